@@ -36,3 +36,125 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 func (e ErrOffsetOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+type ErrInvalidSessionToken struct{}
+
+func (e ErrInvalidSessionToken) GRPCStatus() *status.Status {
+	return status.New(codes.InvalidArgument, "invalid session token")
+}
+
+func (e ErrInvalidSessionToken) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrSessionTimeout struct {
+	Index uint64
+}
+
+func (e ErrSessionTimeout) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.Unavailable,
+		fmt.Sprintf("timed out waiting for index: %d", e.Index),
+	)
+
+	msg := fmt.Sprintf("The server has not caught up with the session's write yet: %d", e.Index)
+
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+
+	return std
+}
+
+func (e ErrSessionTimeout) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrDraining struct{}
+
+func (e ErrDraining) GRPCStatus() *status.Status {
+	st := status.New(codes.Unavailable, "server is draining")
+
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: "The server is leaving the cluster, retry the call on another server",
+	}
+
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+
+	return std
+}
+
+func (e ErrDraining) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrNotLeader is returned by the calls only the leader serves, with the
+// leader's address for the client to retry there, if there's a leader.
+type ErrNotLeader struct {
+	LeaderAddr string
+}
+
+func (e ErrNotLeader) GRPCStatus() *status.Status {
+	if e.LeaderAddr == "" {
+		return status.New(codes.Unavailable, "the cluster has no leader")
+	}
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("not the leader, the leader is at: %s", e.LeaderAddr),
+	)
+
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: fmt.Sprintf("Retry the call on the leader: %s", e.LeaderAddr),
+	}
+
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+
+	return std
+}
+
+func (e ErrNotLeader) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrUnknownPartition struct {
+	Partition uint32
+}
+
+func (e ErrUnknownPartition) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.InvalidArgument,
+		fmt.Sprintf("unknown partition: %d", e.Partition),
+	)
+
+	msg := fmt.Sprintf("The log has no such partition: %d", e.Partition)
+
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+
+	return std
+}
+
+func (e ErrUnknownPartition) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
@@ -27,6 +27,9 @@ type LogClient interface {
 	ConsumeStream(ctx context.Context, in *ConsumeRequest, opts ...grpc.CallOption) (Log_ConsumeStreamClient, error)
 	ProduceStream(ctx context.Context, opts ...grpc.CallOption) (Log_ProduceStreamClient, error)
 	GetServers(ctx context.Context, in *GetServersRequest, opts ...grpc.CallOption) (*GetServersResponse, error)
+	// WatchServers sends the servers, then the servers again whenever the
+	// leadership or the configuration changes.
+	WatchServers(ctx context.Context, in *WatchServersRequest, opts ...grpc.CallOption) (Log_WatchServersClient, error)
 }
 
 type logClient struct {
@@ -127,6 +130,38 @@ func (c *logClient) GetServers(ctx context.Context, in *GetServersRequest, opts
 	return out, nil
 }
 
+func (c *logClient) WatchServers(ctx context.Context, in *WatchServersRequest, opts ...grpc.CallOption) (Log_WatchServersClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Log_ServiceDesc.Streams[2], "/log.v1.Log/WatchServers", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &logWatchServersClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Log_WatchServersClient interface {
+	Recv() (*GetServersResponse, error)
+	grpc.ClientStream
+}
+
+type logWatchServersClient struct {
+	grpc.ClientStream
+}
+
+func (x *logWatchServersClient) Recv() (*GetServersResponse, error) {
+	m := new(GetServersResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // LogServer is the server API for Log service.
 // All implementations must embed UnimplementedLogServer
 // for forward compatibility
@@ -136,6 +171,9 @@ type LogServer interface {
 	ConsumeStream(*ConsumeRequest, Log_ConsumeStreamServer) error
 	ProduceStream(Log_ProduceStreamServer) error
 	GetServers(context.Context, *GetServersRequest) (*GetServersResponse, error)
+	// WatchServers sends the servers, then the servers again whenever the
+	// leadership or the configuration changes.
+	WatchServers(*WatchServersRequest, Log_WatchServersServer) error
 	mustEmbedUnimplementedLogServer()
 }
 
@@ -158,6 +196,9 @@ func (UnimplementedLogServer) ProduceStream(Log_ProduceStreamServer) error {
 func (UnimplementedLogServer) GetServers(context.Context, *GetServersRequest) (*GetServersResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetServers not implemented")
 }
+func (UnimplementedLogServer) WatchServers(*WatchServersRequest, Log_WatchServersServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchServers not implemented")
+}
 func (UnimplementedLogServer) mustEmbedUnimplementedLogServer() {}
 
 // UnsafeLogServer may be embedded to opt out of forward compatibility for this service.
@@ -272,6 +313,27 @@ func _Log_GetServers_Handler(srv interface{}, ctx context.Context, dec func(inte
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Log_WatchServers_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchServersRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(LogServer).WatchServers(m, &logWatchServersServer{stream})
+}
+
+type Log_WatchServersServer interface {
+	Send(*GetServersResponse) error
+	grpc.ServerStream
+}
+
+type logWatchServersServer struct {
+	grpc.ServerStream
+}
+
+func (x *logWatchServersServer) Send(m *GetServersResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 // Log_ServiceDesc is the grpc.ServiceDesc for Log service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -304,6 +366,11 @@ var Log_ServiceDesc = grpc.ServiceDesc{
 			ServerStreams: true,
 			ClientStreams: true,
 		},
+		{
+			StreamName:    "WatchServers",
+			Handler:       _Log_WatchServers_Handler,
+			ServerStreams: true,
+		},
 	},
 	Metadata: "api/v1/log.proto",
 }
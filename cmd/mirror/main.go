@@ -0,0 +1,60 @@
+// Command mirror continuously copies the log of a source cluster to a
+// target cluster, e.g. from the primary to the DR cluster:
+//
+//	mirror -source 10.0.0.1:8400 -target 10.1.0.1:8400 -checkpoint mirror.json
+//
+// Each mirrored record keeps its source offset in its metadata. The
+// checkpoint file lets the mirror resume where it stopped after a restart.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/fedoroko/proglog/internal/config"
+	"github.com/fedoroko/proglog/internal/mirror"
+)
+
+func main() {
+	source := flag.String("source", "", "RPC address of a server in the source cluster")
+	target := flag.String("target", "", "RPC address of a server in the target cluster")
+	checkpoint := flag.String("checkpoint", "mirror.json", "path of the checkpoint file")
+	startOffset := flag.Uint64("start-offset", 0, "source offset to start from without a checkpoint")
+	caFile := flag.String("ca-file", config.CAFile, "CA certificate")
+	certFile := flag.String("cert-file", config.RootClientCertFile, "client certificate")
+	keyFile := flag.String("key-file", config.RootClientKeyFile, "client key")
+	flag.Parse()
+	if *source == "" || *target == "" {
+		log.Fatal("both the source and the target are required")
+	}
+
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: *certFile,
+		KeyFile:  *keyFile,
+		CAFile:   *caFile,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	m, err := mirror.New(mirror.Config{
+		SourceAddr:     *source,
+		TargetAddr:     *target,
+		TLSConfig:      tlsConfig,
+		CheckpointFile: *checkpoint,
+		StartOffset:    *startOffset,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	<-sigc
+	if err = m.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
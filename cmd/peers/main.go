@@ -0,0 +1,90 @@
+// Command peers writes the peers file to recover a cluster that has lost
+// its quorum. It asks the surviving servers for their raft configuration
+// and keeps the servers that answered:
+//
+//	peers -addrs 10.0.0.1:8400,10.0.0.2:8400 -out peers.json
+//
+// Then stop the survivors, copy the file into each one's data dir
+// and start them again.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	api "github.com/fedoroko/proglog/api/v1"
+	"github.com/fedoroko/proglog/internal/config"
+	dlog "github.com/fedoroko/proglog/internal/log"
+)
+
+func main() {
+	addrs := flag.String("addrs", "", "comma separated RPC addresses of the surviving servers")
+	out := flag.String("out", dlog.PeersFile, "path to write the peers file to")
+	caFile := flag.String("ca-file", config.CAFile, "CA certificate")
+	certFile := flag.String("cert-file", config.RootClientCertFile, "client certificate")
+	keyFile := flag.String("key-file", config.RootClientKeyFile, "client key")
+	flag.Parse()
+	if *addrs == "" {
+		log.Fatal("no surviving servers given")
+	}
+
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: *certFile,
+		KeyFile:  *keyFile,
+		CAFile:   *caFile,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	survivors := make(map[string]bool)
+	var configuration []*api.Server
+	for _, addr := range strings.Split(*addrs, ",") {
+		conn, err := grpc.DialContext(ctx, addr, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+		if err != nil {
+			log.Fatal(err)
+		}
+		client := api.NewAdminClient(conn)
+
+		stats, err := client.GetRaftStats(ctx, &api.GetRaftStatsRequest{})
+		if err != nil {
+			log.Printf("skipping %s: %v", addr, err)
+			_ = conn.Close()
+			continue
+		}
+		survivors[stats.Stats.Id] = true
+
+		if configuration == nil {
+			res, err := client.GetRaftConfiguration(ctx, &api.GetRaftConfigurationRequest{})
+			if err != nil {
+				log.Fatal(err)
+			}
+			configuration = res.Servers
+		}
+		_ = conn.Close()
+	}
+
+	var servers []*api.Server
+	for _, server := range configuration {
+		if survivors[server.Id] {
+			servers = append(servers, server)
+		}
+	}
+	if len(servers) == 0 {
+		log.Fatal("none of the servers answered")
+	}
+
+	if err = dlog.WritePeers(*out, servers); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("wrote %d servers to %s", len(servers), *out)
+}
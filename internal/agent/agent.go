@@ -1,11 +1,11 @@
 package agent
 
 import (
-	"bytes"
 	"crypto/tls"
 	"fmt"
-	"io"
 	"net"
+	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
@@ -16,6 +16,7 @@ import (
 	"google.golang.org/grpc/credentials"
 
 	"github.com/fedoroko/proglog/internal/auth"
+	"github.com/fedoroko/proglog/internal/autopilot"
 	"github.com/fedoroko/proglog/internal/discovery"
 	"github.com/fedoroko/proglog/internal/log"
 	"github.com/fedoroko/proglog/internal/server"
@@ -26,8 +27,15 @@ type Agent struct {
 
 	mux        cmux.CMux
 	log        *log.DistributedLog
+	partitions *log.PartitionedLog
 	server     *grpc.Server
-	membership *discovery.Membership
+	membership discovery.Provider
+	drainer    *drainer
+	autopilot  *autopilot.Autopilot
+	stats      *statsFetcher
+	http       *http.Server
+	authorizer *auth.Authorizer
+	logLevel   zap.AtomicLevel
 
 	shutdown     bool
 	shutdowns    chan struct{}
@@ -45,6 +53,56 @@ type Config struct {
 	StartJoinAddrs  []string
 	ACLModelFile    string
 	ACLPolicyFile   string
+	// ReadReplica starts the agent as a non-voter, that replicates the log
+	// and serves consumes without taking part in the raft quorum.
+	ReadReplica bool
+	// SkipLeaveOnShutdown keeps the node in the raft configuration on
+	// shutdown, so it rejoins when started over the same data dir.
+	// Otherwise the agent leaves the cluster for good on shutdown.
+	SkipLeaveOnShutdown bool
+	// DrainOnSignal drains the agent on SIGTERM, giving the calls in
+	// flight DrainTimeout (30 seconds by default) to finish.
+	DrainOnSignal bool
+	DrainTimeout  time.Duration
+	// ReapTimeout is how long a failed node keeps its place in the
+	// raft configuration before it's removed.
+	ReapTimeout time.Duration
+	// GossipKeyringFile holds the keys serf encrypts gossip with, see
+	// discovery.Config.KeyringFile. The keys are managed through the
+	// keyring RPCs.
+	GossipKeyringFile string
+	// Autopilot, when set, has the leader watch over the servers' health,
+	// join new servers as non-voters until they're stable and clean up the
+	// servers that have left.
+	Autopilot *autopilot.Config
+	// VerifyPeers requires the node's peer and server certificates to
+	// name the node, and rejects the peers whose certificates don't.
+	VerifyPeers bool
+	// DiscoveryFile or DiscoverySRV replace serf gossip, for the
+	// environments that block it, with the nodes listed in a file or
+	// behind a DNS SRV name. Every DiscoveryInterval, 5 seconds by
+	// default, the file is checked and reread once it's changed, the
+	// SRV name resolved again.
+	DiscoveryFile     string
+	DiscoverySRV      string
+	DiscoveryInterval time.Duration
+	// Zone is the availability zone the node runs in, advertised to the
+	// clients so they consume from the followers in their own zone.
+	Zone string
+	// LeaderZone keeps the leadership in the zone: a leader elsewhere
+	// hands it over to a voter in the zone. The leader checks every
+	// LeaderZoneInterval, 5 seconds by default.
+	LeaderZone         string
+	LeaderZoneInterval time.Duration
+	// HTTPAddr, when set, serves the members over HTTP as well, at
+	// GET /members, with the server's TLS config.
+	HTTPAddr string
+	// Partitions, when more than 1, runs a raft group per partition, with
+	// the leaders balanced across the servers. The partition 0 is the log
+	// the admin RPCs and the sessions are served by. Every agent of the
+	// cluster runs the same number of partitions, which can't change once
+	// the cluster is bootstrapped.
+	Partitions int
 }
 
 func (c Config) RPCAddr() (string, error) {
@@ -58,14 +116,17 @@ func (c Config) RPCAddr() (string, error) {
 func New(config Config) (*Agent, error) {
 	a := &Agent{
 		Config:    config,
+		drainer:   &drainer{},
 		shutdowns: make(chan struct{}),
 	}
 	setup := []func() error{
 		a.setupLogger,
 		a.setupMux,
 		a.setupLog,
+		a.setupAutopilot,
 		a.setupServer,
 		a.setupMembership,
+		a.setupHTTP,
 	}
 	for _, fn := range setup {
 		if err := fn(); err != nil {
@@ -74,6 +135,12 @@ func New(config Config) (*Agent, error) {
 	}
 
 	go a.serve()
+	if a.Config.LeaderZone != "" {
+		go a.keepLeaderInZone()
+	}
+	if a.Config.DrainOnSignal {
+		go a.drainOnSignal()
+	}
 	return a, nil
 }
 
@@ -89,7 +156,9 @@ func (a *Agent) setupMux() error {
 }
 
 func (a *Agent) setupLogger() error {
-	logger, err := zap.NewDevelopment()
+	config := zap.NewDevelopmentConfig()
+	a.logLevel = config.Level
+	logger, err := config.Build()
 	if err != nil {
 		return err
 	}
@@ -98,14 +167,17 @@ func (a *Agent) setupLogger() error {
 }
 
 func (a *Agent) setupLog() error {
-	raftLn := a.mux.Match(func(reader io.Reader) bool {
-		b := make([]byte, 1)
-		if _, err := reader.Read(b); err != nil {
-			return false
-		}
+	if a.Config.Bootstrap && a.Config.ReadReplica {
+		return fmt.Errorf("read replica can't bootstrap the cluster")
+	}
+	if a.Config.Partitions > 1 && a.Config.Autopilot != nil {
+		return fmt.Errorf("autopilot can't manage a partitioned log")
+	}
+	if a.Config.Partitions > 1 && a.Config.LeaderZone != "" {
+		return fmt.Errorf("a partitioned log balances its leaders across the zones")
+	}
 
-		return bytes.Compare(b, []byte{byte(log.RaftRPC)}) == 0
-	})
+	raftLn := a.mux.Match(log.MatchRaftRPC)
 
 	logConfig := log.Config{}
 	logConfig.Raft.StreamLayer = log.NewStreamLayer(
@@ -113,6 +185,11 @@ func (a *Agent) setupLog() error {
 	)
 	logConfig.Raft.LocalID = raft.ServerID(a.Config.NodeName)
 	logConfig.Raft.Bootstrap = a.Config.Bootstrap
+	logConfig.Raft.VerifyPeers = a.Config.VerifyPeers
+
+	if a.Config.Partitions > 1 {
+		return a.setupPartitionedLog(logConfig)
+	}
 
 	var err error
 	a.log, err = log.NewDistributedLog(a.Config.DataDir, logConfig)
@@ -120,19 +197,70 @@ func (a *Agent) setupLog() error {
 		return err
 	}
 
-	if a.Config.Bootstrap {
+	if a.Config.Bootstrap && !a.log.HasExistingState() {
 		err = a.log.WaitForLeader(3 * time.Second)
 	}
 
 	return err
 }
 
+// setupPartitionedLog runs a raft group per partition, the partition 0
+// standing in for the log.
+func (a *Agent) setupPartitionedLog(logConfig log.Config) error {
+	logConfig.Partitions.Count = a.Config.Partitions
+
+	var err error
+	a.partitions, err = log.NewPartitionedLog(a.Config.DataDir, logConfig)
+	if err != nil {
+		return err
+	}
+	a.log, err = a.partitions.Partition(0)
+	if err != nil {
+		return err
+	}
+
+	if a.Config.Bootstrap && !a.log.HasExistingState() {
+		err = a.partitions.WaitForLeader(3 * time.Second)
+	}
+
+	return err
+}
+
+func (a *Agent) setupAutopilot() error {
+	if a.Config.Autopilot == nil {
+		return nil
+	}
+
+	a.stats = newStatsFetcher(a.Config.PeerTLSConfig)
+	a.autopilot = autopilot.New(a.log, a.stats, *a.Config.Autopilot)
+	return nil
+}
+
 func (a *Agent) setupServer() error {
-	authorizer := auth.New(a.Config.ACLModelFile, a.Config.ACLPolicyFile)
+	a.authorizer = auth.New(a.Config.ACLModelFile, a.Config.ACLPolicyFile)
+	servers := &zonedServers{agent: a}
 	serverConfig := &server.Config{
-		CommitLog:   a.log,
-		Authorizer:  authorizer,
-		GetServerer: a.log,
+		CommitLog:      a.log,
+		Authorizer:     a.authorizer,
+		GetServerer:    servers,
+		ServerWatcher:  servers,
+		SessionLog:     a.log,
+		Admin:          a.log,
+		Drainer:        a.drainer,
+		Membership:     &members{agent: a},
+		Keyring:        &keyring{agent: a},
+		Events:         &events{agent: a},
+		Decommissioner: &decommissioner{agent: a},
+	}
+	if a.autopilot != nil {
+		serverConfig.Autopilot = a.autopilot
+	}
+	if a.partitions != nil {
+		serverConfig.Partitions = a.partitions
+		serverConfig.Admin = &partitionedAdmin{
+			DistributedLog: a.log,
+			partitions:     a.partitions,
+		}
 	}
 	var opts []grpc.ServerOption
 	if a.Config.ServerTLSConfig != nil {
@@ -162,16 +290,78 @@ func (a *Agent) setupMembership() error {
 		return err
 	}
 
-	a.membership, err = discovery.New(a.log, discovery.Config{
-		NodeName: a.Config.NodeName,
-		BindAddr: a.Config.BindAddr,
-		Tags: map[string]string{
-			"rpc_addr": rpcAddr,
-		},
-		StartJoinAddrs: a.Config.StartJoinAddrs,
-	})
+	var handler discovery.Handler = a.log
+	if a.autopilot != nil {
+		handler = a.autopilot
+	}
+	if a.partitions != nil {
+		handler = a.partitions
+	}
+	switch {
+	case a.Config.DiscoveryFile != "":
+		a.membership, err = discovery.NewStatic(handler, discovery.StaticConfig{
+			NodeName: a.Config.NodeName,
+			File:     a.Config.DiscoveryFile,
+			Interval: a.Config.DiscoveryInterval,
+		})
+	case a.Config.DiscoverySRV != "":
+		a.membership, err = discovery.NewDNS(handler, discovery.DNSConfig{
+			NodeName: a.Config.NodeName,
+			Name:     a.Config.DiscoverySRV,
+			Interval: a.Config.DiscoveryInterval,
+		})
+	default:
+		a.membership, err = discovery.New(handler, discovery.Config{
+			NodeName: a.Config.NodeName,
+			BindAddr: a.Config.BindAddr,
+			Tags: map[string]string{
+				"rpc_addr":     rpcAddr,
+				"read_replica": strconv.FormatBool(a.Config.ReadReplica),
+				"zone":         a.Config.Zone,
+			},
+			StartJoinAddrs: a.Config.StartJoinAddrs,
+			ReapTimeout:    a.Config.ReapTimeout,
+			KeyringFile:    a.Config.GossipKeyringFile,
+		})
+	}
+	if err != nil {
+		return err
+	}
+	if membership, ok := a.membership.(*discovery.Membership); ok {
+		a.handleQueries(membership)
+	}
 
-	return err
+	if a.autopilot != nil {
+		a.autopilot.Start(a.membership)
+	}
+	return nil
+}
+
+func (a *Agent) setupHTTP() error {
+	if a.Config.HTTPAddr == "" {
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", a.Config.HTTPAddr)
+	if err != nil {
+		return err
+	}
+	if a.Config.ServerTLSConfig != nil {
+		ln = tls.NewListener(ln, a.Config.ServerTLSConfig)
+	}
+	a.http = &http.Server{
+		Handler: server.NewMembersHandler(&server.Config{
+			Authorizer: a.authorizer,
+			Membership: &members{agent: a},
+		}),
+	}
+	go func() {
+		if err := a.http.Serve(ln); err != http.ErrServerClosed {
+			_ = a.Shutdown()
+		}
+	}()
+
+	return nil
 }
 
 func (a *Agent) Shutdown() error {
@@ -186,12 +376,40 @@ func (a *Agent) Shutdown() error {
 	close(a.shutdowns)
 
 	shutdown := []func() error{
-		a.membership.Leave,
+		func() error {
+			if a.Config.SkipLeaveOnShutdown {
+				return nil
+			}
+			return a.membership.Leave()
+		},
+		func() error {
+			if a.http == nil {
+				return nil
+			}
+			return a.http.Close()
+		},
 		func() error {
 			a.server.GracefulStop()
 			return nil
 		},
-		a.log.Close,
+		func() error {
+			if a.autopilot == nil {
+				return nil
+			}
+			a.autopilot.Stop()
+			return a.stats.Close()
+		},
+		func() error {
+			if a.partitions != nil {
+				return a.partitions.Close()
+			}
+			return a.log.Close()
+		},
+		a.membership.Shutdown,
+		func() error {
+			a.mux.Close()
+			return nil
+		},
 	}
 
 	for _, fn := range shutdown {
@@ -1,77 +1,38 @@
 package agent
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/travisjeffery/go-dynaport"
+	"go.uber.org/zap/zapcore"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/durationpb"
 
 	api "github.com/fedoroko/proglog/api/v1"
+	"github.com/fedoroko/proglog/internal/autopilot"
 	"github.com/fedoroko/proglog/internal/config"
 	"github.com/fedoroko/proglog/internal/loadbalance"
 )
 
 func TestAgent(t *testing.T) {
-	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
-		CertFile:      config.ServerCertFile,
-		KeyFile:       config.ServerKeyFile,
-		CAFile:        config.CAFile,
-		Server:        true,
-		ServerAddress: "127.0.0.1",
-	})
-	require.NoError(t, err)
-
-	peerTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
-		CertFile:      config.RootClientCertFile,
-		KeyFile:       config.RootClientKeyFile,
-		CAFile:        config.CAFile,
-		Server:        false,
-		ServerAddress: "127.0.0.1",
-	})
-	require.NoError(t, err)
-
-	var agents []*Agent
-	for i := 0; i < 3; i++ {
-		ports := dynaport.Get(2)
-		bindAddr := fmt.Sprintf("%s:%d", "127.0.0.1", ports[0])
-		rpcPort := ports[1]
-
-		dataDir, err := ioutil.TempDir("", "agent-test-log")
-		require.NoError(t, err)
-
-		var startJoinAddrs []string
-		if i != 0 {
-			startJoinAddrs = append(
-				startJoinAddrs,
-				agents[0].Config.BindAddr,
-			)
-		}
-
-		agent, err := New(Config{
-			Bootstrap:       i == 0,
-			NodeName:        fmt.Sprintf("%d", i),
-			StartJoinAddrs:  startJoinAddrs,
-			BindAddr:        bindAddr,
-			RPCPort:         rpcPort,
-			DataDir:         dataDir,
-			ACLModelFile:    config.ACLModelFile,
-			ACLPolicyFile:   config.ACLPolicyFile,
-			ServerTLSConfig: serverTLSConfig,
-			PeerTLSConfig:   peerTLSConfig,
-		})
-		require.NoError(t, err)
-		agents = append(agents, agent)
-	}
-
+	agents, peerTLSConfig := setupAgents(t, 3)
 	defer func() {
 		for _, agent := range agents {
 			err := agent.Shutdown()
@@ -124,6 +85,677 @@ func TestAgent(t *testing.T) {
 	got := status.Code(err)
 	want := status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err())
 	require.Equal(t, want, got)
+
+	// the RPCs other than the produces and consumes are routed too
+	servers, err := leaderClient.GetServers(context.Background(), &api.GetServersRequest{})
+	require.NoError(t, err)
+	require.Equal(t, 3, len(servers.Servers))
+}
+
+func TestAgentRestart(t *testing.T) {
+	agents, peerTLSConfig := setupAgents(t, 3, func(c *Config) {
+		c.SkipLeaveOnShutdown = true
+	})
+	defer func() {
+		for _, agent := range agents {
+			err := agent.Shutdown()
+			require.NoError(t, err)
+			require.NoError(t, os.RemoveAll(agent.Config.DataDir))
+		}
+	}()
+
+	time.Sleep(time.Second * 3)
+
+	produceResponse, err := client(t, agents[0], peerTLSConfig).Produce(
+		context.Background(),
+		&api.ProduceRequest{
+			Record: &api.Record{
+				Value: []byte("foo"),
+			},
+		},
+	)
+	require.NoError(t, err)
+
+	time.Sleep(time.Second * 3)
+
+	for _, agent := range agents {
+		require.NoError(t, agent.Shutdown())
+	}
+	for i, agent := range agents {
+		agents[i], err = New(agent.Config)
+		require.NoError(t, err)
+	}
+
+	require.Eventually(t, func() bool {
+		servers, err := agents[0].log.GetServers()
+		if err != nil || len(servers) != 3 {
+			return false
+		}
+		for _, server := range servers {
+			if server.IsLeader {
+				return true
+			}
+		}
+		return false
+	}, 10*time.Second, 250*time.Millisecond)
+
+	for _, agent := range agents {
+		require.Eventually(t, func() bool {
+			record, err := agent.log.Read(produceResponse.Offset)
+			return err == nil && bytes.Equal([]byte("foo"), record.Value)
+		}, 3*time.Second, 50*time.Millisecond)
+	}
+
+	for _, agent := range agents {
+		_, err = agent.log.Read(produceResponse.Offset + 1)
+		require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	}
+
+	require.Eventually(t, func() bool {
+		_, err = client(t, agents[0], peerTLSConfig).Produce(
+			context.Background(),
+			&api.ProduceRequest{
+				Record: &api.Record{
+					Value: []byte("bar"),
+				},
+			},
+		)
+		return err == nil
+	}, 3*time.Second, 250*time.Millisecond)
+}
+
+func TestAgentDrain(t *testing.T) {
+	agents, peerTLSConfig := setupAgents(t, 3)
+	defer func() {
+		for _, agent := range agents {
+			err := agent.Shutdown()
+			require.NoError(t, err)
+			require.NoError(t, os.RemoveAll(agent.Config.DataDir))
+		}
+	}()
+
+	time.Sleep(time.Second * 3)
+
+	produceResponse, err := client(t, agents[0], peerTLSConfig).Produce(
+		context.Background(),
+		&api.ProduceRequest{
+			Record: &api.Record{
+				Value: []byte("foo"),
+			},
+		},
+	)
+	require.NoError(t, err)
+
+	leaderClient := directClient(t, agents[0], peerTLSConfig)
+	stream, err := leaderClient.ConsumeStream(
+		context.Background(),
+		&api.ConsumeRequest{Offset: produceResponse.Offset},
+	)
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("foo"), res.Record.Value)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, agents[0].Drain(ctx))
+
+	// the caught up stream is ended with the drain's status
+	_, err = stream.Recv()
+	require.Equal(t, api.ErrDraining{}.GRPCStatus().Message(), status.Convert(err).Message())
+
+	require.Eventually(t, func() bool {
+		servers, err := agents[1].log.GetServers()
+		if err != nil || len(servers) != 2 {
+			return false
+		}
+		for _, server := range servers {
+			if server.Id == agents[0].Config.NodeName {
+				return false
+			}
+			if server.IsLeader {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 100*time.Millisecond)
+
+	require.Eventually(t, func() bool {
+		_, err = client(t, agents[1], peerTLSConfig).Produce(
+			context.Background(),
+			&api.ProduceRequest{
+				Record: &api.Record{
+					Value: []byte("bar"),
+				},
+			},
+		)
+		return err == nil
+	}, 3*time.Second, 250*time.Millisecond)
+}
+
+func TestAgentDrainRPC(t *testing.T) {
+	agents, peerTLSConfig := setupAgents(t, 3)
+	defer func() {
+		for _, agent := range agents {
+			err := agent.Shutdown()
+			require.NoError(t, err)
+			require.NoError(t, os.RemoveAll(agent.Config.DataDir))
+		}
+	}()
+
+	require.Eventually(t, func() bool {
+		servers, err := agents[0].log.GetServers()
+		return err == nil && len(servers) == 3
+	}, 5*time.Second, 100*time.Millisecond)
+
+	rpcAddr, err := agents[2].RPCAddr()
+	require.NoError(t, err)
+	conn, err := grpc.Dial(rpcAddr, grpc.WithTransportCredentials(credentials.NewTLS(peerTLSConfig)))
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = api.NewAdminClient(conn).Drain(
+		context.Background(),
+		&api.DrainRequest{Timeout: durationpb.New(time.Second)},
+	)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		servers, err := agents[0].log.GetServers()
+		if err != nil || len(servers) != 2 {
+			return false
+		}
+		for _, server := range servers {
+			if server.Id == agents[2].Config.NodeName {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 100*time.Millisecond)
+}
+
+func TestDrainerRejectsNewCalls(t *testing.T) {
+	d := &drainer{}
+	require.NoError(t, d.Acquire())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, d.drain(ctx), context.DeadlineExceeded)
+	require.True(t, d.Draining())
+	require.Equal(t, api.ErrDraining{}, d.Acquire())
+
+	d.Release()
+	require.NoError(t, d.drain(context.Background()))
+
+	require.True(t, d.begin())
+	require.False(t, d.begin())
+}
+
+func TestAgentAutopilot(t *testing.T) {
+	agents, peerTLSConfig := setupAgents(t, 3, func(c *Config) {
+		c.Autopilot = &autopilot.Config{
+			Interval:                100 * time.Millisecond,
+			LastContactThreshold:    time.Second,
+			ServerStabilizationTime: time.Second,
+		}
+	})
+	defer func() {
+		for _, agent := range agents {
+			err := agent.Shutdown()
+			require.NoError(t, err)
+			require.NoError(t, os.RemoveAll(agent.Config.DataDir))
+		}
+	}()
+
+	rpcAddr, err := agents[0].RPCAddr()
+	require.NoError(t, err)
+	conn, err := grpc.Dial(rpcAddr, grpc.WithTransportCredentials(credentials.NewTLS(peerTLSConfig)))
+	require.NoError(t, err)
+	defer conn.Close()
+	admin := api.NewAdminClient(conn)
+
+	require.Eventually(t, func() bool {
+		res, err := admin.GetClusterHealth(context.Background(), &api.GetClusterHealthRequest{})
+		if err != nil || len(res.Health.Servers) != 3 {
+			return false
+		}
+		for _, server := range res.Health.Servers {
+			if server.Role != api.Role_VOTER {
+				return false
+			}
+		}
+		return res.Health.Healthy && res.Health.FailureTolerance == 1
+	}, 15*time.Second, 250*time.Millisecond)
+}
+
+func TestAgentStaticDiscovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent-test-discovery")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "members.json")
+
+	// each agent lists itself before it starts, as an operator would
+	var members []map[string]string
+	agents, peerTLSConfig := setupAgents(t, 3, func(c *Config) {
+		rpcAddr, err := c.RPCAddr()
+		require.NoError(t, err)
+		members = append(members, map[string]string{
+			"name":     c.NodeName,
+			"rpc_addr": rpcAddr,
+		})
+		b, err := json.Marshal(members)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(file, b, 0644))
+
+		c.DiscoveryFile = file
+		c.DiscoveryInterval = 100 * time.Millisecond
+	})
+	defer func() {
+		for _, agent := range agents {
+			err := agent.Shutdown()
+			require.NoError(t, err)
+			require.NoError(t, os.RemoveAll(agent.Config.DataDir))
+		}
+	}()
+
+	leaderClient := directClient(t, agents[0], peerTLSConfig)
+	require.Eventually(t, func() bool {
+		res, err := leaderClient.GetServers(context.Background(), &api.GetServersRequest{})
+		return err == nil && len(res.Servers) == 3
+	}, 5*time.Second, 100*time.Millisecond)
+
+	produceResponse, err := leaderClient.Produce(
+		context.Background(),
+		&api.ProduceRequest{Record: &api.Record{Value: []byte("foo")}},
+	)
+	require.NoError(t, err)
+	followerClient := directClient(t, agents[2], peerTLSConfig)
+	require.Eventually(t, func() bool {
+		res, err := followerClient.Consume(
+			context.Background(),
+			&api.ConsumeRequest{Offset: produceResponse.Offset},
+		)
+		return err == nil && bytes.Equal(res.Record.Value, []byte("foo"))
+	}, 3*time.Second, 100*time.Millisecond)
+
+	// the file still lists the drained agent, so the leader removes it
+	// from raft on its request
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, agents[2].Drain(ctx))
+	servers, err := agents[0].log.GetServers()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(servers))
+	for _, server := range servers {
+		require.NotEqual(t, agents[2].Config.NodeName, server.Id)
+	}
+}
+
+func TestAgentLeaderZone(t *testing.T) {
+	zones := map[string]string{"0": "a", "1": "b", "2": "c"}
+	agents, peerTLSConfig := setupAgents(t, 3, func(c *Config) {
+		c.Zone = zones[c.NodeName]
+		c.LeaderZone = "b"
+		c.LeaderZoneInterval = 100 * time.Millisecond
+	})
+	defer func() {
+		for _, agent := range agents {
+			err := agent.Shutdown()
+			require.NoError(t, err)
+			require.NoError(t, os.RemoveAll(agent.Config.DataDir))
+		}
+	}()
+
+	// the bootstrapping agent leads until the others join, then hands
+	// the leadership over to the agent in the leader zone
+	client := directClient(t, agents[2], peerTLSConfig)
+	require.Eventually(t, func() bool {
+		res, err := client.GetServers(context.Background(), &api.GetServersRequest{})
+		if err != nil || len(res.Servers) != 3 {
+			return false
+		}
+		for _, server := range res.Servers {
+			if server.Zone != zones[server.Id] || server.IsLeader != (server.Id == "1") {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 100*time.Millisecond)
+}
+
+func TestAgentPartitions(t *testing.T) {
+	partitions := 3
+	agents, peerTLSConfig := setupAgents(t, 3, func(c *Config) {
+		c.Partitions = partitions
+	})
+	defer func() {
+		for _, agent := range agents {
+			require.NoError(t, agent.Shutdown())
+			require.NoError(t, os.RemoveAll(agent.Config.DataDir))
+		}
+	}()
+	ctx := context.Background()
+
+	// the leaders spread across the agents
+	c := client(t, agents[0], peerTLSConfig)
+	require.Eventually(t, func() bool {
+		res, err := c.GetServers(ctx, &api.GetServersRequest{})
+		if err != nil || len(res.Servers) != len(agents) {
+			return false
+		}
+		for _, server := range res.Servers {
+			if len(server.LeaderOf) != 1 {
+				return false
+			}
+		}
+		return true
+	}, 20*time.Second, 100*time.Millisecond)
+
+	// the produces go to each partition's leader, and the partitions
+	// keep their own offsets
+	for partition := uint32(0); partition < uint32(partitions); partition++ {
+		res, err := c.Produce(
+			loadbalance.WithPartition(ctx, partition),
+			&api.ProduceRequest{
+				Record:    &api.Record{Value: []byte{byte(partition)}},
+				Partition: partition,
+			},
+		)
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), res.Offset)
+	}
+	for partition := uint32(0); partition < uint32(partitions); partition++ {
+		require.Eventually(t, func() bool {
+			res, err := c.Consume(ctx, &api.ConsumeRequest{Partition: partition})
+			return err == nil && bytes.Equal([]byte{byte(partition)}, res.Record.Value)
+		}, 3*time.Second, 50*time.Millisecond)
+	}
+
+	_, err := c.Produce(ctx, &api.ProduceRequest{
+		Record:    &api.Record{Value: []byte("foo")},
+		Partition: uint32(partitions),
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestAgentWatchServers(t *testing.T) {
+	agents, peerTLSConfig := setupAgents(t, 3)
+	defer func() {
+		for _, agent := range agents {
+			err := agent.Shutdown()
+			require.NoError(t, err)
+			require.NoError(t, os.RemoveAll(agent.Config.DataDir))
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := directClient(t, agents[1], peerTLSConfig).WatchServers(
+		ctx, &api.WatchServersRequest{},
+	)
+	require.NoError(t, err)
+	waitForLeader := func(id string) {
+		for {
+			res, err := stream.Recv()
+			require.NoError(t, err)
+			for _, server := range res.Servers {
+				if len(res.Servers) == 3 && server.Id == id && server.IsLeader {
+					return
+				}
+			}
+		}
+	}
+	waitForLeader("0")
+
+	rpcAddr, err := agents[0].RPCAddr()
+	require.NoError(t, err)
+	conn, err := grpc.Dial(rpcAddr, grpc.WithTransportCredentials(credentials.NewTLS(peerTLSConfig)))
+	require.NoError(t, err)
+	defer conn.Close()
+	// the target has to catch up with the leader to win the election
+	require.Eventually(t, func() bool {
+		_, err := api.NewAdminClient(conn).TransferLeadership(
+			ctx, &api.TransferLeadershipRequest{Id: "2"},
+		)
+		return err == nil
+	}, 5*time.Second, 100*time.Millisecond)
+	waitForLeader("2")
+}
+
+func TestAgentMembers(t *testing.T) {
+	agents, peerTLSConfig := setupAgents(t, 3, func(c *Config) {
+		c.HTTPAddr = fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0])
+		// the agent shut down fails rather than leaves
+		c.SkipLeaveOnShutdown = true
+	})
+	defer func() {
+		for _, agent := range agents {
+			err := agent.Shutdown()
+			require.NoError(t, err)
+			require.NoError(t, os.RemoveAll(agent.Config.DataDir))
+		}
+	}()
+
+	rpcAddr, err := agents[0].RPCAddr()
+	require.NoError(t, err)
+	conn, err := grpc.Dial(rpcAddr, grpc.WithTransportCredentials(credentials.NewTLS(peerTLSConfig)))
+	require.NoError(t, err)
+	defer conn.Close()
+	admin := api.NewAdminClient(conn)
+	ctx := context.Background()
+
+	require.Eventually(t, func() bool {
+		res, err := admin.ListMembers(ctx, &api.ListMembersRequest{})
+		if err != nil || len(res.Members) != 3 {
+			return false
+		}
+		for _, member := range res.Members {
+			if member.Status != "alive" || !member.InRaft || member.Role != api.Role_VOTER {
+				return false
+			}
+		}
+		return res.Members[0].IsLeader
+	}, 5*time.Second, 100*time.Millisecond)
+
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: peerTLSConfig}}
+	res, err := httpClient.Get(fmt.Sprintf("https://%s/members", agents[0].Config.HTTPAddr))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	b, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	var members api.ListMembersResponse
+	require.NoError(t, protojson.Unmarshal(b, &members))
+	require.Equal(t, 3, len(members.Members))
+
+	stream, err := admin.WatchMembers(ctx, &api.WatchMembersRequest{})
+	require.NoError(t, err)
+	// serf takes a while to see the agent failed, the watch is open by then
+	require.NoError(t, agents[2].Shutdown())
+	e, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, api.MemberEventType_MEMBER_FAILED, e.Type)
+	require.Equal(t, "2", e.Member.Name)
+	require.Equal(t, "failed", e.Member.Status)
+	require.True(t, e.Member.InRaft)
+}
+
+func TestAgentGossipKeyring(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent-test-keyring")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	oldKey := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	newKey := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+
+	agents, peerTLSConfig := setupAgents(t, 2, func(c *Config) {
+		c.GossipKeyringFile = filepath.Join(dir, c.NodeName+".json")
+		require.NoError(t, os.WriteFile(
+			c.GossipKeyringFile, []byte(fmt.Sprintf("[%q]", oldKey)), 0600,
+		))
+	})
+	defer func() {
+		for _, agent := range agents {
+			err := agent.Shutdown()
+			require.NoError(t, err)
+			require.NoError(t, os.RemoveAll(agent.Config.DataDir))
+		}
+	}()
+
+	rpcAddr, err := agents[0].RPCAddr()
+	require.NoError(t, err)
+	conn, err := grpc.Dial(rpcAddr, grpc.WithTransportCredentials(credentials.NewTLS(peerTLSConfig)))
+	require.NoError(t, err)
+	defer conn.Close()
+	admin := api.NewAdminClient(conn)
+	ctx := context.Background()
+
+	require.Eventually(t, func() bool {
+		res, err := admin.ListKeys(ctx, &api.ListKeysRequest{})
+		return err == nil && res.Keys[oldKey] == 2
+	}, 5*time.Second, 100*time.Millisecond)
+
+	_, err = admin.InstallKey(ctx, &api.KeyRequest{Key: newKey})
+	require.NoError(t, err)
+	_, err = admin.UseKey(ctx, &api.KeyRequest{Key: newKey})
+	require.NoError(t, err)
+	// the primary key can't be removed
+	_, err = admin.RemoveKey(ctx, &api.KeyRequest{Key: newKey})
+	require.Error(t, err)
+	_, err = admin.RemoveKey(ctx, &api.KeyRequest{Key: oldKey})
+	require.NoError(t, err)
+
+	res, err := admin.ListKeys(ctx, &api.ListKeysRequest{})
+	require.NoError(t, err)
+	require.Equal(t, map[string]int32{newKey: 2}, res.Keys)
+	require.Equal(t, map[string]int32{newKey: 2}, res.PrimaryKeys)
+}
+
+func TestAgentQueries(t *testing.T) {
+	agents, peerTLSConfig := setupAgents(t, 2)
+	defer func() {
+		for _, agent := range agents {
+			err := agent.Shutdown()
+			require.NoError(t, err)
+			require.NoError(t, os.RemoveAll(agent.Config.DataDir))
+		}
+	}()
+
+	rpcAddr, err := agents[0].RPCAddr()
+	require.NoError(t, err)
+	conn, err := grpc.Dial(rpcAddr, grpc.WithTransportCredentials(credentials.NewTLS(peerTLSConfig)))
+	require.NoError(t, err)
+	defer conn.Close()
+	admin := api.NewAdminClient(conn)
+	ctx := context.Background()
+	require.Eventually(t, func() bool {
+		return len(agents[0].membership.Members()) == 2
+	}, 3*time.Second, 100*time.Millisecond)
+
+	res, err := admin.FireQuery(ctx, &api.FireQueryRequest{
+		Name:    SetLogLevelQuery,
+		Payload: []byte("warn"),
+		Timeout: durationpb.New(time.Second),
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res.Responses))
+	for _, r := range res.Responses {
+		require.True(t, r.Responded)
+		require.Equal(t, "debug", string(r.Payload))
+	}
+	for _, agent := range agents {
+		require.Equal(t, zapcore.WarnLevel, agent.logLevel.Level())
+	}
+
+	res, err = admin.FireQuery(ctx, &api.FireQueryRequest{
+		Name:    SetLogLevelQuery,
+		Payload: []byte("loud"),
+		Timeout: durationpb.New(time.Second),
+	})
+	require.NoError(t, err)
+	for _, r := range res.Responses {
+		require.NotEmpty(t, r.Error)
+	}
+
+	res, err = admin.FireQuery(ctx, &api.FireQueryRequest{
+		Name:    ReloadACLQuery,
+		Timeout: durationpb.New(time.Second),
+	})
+	require.NoError(t, err)
+	for _, r := range res.Responses {
+		require.True(t, r.Responded)
+		require.Empty(t, r.Error)
+	}
+
+	// the agents ack the queries they don't handle
+	res, err = admin.FireQuery(ctx, &api.FireQueryRequest{
+		Name:    "unknown",
+		Timeout: durationpb.New(time.Second),
+	})
+	require.NoError(t, err)
+	for _, r := range res.Responses {
+		require.True(t, r.Acked)
+		require.False(t, r.Responded)
+	}
+}
+
+func setupAgents(t *testing.T, count int, opts ...func(*Config)) ([]*Agent, *tls.Config) {
+	t.Helper()
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		Server:        true,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	peerTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
+		CAFile:        config.CAFile,
+		Server:        false,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	var agents []*Agent
+	for i := 0; i < count; i++ {
+		ports := dynaport.Get(2)
+		bindAddr := fmt.Sprintf("%s:%d", "127.0.0.1", ports[0])
+		rpcPort := ports[1]
+
+		dataDir, err := ioutil.TempDir("", "agent-test-log")
+		require.NoError(t, err)
+
+		var startJoinAddrs []string
+		if i != 0 {
+			startJoinAddrs = append(
+				startJoinAddrs,
+				agents[0].Config.BindAddr,
+			)
+		}
+
+		c := Config{
+			Bootstrap:       i == 0,
+			NodeName:        fmt.Sprintf("%d", i),
+			StartJoinAddrs:  startJoinAddrs,
+			BindAddr:        bindAddr,
+			RPCPort:         rpcPort,
+			DataDir:         dataDir,
+			ACLModelFile:    config.ACLModelFile,
+			ACLPolicyFile:   config.ACLPolicyFile,
+			ServerTLSConfig: serverTLSConfig,
+			PeerTLSConfig:   peerTLSConfig,
+		}
+		for _, opt := range opts {
+			opt(&c)
+		}
+
+		agent, err := New(c)
+		require.NoError(t, err)
+		agents = append(agents, agent)
+	}
+
+	return agents, peerTLSConfig
 }
 
 func client(t *testing.T, agent *Agent, tlsConfig *tls.Config) api.LogClient {
@@ -138,3 +770,16 @@ func client(t *testing.T, agent *Agent, tlsConfig *tls.Config) api.LogClient {
 	c := api.NewLogClient(conn)
 	return c
 }
+
+// directClient talks to the agent itself, bypassing the balancer.
+func directClient(t *testing.T, agent *Agent, tlsConfig *tls.Config) api.LogClient {
+	tlsCreds := credentials.NewTLS(tlsConfig)
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(tlsCreds)}
+	rpcAddr, err := agent.RPCAddr()
+	require.NoError(t, err)
+
+	conn, err := grpc.Dial(rpcAddr, opts...)
+	require.NoError(t, err)
+
+	return api.NewLogClient(conn)
+}
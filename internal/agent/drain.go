@@ -0,0 +1,258 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	api "github.com/fedoroko/proglog/api/v1"
+	"github.com/fedoroko/proglog/internal/discovery"
+	"github.com/fedoroko/proglog/internal/log"
+	"github.com/fedoroko/proglog/internal/server"
+)
+
+var _ server.Drainer = (*drainer)(nil)
+
+// drainer counts produce and consume calls in flight and
+// stops admitting new ones once draining starts.
+type drainer struct {
+	mu       sync.RWMutex
+	begun    bool
+	draining bool
+	calls    sync.WaitGroup
+}
+
+// begin reports whether the caller is the first to start draining, so
+// the agent drains once whether on a signal or an RPC.
+func (d *drainer) begin() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.begun {
+		return false
+	}
+	d.begun = true
+	return true
+}
+
+func (d *drainer) Acquire() error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.draining {
+		return api.ErrDraining{}
+	}
+
+	d.calls.Add(1)
+	return nil
+}
+
+func (d *drainer) Release() {
+	d.calls.Done()
+}
+
+func (d *drainer) Draining() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.draining
+}
+
+// drain rejects new calls and waits for the ones in flight
+// to finish, or for the context to be done.
+func (d *drainer) drain(ctx context.Context) error {
+	d.mu.Lock()
+	d.draining = true
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.calls.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Drain decommissions the agent. It hands the leadership over to another
+// server, stops accepting produce and consume calls, gives the calls in
+// flight until the context is done to finish, then leaves the cluster
+// and shuts down. Without serf, the leaders are asked to remove the agent
+// from raft, so its peer certificate must be authorized to remove servers.
+func (a *Agent) Drain(ctx context.Context) error {
+	logger := zap.L().Named("agent")
+	if a.partitions != nil {
+		err := a.partitions.TransferLeadership("")
+		if err != nil && !errors.Is(err, raft.ErrNotLeader) {
+			logger.Warn("failed to transfer leadership", zap.Error(err))
+		}
+	} else if a.log.IsLeader() {
+		if err := a.log.TransferLeadership(""); err != nil {
+			// a single node cluster has nobody to hand over to
+			logger.Warn("failed to transfer leadership", zap.Error(err))
+		}
+	}
+
+	if err := a.drainer.drain(ctx); err != nil {
+		logger.Warn("stopping calls in flight", zap.Error(err))
+		a.server.Stop()
+	}
+
+	// with serf, the leader removes the node from raft once it sees it
+	// leave. The static and DNS providers tell a node that left from one
+	// that's down no better than a poll does, so the node asks the leaders
+	// to remove it.
+	if _, ok := a.membership.(*discovery.Membership); !ok {
+		ctx, cancel := context.WithTimeout(context.Background(), leaveTimeout)
+		defer cancel()
+		if err := a.leaveRaft(ctx); err != nil {
+			return err
+		}
+	}
+	if err := a.membership.Leave(); err != nil {
+		return err
+	}
+
+	return a.Shutdown()
+}
+
+// leaveTimeout is how long a draining agent tries to have the leaders
+// remove it from raft.
+const leaveTimeout = 10 * time.Second
+
+// leaveRaft removes the agent from the raft groups through the RemoveServer
+// admin RPC of their leaders, which returns once the removal is committed.
+// The removals are tried again until they all succeed, or the context is
+// done, since the leadership may move meanwhile.
+func (a *Agent) leaveRaft(ctx context.Context) error {
+	for {
+		err := a.removeThroughLeaders(ctx)
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+}
+
+func (a *Agent) removeThroughLeaders(ctx context.Context) error {
+	var servers []*api.Server
+	var err error
+	if a.partitions != nil {
+		servers, err = a.partitions.GetServers()
+	} else {
+		servers, err = a.log.GetServers()
+	}
+	if err != nil {
+		return err
+	}
+
+	creds := insecure.NewCredentials()
+	if a.Config.PeerTLSConfig != nil {
+		creds = credentials.NewTLS(a.Config.PeerTLSConfig)
+	}
+	for _, server := range servers {
+		// a leader left alone has nobody to remove it
+		if server.Id == a.Config.NodeName ||
+			!server.IsLeader && len(server.LeaderOf) == 0 {
+			continue
+		}
+
+		conn, err := grpc.DialContext(
+			ctx, server.RpcAddr, grpc.WithTransportCredentials(creds),
+		)
+		if err != nil {
+			return err
+		}
+		_, err = api.NewAdminClient(conn).RemoveServer(
+			ctx, &api.RemoveServerRequest{Id: a.Config.NodeName},
+		)
+		_ = conn.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var _ server.Admin = (*partitionedAdmin)(nil)
+
+// partitionedAdmin removes the servers from the raft groups of every
+// partition the server leads, rather than the partition 0's alone.
+type partitionedAdmin struct {
+	*log.DistributedLog
+	partitions *log.PartitionedLog
+}
+
+func (a *partitionedAdmin) Leave(id string) error {
+	return a.partitions.Leave(id)
+}
+
+// drainOnSignal drains the agent once the process gets SIGTERM.
+func (a *Agent) drainOnSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	select {
+	case <-sigs:
+	case <-a.shutdowns:
+		return
+	}
+
+	if a.drainer.begin() {
+		a.drainWithin(0)
+	}
+}
+
+// drainWithin drains the agent, giving the calls in flight the timeout,
+// or the agent's DrainTimeout if zero, to finish.
+func (a *Agent) drainWithin(timeout time.Duration) {
+	if timeout == 0 {
+		timeout = a.Config.DrainTimeout
+	}
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := a.Drain(ctx); err != nil {
+		zap.L().Named("agent").Error("failed to drain", zap.Error(err))
+	}
+}
+
+var _ server.Decommissioner = (*decommissioner)(nil)
+
+// decommissioner drains the agent through the Drain admin RPC.
+type decommissioner struct {
+	agent *Agent
+}
+
+// Drain drains the agent in the background, since the drain ends with
+// the shutdown of the server serving the call.
+func (d *decommissioner) Drain(timeout time.Duration) error {
+	if !d.agent.drainer.begin() {
+		return status.Error(codes.FailedPrecondition, "the agent is already draining")
+	}
+	go d.agent.drainWithin(timeout)
+	return nil
+}
@@ -0,0 +1,89 @@
+package agent
+
+import (
+	"sort"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/fedoroko/proglog/api/v1"
+	"github.com/fedoroko/proglog/internal/discovery"
+)
+
+// The queries every gossiping agent answers, fired through the FireQuery
+// RPC to apply an operational change across the cluster at once.
+const (
+	// SetLogLevelQuery sets the log level to the payload, e.g. "debug",
+	// and answers with the previous level.
+	SetLogLevelQuery = "set-log-level"
+	// ReloadACLQuery rereads the ACL policy file.
+	ReloadACLQuery = "reload-acl"
+)
+
+// events fires the user events and queries through serf.
+type events struct {
+	agent *Agent
+}
+
+func (e *events) FireEvent(name string, payload []byte) error {
+	membership, err := e.membership()
+	if err != nil {
+		return err
+	}
+	return membership.UserEvent(name, payload)
+}
+
+func (e *events) FireQuery(
+	name string, payload []byte, timeout time.Duration,
+) ([]*api.MemberResponse, error) {
+	membership, err := e.membership()
+	if err != nil {
+		return nil, err
+	}
+	responses, err := membership.Query(name, payload, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*api.MemberResponse, 0, len(responses))
+	for member, res := range responses {
+		list = append(list, &api.MemberResponse{
+			Member:    member,
+			Acked:     res.Acked,
+			Responded: res.Responded,
+			Payload:   res.Payload,
+			Error:     res.Error,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Member < list[j].Member
+	})
+
+	return list, nil
+}
+
+func (e *events) membership() (*discovery.Membership, error) {
+	membership, ok := e.agent.membership.(*discovery.Membership)
+	if !ok {
+		return nil, status.Error(codes.FailedPrecondition, "the agent doesn't gossip")
+	}
+	return membership, nil
+}
+
+// handleQueries registers the handlers of the agent's own queries.
+func (a *Agent) handleQueries(membership *discovery.Membership) {
+	membership.HandleQuery(SetLogLevelQuery, func(payload []byte) ([]byte, error) {
+		var level zapcore.Level
+		if err := level.UnmarshalText(payload); err != nil {
+			return nil, err
+		}
+		prev := a.logLevel.Level()
+		a.logLevel.SetLevel(level)
+		return []byte(prev.String()), nil
+	})
+	membership.HandleQuery(ReloadACLQuery, func([]byte) ([]byte, error) {
+		return nil, a.authorizer.Reload()
+	})
+}
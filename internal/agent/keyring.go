@@ -0,0 +1,83 @@
+package agent
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/serf/serf"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/fedoroko/proglog/api/v1"
+	"github.com/fedoroko/proglog/internal/discovery"
+)
+
+// keyring manages the gossip keys through serf's key manager.
+type keyring struct {
+	agent *Agent
+}
+
+func (k *keyring) ListKeys() (*api.KeyringResponse, error) {
+	keyManager, err := k.keyManager()
+	if err != nil {
+		return nil, err
+	}
+	return keyringResponse(keyManager.ListKeys())
+}
+
+func (k *keyring) InstallKey(key string) (*api.KeyringResponse, error) {
+	keyManager, err := k.keyManager()
+	if err != nil {
+		return nil, err
+	}
+	return keyringResponse(keyManager.InstallKey(key))
+}
+
+func (k *keyring) UseKey(key string) (*api.KeyringResponse, error) {
+	keyManager, err := k.keyManager()
+	if err != nil {
+		return nil, err
+	}
+	return keyringResponse(keyManager.UseKey(key))
+}
+
+func (k *keyring) RemoveKey(key string) (*api.KeyringResponse, error) {
+	keyManager, err := k.keyManager()
+	if err != nil {
+		return nil, err
+	}
+	return keyringResponse(keyManager.RemoveKey(key))
+}
+
+func (k *keyring) keyManager() (*serf.KeyManager, error) {
+	membership, ok := k.agent.membership.(*discovery.Membership)
+	if !ok {
+		return nil, status.Error(codes.FailedPrecondition, "the agent doesn't gossip")
+	}
+	return membership.KeyManager(), nil
+}
+
+func keyringResponse(res *serf.KeyResponse, err error) (*api.KeyringResponse, error) {
+	if err != nil {
+		// the messages tell which members failed, and why
+		if res != nil && len(res.Messages) != 0 {
+			return nil, fmt.Errorf("%w: %v", err, res.Messages)
+		}
+		return nil, err
+	}
+
+	keys := make(map[string]int32, len(res.Keys))
+	for key, count := range res.Keys {
+		keys[key] = int32(count)
+	}
+	primaryKeys := make(map[string]int32, len(res.PrimaryKeys))
+	for key, count := range res.PrimaryKeys {
+		primaryKeys[key] = int32(count)
+	}
+
+	return &api.KeyringResponse{
+		NumNodes:    int32(res.NumNodes),
+		NumResp:     int32(res.NumResp),
+		Keys:        keys,
+		PrimaryKeys: primaryKeys,
+	}, nil
+}
@@ -0,0 +1,105 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/hashicorp/serf/serf"
+
+	api "github.com/fedoroko/proglog/api/v1"
+)
+
+// members lists the agent's members, with the roles they have in raft.
+type members struct {
+	agent *Agent
+}
+
+func (m *members) ListMembers() ([]*api.Member, error) {
+	servers, err := m.agent.log.GetServers()
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*api.Member
+	for _, member := range m.agent.membership.Members() {
+		list = append(list, newMember(member, servers))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+
+	return list, nil
+}
+
+// WatchMembers ends the watch on the agent's shutdown too, so the open
+// watches don't hold the server's graceful stop up.
+func (m *members) WatchMembers(ctx context.Context) (<-chan *api.MemberEvent, error) {
+	events, stop := m.agent.membership.Watch()
+	ch := make(chan *api.MemberEvent)
+	go func() {
+		defer close(ch)
+		defer stop()
+		for {
+			var e serf.MemberEvent
+			var ok bool
+			select {
+			case e, ok = <-events:
+				if !ok {
+					return
+				}
+			case <-ctx.Done():
+				return
+			case <-m.agent.shutdowns:
+				return
+			}
+
+			// the roles are as good as they get, without the configuration
+			servers, _ := m.agent.log.GetServers()
+			for _, member := range e.Members {
+				select {
+				case ch <- &api.MemberEvent{
+					Type:   memberEventTypes[e.Type],
+					Member: newMember(member, servers),
+				}:
+				case <-ctx.Done():
+					return
+				case <-m.agent.shutdowns:
+					return
+				}
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+var memberEventTypes = map[serf.EventType]api.MemberEventType{
+	serf.EventMemberJoin:   api.MemberEventType_MEMBER_JOIN,
+	serf.EventMemberLeave:  api.MemberEventType_MEMBER_LEAVE,
+	serf.EventMemberFailed: api.MemberEventType_MEMBER_FAILED,
+	serf.EventMemberUpdate: api.MemberEventType_MEMBER_UPDATE,
+	serf.EventMemberReap:   api.MemberEventType_MEMBER_REAP,
+}
+
+func newMember(member serf.Member, servers []*api.Server) *api.Member {
+	m := &api.Member{
+		Name:    member.Name,
+		RpcAddr: member.Tags["rpc_addr"],
+		Tags:    member.Tags,
+		Status:  member.Status.String(),
+	}
+	if member.Addr != nil {
+		m.Addr = net.JoinHostPort(member.Addr.String(), strconv.Itoa(int(member.Port)))
+	}
+	for _, server := range servers {
+		if server.Id == member.Name {
+			m.InRaft = true
+			m.Role = server.Role
+			m.IsLeader = server.IsLeader
+		}
+	}
+
+	return m
+}
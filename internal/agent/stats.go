@@ -0,0 +1,99 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+
+	api "github.com/fedoroko/proglog/api/v1"
+	"github.com/fedoroko/proglog/internal/autopilot"
+)
+
+var _ autopilot.StatsFetcher = (*statsFetcher)(nil)
+
+// statsFetcher gets the other servers' raft stats through their admin
+// service, keeping a connection to each server in the configuration for
+// the next checks.
+type statsFetcher struct {
+	tlsConfig *tls.Config
+
+	mu    sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+func newStatsFetcher(tlsConfig *tls.Config) *statsFetcher {
+	return &statsFetcher{
+		tlsConfig: tlsConfig,
+		conns:     make(map[string]*grpc.ClientConn),
+	}
+}
+
+func (f *statsFetcher) FetchStats(ctx context.Context, addr string) (*api.RaftStats, error) {
+	conn, err := f.conn(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := api.NewAdminClient(conn).GetRaftStats(ctx, &api.GetRaftStatsRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Stats, nil
+}
+
+func (f *statsFetcher) conn(addr string) (*grpc.ClientConn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if conn, ok := f.conns[addr]; ok {
+		return conn, nil
+	}
+
+	creds := insecure.NewCredentials()
+	if f.tlsConfig != nil {
+		creds = credentials.NewTLS(f.tlsConfig)
+	}
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+
+	f.conns[addr] = conn
+	return conn, nil
+}
+
+// Retain closes the connections to the servers gone from the
+// configuration.
+func (f *statsFetcher) Retain(addrs []string) {
+	keep := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		keep[addr] = true
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for addr, conn := range f.conns {
+		if keep[addr] {
+			continue
+		}
+		_ = conn.Close()
+		delete(f.conns, addr)
+	}
+}
+
+func (f *statsFetcher) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for addr, conn := range f.conns {
+		if err := conn.Close(); err != nil {
+			return err
+		}
+		delete(f.conns, addr)
+	}
+
+	return nil
+}
@@ -0,0 +1,145 @@
+package agent
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/fedoroko/proglog/api/v1"
+)
+
+// zonedServers adds the zones the members advertise to the log's servers.
+type zonedServers struct {
+	agent *Agent
+}
+
+// serverLog is the log the servers are read from, the partitioned one if
+// the agent runs it, for the partitions each server leads.
+type serverLog interface {
+	GetServers() ([]*api.Server, error)
+	WatchServers() (<-chan struct{}, func())
+}
+
+func (z *zonedServers) log() serverLog {
+	if z.agent.partitions != nil {
+		return z.agent.partitions
+	}
+	return z.agent.log
+}
+
+func (z *zonedServers) GetServers() ([]*api.Server, error) {
+	servers, err := z.log().GetServers()
+	if err != nil {
+		return nil, err
+	}
+
+	// the agent serves once its membership is set up, so it's there
+	zones := make(map[string]string)
+	for _, member := range z.agent.membership.Members() {
+		zones[member.Name] = member.Tags["zone"]
+	}
+	for _, server := range servers {
+		server.Zone = zones[server.Id]
+	}
+
+	return servers, nil
+}
+
+// WatchServers sends the servers on the log's signals, skipping the ones
+// that leave them as they were. The watch ends on the agent's shutdown
+// too, so the open watches don't hold the server's graceful stop up.
+func (z *zonedServers) WatchServers(ctx context.Context) (<-chan []*api.Server, error) {
+	changes, stop := z.log().WatchServers()
+	ch := make(chan []*api.Server)
+	go func() {
+		defer close(ch)
+		defer stop()
+		var last []*api.Server
+		for {
+			// the configuration can't be read while raft shuts down,
+			// the next signal, if any, has it read again
+			servers, err := z.GetServers()
+			if err == nil && !equalServers(last, servers) {
+				select {
+				case ch <- servers:
+					last = servers
+				case <-ctx.Done():
+					return
+				case <-z.agent.shutdowns:
+					return
+				}
+			}
+
+			select {
+			case _, ok := <-changes:
+				if !ok {
+					return
+				}
+			case <-ctx.Done():
+				return
+			case <-z.agent.shutdowns:
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+func equalServers(a, b []*api.Server) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !proto.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// keepLeaderInZone hands the leadership over to a voter in the leader
+// zone whenever the agent leads from another zone.
+func (a *Agent) keepLeaderInZone() {
+	interval := a.Config.LeaderZoneInterval
+	if interval == 0 {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// a failed transfer is retried on the next tick
+			if err := a.moveLeaderToZone(); err != nil {
+				zap.L().Named("agent").Warn(
+					"failed to move leadership to zone",
+					zap.Error(err),
+					zap.String("zone", a.Config.LeaderZone),
+				)
+			}
+		case <-a.shutdowns:
+			return
+		}
+	}
+}
+
+func (a *Agent) moveLeaderToZone() error {
+	if a.Config.Zone == a.Config.LeaderZone || !a.log.IsLeader() {
+		return nil
+	}
+
+	servers, err := (&zonedServers{agent: a}).GetServers()
+	if err != nil {
+		return err
+	}
+	for _, server := range servers {
+		if server.Role == api.Role_VOTER && server.Zone == a.Config.LeaderZone {
+			return a.log.TransferLeadership(server.Id)
+		}
+	}
+
+	return nil
+}
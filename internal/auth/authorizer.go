@@ -2,6 +2,7 @@ package auth
 
 import (
 	"fmt"
+	"sync"
 
 	"github.com/casbin/casbin"
 	"google.golang.org/grpc/codes"
@@ -16,11 +17,15 @@ func New(model, policy string) *Authorizer {
 }
 
 type Authorizer struct {
+	mu       sync.RWMutex
 	enforcer *casbin.Enforcer
 }
 
 func (a *Authorizer) Authorize(subject, object, action string) error {
-	if !a.enforcer.Enforce(subject, object, action) {
+	a.mu.RLock()
+	permitted := a.enforcer.Enforce(subject, object, action)
+	a.mu.RUnlock()
+	if !permitted {
 		msg := fmt.Sprintf(
 			"%s not permitted to %s to %s",
 			subject,
@@ -33,3 +38,11 @@ func (a *Authorizer) Authorize(subject, object, action string) error {
 
 	return nil
 }
+
+// Reload rereads the policy file, so the policy changes apply without
+// a restart.
+func (a *Authorizer) Reload() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.enforcer.LoadPolicy()
+}
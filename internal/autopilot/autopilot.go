@@ -0,0 +1,412 @@
+package autopilot
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/serf/serf"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	api "github.com/fedoroko/proglog/api/v1"
+)
+
+// Autopilot runs on every server and, while the server is the leader,
+// keeps track of the cluster's health. It joins new servers as non-voters
+// and promotes them once they're caught up and stable, and removes the
+// servers that have left the cluster while the quorum stays safe.
+type Autopilot struct {
+	Config
+	raft    Raft
+	stats   StatsFetcher
+	members Members
+	logger  *zap.Logger
+
+	mu     sync.RWMutex
+	health map[string]*api.ServerHealth
+	// the servers that have left, to remove on the next check
+	leaving map[string]bool
+
+	closed chan struct{}
+	done   chan struct{}
+}
+
+type Config struct {
+	// Interval between the health checks, 1 second by default.
+	Interval time.Duration
+	// LastContactThreshold is how long a follower may go without hearing
+	// from the leader and still be healthy, 200 milliseconds by default.
+	LastContactThreshold time.Duration
+	// MaxTrailingLogs is how far behind the leader's log a follower
+	// may fall and still be healthy, 250 entries by default.
+	MaxTrailingLogs uint64
+	// ServerStabilizationTime is how long a non-voter has to stay healthy
+	// before it's promoted, 10 seconds by default. Servers that have left
+	// are removed once they've been gone for that long as well.
+	ServerStabilizationTime time.Duration
+	// MinQuorum is the number of voters the cleanup never goes below.
+	MinQuorum int
+}
+
+// Raft is the server's view of the raft cluster.
+type Raft interface {
+	IsLeader() bool
+	RaftStats() (*api.RaftStats, error)
+	GetServers() ([]*api.Server, error)
+	Join(id, addr string, voter bool) error
+	Leave(id string) error
+}
+
+// StatsFetcher gets the raft stats of the server at the address.
+type StatsFetcher interface {
+	FetchStats(ctx context.Context, addr string) (*api.RaftStats, error)
+	// Retain lets go of the servers other than those at the addresses,
+	// the servers in the configuration.
+	Retain(addrs []string)
+}
+
+// Members lists the members of the serf cluster.
+type Members interface {
+	Members() []serf.Member
+}
+
+func New(r Raft, stats StatsFetcher, config Config) *Autopilot {
+	if config.Interval == 0 {
+		config.Interval = time.Second
+	}
+	if config.LastContactThreshold == 0 {
+		config.LastContactThreshold = 200 * time.Millisecond
+	}
+	if config.MaxTrailingLogs == 0 {
+		config.MaxTrailingLogs = 250
+	}
+	if config.ServerStabilizationTime == 0 {
+		config.ServerStabilizationTime = 10 * time.Second
+	}
+
+	return &Autopilot{
+		Config:  config,
+		raft:    r,
+		stats:   stats,
+		logger:  zap.L().Named("autopilot"),
+		leaving: make(map[string]bool),
+		closed:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Start runs the health checks against the members until Stop is called.
+func (a *Autopilot) Start(members Members) {
+	a.members = members
+	go a.run()
+}
+
+func (a *Autopilot) Stop() {
+	close(a.closed)
+	<-a.done
+}
+
+func (a *Autopilot) run() {
+	defer close(a.done)
+	ticker := time.NewTicker(a.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.tick(time.Now())
+		case <-a.closed:
+			return
+		}
+	}
+}
+
+func (a *Autopilot) tick(now time.Time) {
+	if !a.raft.IsLeader() {
+		a.mu.Lock()
+		a.health = nil
+		a.leaving = make(map[string]bool)
+		a.mu.Unlock()
+		return
+	}
+
+	if err := a.updateHealth(now); err != nil {
+		a.logger.Error("failed to update health", zap.Error(err))
+		return
+	}
+	a.promoteStableServers(now)
+	a.removeDeadServers(now)
+}
+
+// Join adds a new server as a non-voter, to be promoted once it's stable.
+// Servers already in the configuration keep their suffrage when voter.
+func (a *Autopilot) Join(id, addr string, voter bool) error {
+	// a server back before its removal stays
+	a.mu.Lock()
+	delete(a.leaving, id)
+	a.mu.Unlock()
+
+	if voter {
+		servers, err := a.raft.GetServers()
+		if err != nil {
+			return err
+		}
+		for _, server := range servers {
+			if server.Id == id && server.Role == api.Role_VOTER {
+				return a.raft.Join(id, addr, true)
+			}
+		}
+	}
+
+	return a.raft.Join(id, addr, false)
+}
+
+// Leave queues the server for removal on the next check, without waiting
+// for the stabilization time, as long as the quorum stays safe. Only the
+// leader removes servers, so the other servers return raft.ErrNotLeader.
+func (a *Autopilot) Leave(id string) error {
+	if !a.raft.IsLeader() {
+		return raft.ErrNotLeader
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.leaving[id] = true
+	return nil
+}
+
+// ClusterHealth returns the health as of the last check. Only the leader
+// checks the health, so the other servers return raft.ErrNotLeader.
+func (a *Autopilot) ClusterHealth() (*api.ClusterHealth, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.health == nil {
+		return nil, raft.ErrNotLeader
+	}
+
+	res := &api.ClusterHealth{Healthy: true}
+	voters, healthyVoters := 0, 0
+	for _, health := range a.health {
+		res.Servers = append(res.Servers, health)
+		if !health.Healthy {
+			res.Healthy = false
+		}
+		if health.Role == api.Role_VOTER {
+			voters++
+			if health.Healthy {
+				healthyVoters++
+			}
+		}
+	}
+	sort.Slice(res.Servers, func(i, j int) bool {
+		return res.Servers[i].Id < res.Servers[j].Id
+	})
+	if tolerance := healthyVoters - (voters/2 + 1); tolerance > 0 {
+		res.FailureTolerance = int32(tolerance)
+	}
+
+	return res, nil
+}
+
+func (a *Autopilot) updateHealth(now time.Time) error {
+	leader, err := a.raft.RaftStats()
+	if err != nil {
+		return err
+	}
+	servers, err := a.raft.GetServers()
+	if err != nil {
+		return err
+	}
+
+	members := make(map[string]serf.Member)
+	for _, member := range a.members.Members() {
+		members[member.Name] = member
+	}
+
+	addrs := make([]string, 0, len(servers))
+	for _, server := range servers {
+		if server.Id != leader.Id {
+			addrs = append(addrs, server.RpcAddr)
+		}
+	}
+	a.stats.Retain(addrs)
+
+	stats := make([]*api.RaftStats, len(servers))
+	ctx, cancel := context.WithTimeout(context.Background(), a.Interval/2)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		if server.Id == leader.Id {
+			stats[i] = leader
+			continue
+		}
+		wg.Add(1)
+		go func(i int, server *api.Server) {
+			defer wg.Done()
+			s, err := a.stats.FetchStats(ctx, server.RpcAddr)
+			if err != nil {
+				a.logger.Debug(
+					"failed to fetch stats",
+					zap.Error(err),
+					zap.String("id", server.Id),
+				)
+				return
+			}
+			stats[i] = s
+		}(i, server)
+	}
+	wg.Wait()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	prev := a.health
+	a.health = make(map[string]*api.ServerHealth, len(servers))
+	for i, server := range servers {
+		health := &api.ServerHealth{
+			Id:         server.Id,
+			RpcAddr:    server.RpcAddr,
+			Role:       server.Role,
+			IsLeader:   server.Id == leader.Id,
+			SerfStatus: serf.StatusNone.String(),
+		}
+		if member, ok := members[server.Id]; ok {
+			health.SerfStatus = member.Status.String()
+		}
+		if s := stats[i]; s != nil {
+			health.LastContact = s.LastContact
+			health.LastTerm = s.Term
+			health.LastLogIndex = s.LastLogIndex
+			health.Healthy = health.SerfStatus == serf.StatusAlive.String() &&
+				s.LastContact.AsDuration() < a.LastContactThreshold &&
+				s.Term == leader.Term &&
+				s.LastLogIndex+a.MaxTrailingLogs >= leader.LastLogIndex
+		}
+
+		health.StableSince = timestamppb.New(now)
+		if p, ok := prev[server.Id]; ok && p.Healthy == health.Healthy {
+			health.StableSince = p.StableSince
+		}
+		if health.LastContact == nil {
+			health.LastContact = durationpb.New(0)
+		}
+		a.health[server.Id] = health
+	}
+	// the servers gone from the configuration have nothing left to remove
+	for id := range a.leaving {
+		if _, ok := a.health[id]; !ok {
+			delete(a.leaving, id)
+		}
+	}
+
+	return nil
+}
+
+// promoteStableServers promotes the non-voters, other than read replicas,
+// that have been healthy for the stabilization time.
+func (a *Autopilot) promoteStableServers(now time.Time) {
+	members := make(map[string]serf.Member)
+	for _, member := range a.members.Members() {
+		members[member.Name] = member
+	}
+
+	for _, health := range a.stableServers(now, true) {
+		if health.Role != api.Role_NONVOTER {
+			continue
+		}
+		member, ok := members[health.Id]
+		if !ok {
+			continue
+		}
+		if readReplica, _ := strconv.ParseBool(member.Tags["read_replica"]); readReplica {
+			continue
+		}
+
+		if err := a.raft.Join(health.Id, health.RpcAddr, true); err != nil {
+			a.logger.Error("failed to promote", zap.Error(err), zap.String("id", health.Id))
+			continue
+		}
+		a.logger.Info("promoted", zap.String("id", health.Id))
+	}
+}
+
+// removeDeadServers removes the servers that have left serf, or have been
+// reaped by it, for the stabilization time, and the servers queued by
+// Leave. Failed servers are kept until serf reaps them, in case they come
+// back. Voters are removed only if a majority of them remains, and never
+// below the min quorum.
+func (a *Autopilot) removeDeadServers(now time.Time) {
+	var dead []*api.ServerHealth
+	voters, deadVoters := 0, 0
+	isDead := make(map[string]bool)
+	a.mu.RLock()
+	for _, health := range a.health {
+		if health.Role == api.Role_VOTER {
+			voters++
+		}
+		if a.leaving[health.Id] && !health.IsLeader {
+			isDead[health.Id] = true
+			dead = append(dead, health)
+		}
+	}
+	a.mu.RUnlock()
+	for _, health := range a.stableServers(now, false) {
+		if isDead[health.Id] ||
+			health.SerfStatus != serf.StatusLeft.String() &&
+				health.SerfStatus != serf.StatusNone.String() {
+			continue
+		}
+		dead = append(dead, health)
+	}
+	for _, health := range dead {
+		if health.Role == api.Role_VOTER {
+			deadVoters++
+		}
+	}
+	if deadVoters != 0 && deadVoters*2 >= voters {
+		a.logger.Warn(
+			"not removing dead voters, the quorum would be lost",
+			zap.Int("voters", voters),
+			zap.Int("dead_voters", deadVoters),
+		)
+		return
+	}
+
+	for _, health := range dead {
+		if health.Role == api.Role_VOTER {
+			if voters <= a.MinQuorum {
+				continue
+			}
+			voters--
+		}
+		if err := a.raft.Leave(health.Id); err != nil {
+			a.logger.Error("failed to remove dead server", zap.Error(err), zap.String("id", health.Id))
+			continue
+		}
+		a.mu.Lock()
+		delete(a.leaving, health.Id)
+		a.mu.Unlock()
+		a.logger.Info("removed dead server", zap.String("id", health.Id))
+	}
+}
+
+// stableServers returns the servers that have been healthy, or unhealthy,
+// for at least the stabilization time.
+func (a *Autopilot) stableServers(now time.Time, healthy bool) []*api.ServerHealth {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	var servers []*api.ServerHealth
+	for _, health := range a.health {
+		if health.Healthy != healthy || health.IsLeader {
+			continue
+		}
+		if now.Sub(health.StableSince.AsTime()) < a.ServerStabilizationTime {
+			continue
+		}
+		servers = append(servers, health)
+	}
+
+	return servers
+}
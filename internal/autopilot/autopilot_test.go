@@ -0,0 +1,322 @@
+package autopilot
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/serf/serf"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	api "github.com/fedoroko/proglog/api/v1"
+)
+
+func TestAutopilot(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T, a *Autopilot, r *fakeRaft, m *fakeMembers,
+	){
+		"reports cluster health":              testClusterHealth,
+		"promotes stable non-voters":          testPromoteStable,
+		"keeps read replicas non-voters":      testKeepReadReplicas,
+		"doesn't promote lagging non-voters":  testLaggingNonvoter,
+		"removes servers that have left":      testRemoveLeft,
+		"keeps the quorum when removing":      testRemoveKeepsQuorum,
+		"joins new servers as non-voters":     testJoinNonvoter,
+		"reports no health unless the leader": testNotLeader,
+		"removes leaving servers safely":      testLeave,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			r := &fakeRaft{
+				leader: true,
+				term:   2,
+				last:   100,
+				servers: []*api.Server{
+					{Id: "0", RpcAddr: "0", IsLeader: true, Role: api.Role_VOTER},
+				},
+				stats: make(map[string]*api.RaftStats),
+			}
+			m := &fakeMembers{}
+			m.add("0", serf.StatusAlive, nil)
+			a := New(r, r, Config{ServerStabilizationTime: 10 * time.Second})
+			a.members = m
+
+			fn(t, a, r, m)
+		})
+	}
+}
+
+func testClusterHealth(t *testing.T, a *Autopilot, r *fakeRaft, m *fakeMembers) {
+	r.addServer("1", api.Role_VOTER, 100)
+	r.addServer("2", api.Role_VOTER, 100)
+	m.add("1", serf.StatusAlive, nil)
+	m.add("2", serf.StatusAlive, nil)
+
+	now := time.Now()
+	a.tick(now)
+	health, err := a.ClusterHealth()
+	require.NoError(t, err)
+	require.True(t, health.Healthy)
+	require.Equal(t, int32(1), health.FailureTolerance)
+	require.Equal(t, 3, len(health.Servers))
+	require.True(t, health.Servers[0].IsLeader)
+
+	// the server's stats can't be fetched once it fails
+	m.add("2", serf.StatusFailed, nil)
+	delete(r.stats, "2")
+	a.tick(now.Add(time.Second))
+	health, err = a.ClusterHealth()
+	require.NoError(t, err)
+	require.False(t, health.Healthy)
+	require.Equal(t, int32(0), health.FailureTolerance)
+	require.Equal(t, "failed", health.Servers[2].SerfStatus)
+	require.True(t, now.Add(time.Second).Equal(health.Servers[2].StableSince.AsTime()))
+	require.True(t, now.Equal(health.Servers[1].StableSince.AsTime()))
+}
+
+func testPromoteStable(t *testing.T, a *Autopilot, r *fakeRaft, m *fakeMembers) {
+	r.addServer("1", api.Role_NONVOTER, 100)
+	m.add("1", serf.StatusAlive, nil)
+
+	now := time.Now()
+	a.tick(now)
+	require.Equal(t, api.Role_NONVOTER, r.role("1"))
+	a.tick(now.Add(5 * time.Second))
+	require.Equal(t, api.Role_NONVOTER, r.role("1"))
+	a.tick(now.Add(10 * time.Second))
+	require.Equal(t, api.Role_VOTER, r.role("1"))
+}
+
+func testKeepReadReplicas(t *testing.T, a *Autopilot, r *fakeRaft, m *fakeMembers) {
+	r.addServer("1", api.Role_NONVOTER, 100)
+	m.add("1", serf.StatusAlive, map[string]string{"read_replica": "true"})
+
+	now := time.Now()
+	a.tick(now)
+	a.tick(now.Add(time.Minute))
+	require.Equal(t, api.Role_NONVOTER, r.role("1"))
+}
+
+func testLaggingNonvoter(t *testing.T, a *Autopilot, r *fakeRaft, m *fakeMembers) {
+	r.last = 1000
+	r.addServer("1", api.Role_NONVOTER, 100)
+	m.add("1", serf.StatusAlive, nil)
+
+	now := time.Now()
+	a.tick(now)
+	a.tick(now.Add(time.Minute))
+	require.Equal(t, api.Role_NONVOTER, r.role("1"))
+
+	// it's promoted once it has caught up and stayed so
+	r.stats["1"].LastLogIndex = 1000
+	a.tick(now.Add(2 * time.Minute))
+	require.Equal(t, api.Role_NONVOTER, r.role("1"))
+	a.tick(now.Add(3 * time.Minute))
+	require.Equal(t, api.Role_VOTER, r.role("1"))
+}
+
+func testRemoveLeft(t *testing.T, a *Autopilot, r *fakeRaft, m *fakeMembers) {
+	for i := 1; i < 5; i++ {
+		r.addServer(fmt.Sprintf("%d", i), api.Role_VOTER, 100)
+	}
+	m.add("1", serf.StatusAlive, nil)
+	m.add("2", serf.StatusLeft, nil)
+	m.add("3", serf.StatusFailed, nil)
+	// 4 has been reaped by serf
+
+	now := time.Now()
+	a.tick(now)
+	require.Equal(t, 5, len(r.servers))
+	a.tick(now.Add(10 * time.Second))
+	require.Equal(t, 3, len(r.servers))
+	require.Equal(t, api.Role_VOTER, r.role("3"))
+}
+
+func testRemoveKeepsQuorum(t *testing.T, a *Autopilot, r *fakeRaft, m *fakeMembers) {
+	r.addServer("1", api.Role_VOTER, 100)
+	m.add("1", serf.StatusLeft, nil)
+
+	now := time.Now()
+	a.tick(now)
+	a.tick(now.Add(time.Minute))
+	require.Equal(t, 2, len(r.servers))
+
+	a.MinQuorum = 3
+	r.addServer("2", api.Role_VOTER, 100)
+	m.add("2", serf.StatusAlive, nil)
+	a.tick(now.Add(2 * time.Minute))
+	require.Equal(t, 3, len(r.servers))
+
+	a.MinQuorum = 2
+	a.tick(now.Add(3 * time.Minute))
+	require.Equal(t, 2, len(r.servers))
+	require.False(t, r.has("1"))
+}
+
+func testJoinNonvoter(t *testing.T, a *Autopilot, r *fakeRaft, m *fakeMembers) {
+	require.NoError(t, a.Join("1", "1", true))
+	require.Equal(t, api.Role_NONVOTER, r.role("1"))
+
+	// a voter coming back stays a voter
+	r.addServer("2", api.Role_VOTER, 100)
+	require.NoError(t, a.Join("2", "2", true))
+	require.Equal(t, api.Role_VOTER, r.role("2"))
+}
+
+func testLeave(t *testing.T, a *Autopilot, r *fakeRaft, m *fakeMembers) {
+	for i := 1; i < 4; i++ {
+		r.addServer(fmt.Sprintf("%d", i), api.Role_VOTER, 100)
+		m.add(fmt.Sprintf("%d", i), serf.StatusAlive, nil)
+	}
+
+	// the leaving server is removed on the next check, without waiting
+	// for the stabilization time
+	now := time.Now()
+	require.NoError(t, a.Leave("1"))
+	require.True(t, r.has("1"))
+	a.tick(now)
+	require.False(t, r.has("1"))
+
+	// but not below the min quorum
+	a.MinQuorum = 3
+	require.NoError(t, a.Leave("2"))
+	a.tick(now.Add(time.Second))
+	require.True(t, r.has("2"))
+	// the stats of the server removed are let go of
+	require.Equal(t, []string{"2", "3"}, r.retained)
+	a.MinQuorum = 0
+	a.tick(now.Add(2 * time.Second))
+	require.False(t, r.has("2"))
+
+	// nor losing the quorum
+	require.NoError(t, a.Leave("3"))
+	a.tick(now.Add(3 * time.Second))
+	require.True(t, r.has("3"))
+
+	r.leader = false
+	require.Equal(t, raft.ErrNotLeader, a.Leave("3"))
+}
+
+func testNotLeader(t *testing.T, a *Autopilot, r *fakeRaft, m *fakeMembers) {
+	a.tick(time.Now())
+	_, err := a.ClusterHealth()
+	require.NoError(t, err)
+
+	r.leader = false
+	a.tick(time.Now())
+	_, err = a.ClusterHealth()
+	require.Equal(t, raft.ErrNotLeader, err)
+}
+
+// fakeRaft is a cluster led by the server 0, that serves
+// the other servers' stats too.
+type fakeRaft struct {
+	mu      sync.Mutex
+	leader  bool
+	term    uint64
+	last    uint64
+	servers []*api.Server
+	stats   map[string]*api.RaftStats
+	// the addresses of the stats retained on the last check
+	retained []string
+}
+
+func (r *fakeRaft) addServer(id string, role api.Role, last uint64) {
+	r.servers = append(r.servers, &api.Server{Id: id, RpcAddr: id, Role: role})
+	r.stats[id] = &api.RaftStats{
+		Id:           id,
+		Term:         r.term,
+		LastLogIndex: last,
+		LastContact:  durationpb.New(10 * time.Millisecond),
+	}
+}
+
+func (r *fakeRaft) role(id string) api.Role {
+	for _, server := range r.servers {
+		if server.Id == id {
+			return server.Role
+		}
+	}
+	return -1
+}
+
+func (r *fakeRaft) has(id string) bool {
+	return r.role(id) != -1
+}
+
+func (r *fakeRaft) IsLeader() bool {
+	return r.leader
+}
+
+func (r *fakeRaft) RaftStats() (*api.RaftStats, error) {
+	return &api.RaftStats{
+		Id:           "0",
+		Term:         r.term,
+		LastLogIndex: r.last,
+		LastContact:  durationpb.New(0),
+	}, nil
+}
+
+func (r *fakeRaft) GetServers() ([]*api.Server, error) {
+	return r.servers, nil
+}
+
+func (r *fakeRaft) Join(id, addr string, voter bool) error {
+	role := api.Role_NONVOTER
+	if voter {
+		role = api.Role_VOTER
+	}
+	for _, server := range r.servers {
+		if server.Id == id {
+			server.Role = role
+			return nil
+		}
+	}
+	r.servers = append(r.servers, &api.Server{Id: id, RpcAddr: addr, Role: role})
+	return nil
+}
+
+func (r *fakeRaft) Leave(id string) error {
+	for i, server := range r.servers {
+		if server.Id == id {
+			r.servers = append(r.servers[:i], r.servers[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (r *fakeRaft) FetchStats(ctx context.Context, addr string) (*api.RaftStats, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats, ok := r.stats[addr]
+	if !ok {
+		return nil, fmt.Errorf("unreachable: %s", addr)
+	}
+	return stats, nil
+}
+
+func (r *fakeRaft) Retain(addrs []string) {
+	r.retained = addrs
+}
+
+type fakeMembers struct {
+	members []serf.Member
+}
+
+func (m *fakeMembers) add(name string, status serf.MemberStatus, tags map[string]string) {
+	for i, member := range m.members {
+		if member.Name == name {
+			m.members[i].Status = status
+			return
+		}
+	}
+	m.members = append(m.members, serf.Member{Name: name, Status: status, Tags: tags})
+}
+
+func (m *fakeMembers) Members() []serf.Member {
+	return m.members
+}
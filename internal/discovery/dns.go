@@ -0,0 +1,72 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"go.uber.org/zap"
+)
+
+// DNS lists the members from the SRV records of a name, looked up every
+// interval. Each record's target and port is a node's RPC address, and
+// the target, without the trailing dot, is its name. So nodes are named
+// after their hosts, e.g. proglog-0.proglog.default.svc.cluster.local.
+// Every node listed joins as a voter.
+type DNS struct {
+	DNSConfig
+	*poller
+}
+
+type DNSConfig struct {
+	NodeName string
+	// Name is the SRV name, e.g. _rpc._tcp.proglog.default.svc.cluster.local.
+	Name string
+	// Resolver looks up the records, net.DefaultResolver by default.
+	Resolver *net.Resolver
+	// Interval between the lookups, 5 seconds by default.
+	Interval time.Duration
+}
+
+func NewDNS(handler Handler, config DNSConfig) (*DNS, error) {
+	if config.Resolver == nil {
+		config.Resolver = net.DefaultResolver
+	}
+	d := &DNS{DNSConfig: config}
+	d.poller = newPoller(
+		handler,
+		config.NodeName,
+		config.Interval,
+		d.list,
+		zap.L().Named("dns"),
+	)
+	if err := d.start(); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func (d *DNS) list() ([]serf.Member, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.poller.interval)
+	defer cancel()
+	_, records, err := d.Resolver.LookupSRV(ctx, "", "", d.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	members := make([]serf.Member, 0, len(records))
+	for _, record := range records {
+		host := strings.TrimSuffix(record.Target, ".")
+		members = append(members, serf.Member{
+			Name: host,
+			Tags: map[string]string{
+				"rpc_addr": net.JoinHostPort(host, strconv.Itoa(int(record.Port))),
+			},
+		})
+	}
+	return members, nil
+}
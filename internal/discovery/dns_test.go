@@ -0,0 +1,102 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNS(t *testing.T) {
+	stub := &stubDNS{}
+	stub.set(
+		&dns.SRV{Target: "proglog-0.proglog.test.", Port: 8400},
+		&dns.SRV{Target: "proglog-1.proglog.test.", Port: 8400},
+	)
+	resolver := stub.start(t)
+
+	h := &handler{
+		joins:  make(chan map[string]string, 3),
+		leaves: make(chan string, 3),
+	}
+	d, err := NewDNS(h, DNSConfig{
+		NodeName: "proglog-0.proglog.test",
+		Name:     "_rpc._tcp.proglog.test.",
+		Resolver: resolver,
+		Interval: 50 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer d.Shutdown()
+
+	require.Equal(t, map[string]string{
+		"id":    "proglog-1.proglog.test",
+		"addr":  "proglog-1.proglog.test:8400",
+		"voter": "true",
+	}, <-h.joins)
+	require.Equal(t, 2, len(d.Members()))
+
+	stub.set(
+		&dns.SRV{Target: "proglog-0.proglog.test.", Port: 8400},
+		&dns.SRV{Target: "proglog-2.proglog.test.", Port: 8400},
+	)
+	require.Equal(t, "proglog-2.proglog.test", (<-h.joins)["id"])
+	require.Equal(t, "proglog-1.proglog.test", <-h.leaves)
+}
+
+// stubDNS answers the SRV lookups with the records it's set with.
+type stubDNS struct {
+	mu      sync.Mutex
+	records []*dns.SRV
+}
+
+func (s *stubDNS) set(records ...*dns.SRV) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = records
+}
+
+// start serves the records and returns a resolver that looks them up.
+func (s *stubDNS) start(t *testing.T) *net.Resolver {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := &dns.Server{PacketConn: conn, Handler: s}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { _ = server.Shutdown() })
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", conn.LocalAddr().String())
+		},
+	}
+}
+
+func (s *stubDNS) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := new(dns.Msg)
+	res.SetReply(req)
+	for _, q := range req.Question {
+		if q.Qtype != dns.TypeSRV {
+			continue
+		}
+		for _, record := range s.records {
+			rr := *record
+			rr.Hdr = dns.RR_Header{
+				Name:   q.Name,
+				Rrtype: dns.TypeSRV,
+				Class:  dns.ClassINET,
+				Ttl:    0,
+			}
+			res.Answer = append(res.Answer, &rr)
+		}
+	}
+	_ = w.WriteMsg(res)
+}
@@ -0,0 +1,163 @@
+package discovery
+
+import (
+	"errors"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"go.uber.org/zap"
+)
+
+// EventHandler handles a user event fired across the cluster.
+type EventHandler func(payload []byte)
+
+// QueryHandler answers a query fired across the cluster. The answer, or
+// the error, goes back to the member that fired the query.
+type QueryHandler func(payload []byte) ([]byte, error)
+
+// QueryResponse is a member's answer to a query. An acked member got
+// the query, and responded if it has a handler for it and answered in
+// time.
+type QueryResponse struct {
+	Acked     bool
+	Responded bool
+	Payload   []byte
+	Error     string
+}
+
+// the first byte of a query's answer tells an error from a payload
+const (
+	responseOK byte = iota
+	responseError
+)
+
+// HandleEvent registers the handler of the user events with the name.
+// The events are handled in order on the gossip loop, so the handler
+// shouldn't block.
+func (m *Membership) HandleEvent(name string, handler EventHandler) {
+	m.handlersMu.Lock()
+	defer m.handlersMu.Unlock()
+	m.eventHandlers[name] = handler
+}
+
+// HandleQuery registers the handler of the queries with the name.
+func (m *Membership) HandleQuery(name string, handler QueryHandler) {
+	m.handlersMu.Lock()
+	defer m.handlersMu.Unlock()
+	m.queryHandlers[name] = handler
+}
+
+// UserEvent fires the event to every member, this one included. Serf
+// gossips it on a best effort basis: nothing tells which members got it.
+func (m *Membership) UserEvent(name string, payload []byte) error {
+	return m.serf.UserEvent(name, payload, false)
+}
+
+// Query fires the query to every member, this one included, and collects
+// their acks and answers until the timeout, by default serf's, scaled to
+// the size of the cluster. The members alive at the time of the query
+// are listed even if they never acked it.
+func (m *Membership) Query(
+	name string, payload []byte, timeout time.Duration,
+) (map[string]*QueryResponse, error) {
+	params := m.serf.DefaultQueryParams()
+	params.RequestAck = true
+	if timeout != 0 {
+		params.Timeout = timeout
+	}
+
+	responses := make(map[string]*QueryResponse)
+	for _, member := range m.serf.Members() {
+		if member.Status == serf.StatusAlive {
+			responses[member.Name] = &QueryResponse{}
+		}
+	}
+	get := func(name string) *QueryResponse {
+		if _, ok := responses[name]; !ok {
+			responses[name] = &QueryResponse{}
+		}
+		return responses[name]
+	}
+
+	res, err := m.serf.Query(name, payload, params)
+	if err != nil {
+		return nil, err
+	}
+	acks, answers := res.AckCh(), res.ResponseCh()
+	for acks != nil || answers != nil {
+		select {
+		case from, ok := <-acks:
+			if !ok {
+				acks = nil
+				continue
+			}
+			get(from).Acked = true
+		case answer, ok := <-answers:
+			if !ok {
+				answers = nil
+				continue
+			}
+			response := get(answer.From)
+			// the answer may overtake the ack
+			response.Acked = true
+			response.Responded = true
+			response.Payload, err = decodeResponse(answer.Payload)
+			if err != nil {
+				response.Error = err.Error()
+			}
+		}
+	}
+
+	return responses, nil
+}
+
+func (m *Membership) handleUserEvent(e serf.UserEvent) {
+	m.handlersMu.RLock()
+	handler, ok := m.eventHandlers[e.Name]
+	m.handlersMu.RUnlock()
+	if !ok {
+		m.logger.Debug("unhandled user event", zap.String("name", e.Name))
+		return
+	}
+	handler(e.Payload)
+}
+
+// handleQuery answers the query off the gossip loop, so a slow handler
+// doesn't hold up the members' events.
+func (m *Membership) handleQuery(q *serf.Query) {
+	m.handlersMu.RLock()
+	handler, ok := m.queryHandlers[q.Name]
+	m.handlersMu.RUnlock()
+	if !ok {
+		m.logger.Debug("unhandled query", zap.String("name", q.Name))
+		return
+	}
+
+	go func() {
+		payload, err := handler(q.Payload)
+		if err = q.Respond(encodeResponse(payload, err)); err != nil {
+			m.logger.Error(
+				"failed to respond to query",
+				zap.Error(err),
+				zap.String("name", q.Name),
+			)
+		}
+	}()
+}
+
+func encodeResponse(payload []byte, err error) []byte {
+	if err != nil {
+		return append([]byte{responseError}, err.Error()...)
+	}
+	return append([]byte{responseOK}, payload...)
+}
+
+func decodeResponse(b []byte) ([]byte, error) {
+	if len(b) == 0 {
+		return nil, errors.New("empty response")
+	}
+	if b[0] == responseError {
+		return nil, errors.New(string(b[1:]))
+	}
+	return b[1:], nil
+}
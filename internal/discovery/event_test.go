@@ -0,0 +1,64 @@
+package discovery
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMembershipUserEvent(t *testing.T) {
+	m, h := setupMember(t, nil)
+	m, _ = setupMember(t, m)
+	m, _ = setupMember(t, m)
+	require.Eventually(t, func() bool {
+		return len(h.joins) == 2 && len(m[0].Members()) == 3
+	}, 3*time.Second, 250*time.Millisecond)
+
+	got := make(chan string, 3)
+	for _, member := range m {
+		name := member.NodeName
+		member.HandleEvent("ping", func(payload []byte) {
+			got <- name + ":" + string(payload)
+		})
+	}
+	require.NoError(t, m[1].UserEvent("ping", []byte("hello")))
+
+	var received []string
+	require.Eventually(t, func() bool {
+		select {
+		case e := <-got:
+			received = append(received, e)
+		default:
+		}
+		return len(received) == 3
+	}, 5*time.Second, 50*time.Millisecond)
+	require.ElementsMatch(t, []string{"0:hello", "1:hello", "2:hello"}, received)
+}
+
+func TestMembershipQuery(t *testing.T) {
+	m, h := setupMember(t, nil)
+	m, _ = setupMember(t, m)
+	m, _ = setupMember(t, m)
+	require.Eventually(t, func() bool {
+		return len(h.joins) == 2 && len(m[0].Members()) == 3
+	}, 3*time.Second, 250*time.Millisecond)
+
+	// member 2 has no handler, so it acks the query without answering
+	m[0].HandleQuery("upper", func(payload []byte) ([]byte, error) {
+		return bytes.ToUpper(payload), nil
+	})
+	m[1].HandleQuery("upper", func(payload []byte) ([]byte, error) {
+		return nil, errors.New("can't")
+	})
+
+	responses, err := m[0].Query("upper", []byte("hello"), time.Second)
+	require.NoError(t, err)
+	require.Equal(t, map[string]*QueryResponse{
+		"0": {Acked: true, Responded: true, Payload: []byte("HELLO")},
+		"1": {Acked: true, Responded: true, Error: "can't"},
+		"2": {Acked: true},
+	}, responses)
+}
@@ -0,0 +1,37 @@
+package discovery
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// loadKeyring reads the keyring from the file, in the format serf writes
+// it back in.
+func loadKeyring(path string) (*memberlist.Keyring, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var encoded []string
+	if err = json.Unmarshal(b, &encoded); err != nil {
+		return nil, err
+	}
+	if len(encoded) == 0 {
+		return nil, fmt.Errorf("no keys in keyring file: %s", path)
+	}
+
+	keys := make([][]byte, 0, len(encoded))
+	for _, e := range encoded {
+		key, err := base64.StdEncoding.DecodeString(e)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return memberlist.NewKeyring(keys, keys[0])
+}
@@ -0,0 +1,81 @@
+package discovery
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/go-dynaport"
+)
+
+func TestMembershipEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyring-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	oldKey, newKey := newKey(t), newKey(t)
+
+	// each member has its own keyring file, as each node would
+	var files []string
+	withKeyring := func(c *Config) {
+		c.KeyringFile = filepath.Join(dir, fmt.Sprintf("keyring-%d.json", len(files)))
+		files = append(files, c.KeyringFile)
+		writeKeyring(t, c.KeyringFile, oldKey)
+	}
+	m, h := setupMember(t, nil, withKeyring)
+	m, _ = setupMember(t, m, withKeyring)
+	require.Eventually(t, func() bool {
+		return len(h.joins) == 1 && len(m[0].Members()) == 2
+	}, 3*time.Second, 250*time.Millisecond)
+
+	// a node that gossips in plaintext can't join
+	_, err = New(&handler{}, Config{
+		NodeName:       "plaintext",
+		BindAddr:       fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0]),
+		StartJoinAddrs: []string{m[0].BindAddr},
+	})
+	require.Error(t, err)
+
+	// rotate the key across the live cluster
+	keyManager := m[0].KeyManager()
+	_, err = keyManager.InstallKey(newKey)
+	require.NoError(t, err)
+	_, err = keyManager.UseKey(newKey)
+	require.NoError(t, err)
+	_, err = keyManager.RemoveKey(oldKey)
+	require.NoError(t, err)
+
+	res, err := keyManager.ListKeys()
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{newKey: 2}, res.Keys)
+	require.Equal(t, map[string]int{newKey: 2}, res.PrimaryKeys)
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		require.NoError(t, err)
+		var keys []string
+		require.NoError(t, json.Unmarshal(b, &keys))
+		require.Equal(t, []string{newKey}, keys)
+	}
+	require.Equal(t, 2, len(m[1].Members()))
+}
+
+func newKey(t *testing.T) string {
+	t.Helper()
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func writeKeyring(t *testing.T, path string, keys ...string) {
+	t.Helper()
+	b, err := json.Marshal(keys)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, b, 0600))
+}
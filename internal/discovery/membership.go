@@ -2,6 +2,9 @@ package discovery
 
 import (
 	"net"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/raft"
 	"github.com/hashicorp/serf/serf"
@@ -14,13 +17,20 @@ type Membership struct {
 	serf    *serf.Serf
 	events  chan serf.Event
 	logger  *zap.Logger
+	watchers
+
+	handlersMu    sync.RWMutex
+	eventHandlers map[string]EventHandler
+	queryHandlers map[string]QueryHandler
 }
 
 func New(handler Handler, config Config) (*Membership, error) {
 	c := &Membership{
-		Config:  config,
-		handler: handler,
-		logger:  zap.L().Named("membership"),
+		Config:        config,
+		handler:       handler,
+		logger:        zap.L().Named("membership"),
+		eventHandlers: make(map[string]EventHandler),
+		queryHandlers: make(map[string]QueryHandler),
 	}
 	if err := c.setupSerf(); err != nil {
 		return nil, err
@@ -34,6 +44,14 @@ type Config struct {
 	BindAddr       string
 	Tags           map[string]string
 	StartJoinAddrs []string
+	// ReapTimeout is how long a failed member is kept in the cluster, in
+	// case it comes back, before it's removed. Defaults to serf's 24 hours.
+	ReapTimeout time.Duration
+	// KeyringFile holds the keys gossip is encrypted with, base64 encoded
+	// in a JSON list with the primary key first. Without it, gossip is in
+	// plaintext. The changes made through the key manager are written
+	// back to the file, so they outlive restarts.
+	KeyringFile string
 }
 
 func (m *Membership) setupSerf() error {
@@ -49,6 +67,19 @@ func (m *Membership) setupSerf() error {
 	config.EventCh = m.events
 	config.Tags = m.Tags
 	config.NodeName = m.Config.NodeName
+	if m.KeyringFile != "" {
+		config.MemberlistConfig.Keyring, err = loadKeyring(m.KeyringFile)
+		if err != nil {
+			return err
+		}
+		config.KeyringFile = m.KeyringFile
+	}
+	if m.ReapTimeout != 0 {
+		config.ReconnectTimeout = m.ReapTimeout
+		if m.ReapTimeout < config.ReapInterval {
+			config.ReapInterval = m.ReapTimeout
+		}
+	}
 	m.serf, err = serf.Create(config)
 	if err != nil {
 		return err
@@ -66,13 +97,20 @@ func (m *Membership) setupSerf() error {
 }
 
 type Handler interface {
-	Join(name, addr string) error
+	Join(name, addr string, voter bool) error
 	Leave(name string) error
 }
 
 func (m *Membership) eventHandler() {
 	for e := range m.events {
+		if e, ok := e.(serf.MemberEvent); ok {
+			m.notify(e)
+		}
 		switch e.EventType() {
+		case serf.EventUser:
+			m.handleUserEvent(e.(serf.UserEvent))
+		case serf.EventQuery:
+			m.handleQuery(e.(*serf.Query))
 		case serf.EventMemberJoin:
 			for _, member := range e.(serf.MemberEvent).Members {
 				if m.isLocal(member) {
@@ -80,10 +118,20 @@ func (m *Membership) eventHandler() {
 				}
 				m.handleJoin(member)
 			}
-		case serf.EventMemberLeave, serf.EventMemberFailed:
+		case serf.EventMemberFailed:
+			// a failed member might be just cut off for a while, so it's
+			// kept in the cluster until serf reaps it
+			for _, member := range e.(serf.MemberEvent).Members {
+				m.logger.Warn(
+					"member failed",
+					zap.String("name", member.Name),
+					zap.String("rpc_addr", member.Tags["rpc_addr"]),
+				)
+			}
+		case serf.EventMemberLeave, serf.EventMemberReap:
 			for _, member := range e.(serf.MemberEvent).Members {
 				if m.isLocal(member) {
-					return
+					continue
 				}
 				m.handleLeave(member)
 			}
@@ -92,7 +140,12 @@ func (m *Membership) eventHandler() {
 }
 
 func (m *Membership) handleJoin(member serf.Member) {
-	if err := m.handler.Join(member.Name, member.Tags["rpc_addr"]); err != nil {
+	readReplica, _ := strconv.ParseBool(member.Tags["read_replica"])
+	if err := m.handler.Join(
+		member.Name,
+		member.Tags["rpc_addr"],
+		!readReplica,
+	); err != nil {
 		m.logError(err, "failed to join", member)
 	}
 }
@@ -111,10 +164,23 @@ func (m *Membership) Members() []serf.Member {
 	return m.serf.Members()
 }
 
+// KeyManager installs, uses and removes the gossip keys across the
+// cluster, so they can be rotated without downtime: install the new key,
+// use it, then remove the old one.
+func (m *Membership) KeyManager() *serf.KeyManager {
+	return m.serf.KeyManager()
+}
+
 func (m *Membership) Leave() error {
 	return m.serf.Leave()
 }
 
+// Shutdown stops the gossip without leaving the cluster, so the other
+// members will see the node as failed until it comes back.
+func (m *Membership) Shutdown() error {
+	return m.serf.Shutdown()
+}
+
 func (m *Membership) logError(err error, msg string, member serf.Member) {
 	log := m.logger.Error
 	if err == raft.ErrNotLeader {
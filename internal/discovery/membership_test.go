@@ -1,7 +1,10 @@
 package discovery
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -30,7 +33,61 @@ func TestMembership(t *testing.T) {
 	require.Equal(t, fmt.Sprintf("%d", 2), <-handler.leaves)
 }
 
-func setupMember(t *testing.T, members []*Membership) ([]*Membership, *handler) {
+func TestMembershipFailed(t *testing.T) {
+	withReapTimeout := func(c *Config) { c.ReapTimeout = time.Minute }
+	m, handler := setupMember(t, nil, withReapTimeout)
+	m, _ = setupMember(t, m, withReapTimeout)
+	m, _ = setupMember(t, m, withReapTimeout)
+
+	require.Eventually(t, func() bool {
+		return len(handler.joins) == 2 && len(m[0].Members()) == 3
+	}, 3*time.Second, 250*time.Millisecond)
+	require.NoError(t, m[2].Shutdown())
+	require.Eventually(t, func() bool {
+		return memberStatus(m[0], "2") == serf.StatusFailed
+	}, 10*time.Second, 250*time.Millisecond)
+	require.Equal(t, 0, len(handler.leaves))
+
+	// the member comes back before it's reaped
+	c := m[2].Config
+	c.StartJoinAddrs = []string{m[0].BindAddr}
+	_, err := New(m[2].handler, c)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return memberStatus(m[0], "2") == serf.StatusAlive
+	}, 10*time.Second, 250*time.Millisecond)
+	require.Equal(t, 3, len(handler.joins))
+	require.Equal(t, 0, len(handler.leaves))
+}
+
+func TestMembershipReap(t *testing.T) {
+	withReapTimeout := func(c *Config) { c.ReapTimeout = time.Second }
+	m, handler := setupMember(t, nil, withReapTimeout)
+	m, _ = setupMember(t, m, withReapTimeout)
+
+	require.Eventually(t, func() bool {
+		return len(handler.joins) == 1 && len(m[0].Members()) == 2
+	}, 3*time.Second, 250*time.Millisecond)
+	require.NoError(t, m[1].Shutdown())
+	require.Eventually(t, func() bool {
+		return memberStatus(m[0], "1") == serf.StatusFailed
+	}, 10*time.Second, 250*time.Millisecond)
+	require.Eventually(t, func() bool {
+		return len(handler.leaves) == 1
+	}, 5*time.Second, 250*time.Millisecond)
+	require.Equal(t, "1", <-handler.leaves)
+}
+
+func memberStatus(m *Membership, name string) serf.MemberStatus {
+	for _, member := range m.Members() {
+		if member.Name == name {
+			return member.Status
+		}
+	}
+	return serf.StatusNone
+}
+
+func setupMember(t *testing.T, members []*Membership, opts ...func(*Config)) ([]*Membership, *handler) {
 	id := len(members)
 	ports := dynaport.Get(1)
 	addr := fmt.Sprintf("%s:%d", "127.0.0.1", ports[0])
@@ -42,6 +99,9 @@ func setupMember(t *testing.T, members []*Membership) ([]*Membership, *handler)
 		BindAddr: addr,
 		Tags:     tags,
 	}
+	for _, opt := range opts {
+		opt(&c)
+	}
 
 	h := &handler{}
 	if len(members) == 0 {
@@ -63,13 +123,20 @@ func setupMember(t *testing.T, members []*Membership) ([]*Membership, *handler)
 type handler struct {
 	joins  chan map[string]string
 	leaves chan string
+	// joinErrs is the number of joins to fail first
+	joinErrs int32
 }
 
-func (h *handler) Join(id, addr string) error {
+func (h *handler) Join(id, addr string, voter bool) error {
+	if n := atomic.LoadInt32(&h.joinErrs); n > 0 &&
+		atomic.CompareAndSwapInt32(&h.joinErrs, n, n-1) {
+		return errors.New("join failed")
+	}
 	if h.joins != nil {
 		h.joins <- map[string]string{
-			"id":   id,
-			"addr": addr,
+			"id":    id,
+			"addr":  addr,
+			"voter": strconv.FormatBool(voter),
 		}
 	}
 
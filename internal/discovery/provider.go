@@ -0,0 +1,201 @@
+package discovery
+
+import (
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/serf/serf"
+	"go.uber.org/zap"
+)
+
+// Provider finds the members of the cluster and calls its handler as they
+// join and leave. Membership finds them through serf gossip, Static and
+// DNS through a file and DNS SRV records, for the environments that block
+// gossip.
+type Provider interface {
+	Members() []serf.Member
+	// Watch returns the channel of the members' changes, and a func to
+	// stop watching.
+	Watch() (<-chan serf.MemberEvent, func())
+	// Leave leaves the cluster for good.
+	Leave() error
+	// Shutdown stops the provider without leaving the cluster.
+	Shutdown() error
+}
+
+var (
+	_ Provider = (*Membership)(nil)
+	_ Provider = (*Static)(nil)
+	_ Provider = (*DNS)(nil)
+)
+
+// poller lists the members every interval, and calls the handler for
+// the members that have come, changed, or gone since the last list, and
+// again for those whose join failed. The listed members are alive, the
+// unlisted ones are gone.
+type poller struct {
+	handler  Handler
+	nodeName string
+	interval time.Duration
+	list     func() ([]serf.Member, error)
+	logger   *zap.Logger
+	watchers
+
+	mu      sync.RWMutex
+	members map[string]serf.Member
+	// the members whose join failed, joined again on every poll until
+	// it succeeds
+	failedJoins map[string]bool
+
+	closed chan struct{}
+	done   chan struct{}
+}
+
+func newPoller(
+	handler Handler,
+	nodeName string,
+	interval time.Duration,
+	list func() ([]serf.Member, error),
+	logger *zap.Logger,
+) *poller {
+	if interval == 0 {
+		interval = 5 * time.Second
+	}
+
+	return &poller{
+		handler:  handler,
+		nodeName: nodeName,
+		interval: interval,
+		list:     list,
+		logger:   logger,
+		closed:   make(chan struct{}),
+		done:     make(chan struct{}),
+
+		failedJoins: make(map[string]bool),
+	}
+}
+
+// start lists the members once, failing if it can't, and then keeps
+// polling until shutdown.
+func (p *poller) start() error {
+	if err := p.poll(); err != nil {
+		return err
+	}
+
+	go p.run()
+	return nil
+}
+
+func (p *poller) run() {
+	defer close(p.done)
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// the last list stands until the next one succeeds
+			if err := p.poll(); err != nil {
+				p.logger.Error("failed to list members", zap.Error(err))
+			}
+		case <-p.closed:
+			return
+		}
+	}
+}
+
+func (p *poller) poll() error {
+	list, err := p.list()
+	if err != nil {
+		return err
+	}
+	members := make(map[string]serf.Member, len(list))
+	for _, member := range list {
+		member.Status = serf.StatusAlive
+		members[member.Name] = member
+	}
+
+	p.mu.Lock()
+	prev := p.members
+	p.members = members
+	p.mu.Unlock()
+
+	for name, member := range members {
+		old, ok := prev[name]
+		switch {
+		case !ok:
+			p.notify(serf.MemberEvent{Type: serf.EventMemberJoin, Members: []serf.Member{member}})
+		case !reflect.DeepEqual(old.Tags, member.Tags):
+			p.notify(serf.MemberEvent{Type: serf.EventMemberUpdate, Members: []serf.Member{member}})
+		}
+		if name == p.nodeName || ok && !p.failedJoins[name] &&
+			old.Tags["rpc_addr"] == member.Tags["rpc_addr"] &&
+			old.Tags["read_replica"] == member.Tags["read_replica"] {
+			continue
+		}
+		readReplica, _ := strconv.ParseBool(member.Tags["read_replica"])
+		if err := p.handler.Join(name, member.Tags["rpc_addr"], !readReplica); err != nil {
+			p.failedJoins[name] = true
+			p.logError(err, "failed to join", member)
+		} else {
+			delete(p.failedJoins, name)
+		}
+	}
+	for name, member := range prev {
+		if _, ok := members[name]; ok {
+			continue
+		}
+		delete(p.failedJoins, name)
+		member.Status = serf.StatusLeft
+		p.notify(serf.MemberEvent{Type: serf.EventMemberLeave, Members: []serf.Member{member}})
+		if name == p.nodeName {
+			continue
+		}
+		if err := p.handler.Leave(name); err != nil {
+			p.logError(err, "failed to leave", member)
+		}
+	}
+
+	return nil
+}
+
+func (p *poller) Members() []serf.Member {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	members := make([]serf.Member, 0, len(p.members))
+	for _, member := range p.members {
+		members = append(members, member)
+	}
+	return members
+}
+
+// Leave has nothing to announce, the other nodes see the node gone once
+// it's unlisted.
+func (p *poller) Leave() error {
+	return nil
+}
+
+func (p *poller) Shutdown() error {
+	select {
+	case <-p.closed:
+	default:
+		close(p.closed)
+		<-p.done
+	}
+	return nil
+}
+
+func (p *poller) logError(err error, msg string, member serf.Member) {
+	log := p.logger.Error
+	if err == raft.ErrNotLeader {
+		log = p.logger.Debug
+	}
+	log(
+		msg,
+		zap.Error(err),
+		zap.String("name", member.Name),
+		zap.String("rpc_addr", member.Tags["rpc_addr"]),
+	)
+}
@@ -0,0 +1,93 @@
+package discovery
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"go.uber.org/zap"
+)
+
+// Static lists the members from a file, and checks it every interval to
+// pick up the changes: the file is reread only once it's replaced, or its
+// modification time or size changes. The file lists the nodes in JSON:
+//
+//	[
+//	  {"name": "0", "rpc_addr": "10.0.0.1:8400"},
+//	  {"name": "1", "rpc_addr": "10.0.0.2:8400", "zone": "us-east-1b", "read_replica": true}
+//	]
+type Static struct {
+	StaticConfig
+	*poller
+
+	// the file as last read, and the members it listed
+	info    os.FileInfo
+	members []serf.Member
+}
+
+type StaticConfig struct {
+	NodeName string
+	File     string
+	// Interval between the reads of the file, 5 seconds by default.
+	Interval time.Duration
+}
+
+// staticMember is a node in the file.
+type staticMember struct {
+	Name        string `json:"name"`
+	RPCAddr     string `json:"rpc_addr"`
+	Zone        string `json:"zone"`
+	ReadReplica bool   `json:"read_replica"`
+}
+
+func NewStatic(handler Handler, config StaticConfig) (*Static, error) {
+	s := &Static{StaticConfig: config}
+	s.poller = newPoller(
+		handler,
+		config.NodeName,
+		config.Interval,
+		s.list,
+		zap.L().Named("static"),
+	)
+	if err := s.start(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *Static) list() ([]serf.Member, error) {
+	info, err := os.Stat(s.File)
+	if err != nil {
+		return nil, err
+	}
+	if s.info != nil && os.SameFile(s.info, info) &&
+		s.info.ModTime().Equal(info.ModTime()) && s.info.Size() == info.Size() {
+		return s.members, nil
+	}
+
+	b, err := os.ReadFile(s.File)
+	if err != nil {
+		return nil, err
+	}
+	var nodes []staticMember
+	if err = json.Unmarshal(b, &nodes); err != nil {
+		return nil, err
+	}
+
+	members := make([]serf.Member, 0, len(nodes))
+	for _, node := range nodes {
+		members = append(members, serf.Member{
+			Name: node.Name,
+			Tags: map[string]string{
+				"rpc_addr":     node.RPCAddr,
+				"zone":         node.Zone,
+				"read_replica": strconv.FormatBool(node.ReadReplica),
+			},
+		})
+	}
+	s.info, s.members = info, members
+	return members, nil
+}
@@ -0,0 +1,122 @@
+package discovery
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "static-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "members.json")
+	write := func(members string) {
+		// replaced through a rename, so the reads never see it half written
+		require.NoError(t, os.WriteFile(file+".tmp", []byte(members), 0644))
+		require.NoError(t, os.Rename(file+".tmp", file))
+	}
+
+	write(`[
+		{"name": "0", "rpc_addr": "127.0.0.1:8400"},
+		{"name": "1", "rpc_addr": "127.0.0.1:8401"}
+	]`)
+	h := &handler{
+		joins:  make(chan map[string]string, 3),
+		leaves: make(chan string, 3),
+	}
+	s, err := NewStatic(h, StaticConfig{
+		NodeName: "0",
+		File:     file,
+		Interval: 50 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer s.Shutdown()
+
+	require.Equal(t, map[string]string{
+		"id": "1", "addr": "127.0.0.1:8401", "voter": "true",
+	}, <-h.joins)
+	require.Equal(t, 2, len(s.Members()))
+
+	events, stop := s.Watch()
+	defer stop()
+	write(`[
+		{"name": "0", "rpc_addr": "127.0.0.1:8400"},
+		{"name": "2", "rpc_addr": "127.0.0.1:8402", "read_replica": true}
+	]`)
+	require.Equal(t, map[string]string{
+		"id": "2", "addr": "127.0.0.1:8402", "voter": "false",
+	}, <-h.joins)
+	require.Equal(t, "1", <-h.leaves)
+	e := <-events
+	require.Equal(t, serf.EventMemberJoin, e.Type)
+	require.Equal(t, "2", e.Members[0].Name)
+	e = <-events
+	require.Equal(t, serf.EventMemberLeave, e.Type)
+	require.Equal(t, "1", e.Members[0].Name)
+	require.Equal(t, serf.StatusLeft, e.Members[0].Status)
+
+	// the file is reread only once it's changed, not when it's written
+	// over with the modification time and size kept
+	info, err := os.Stat(file)
+	require.NoError(t, err)
+	b, err := os.ReadFile(file)
+	require.NoError(t, err)
+	b = bytes.Replace(b, []byte("8402"), []byte("8403"), 1)
+	require.NoError(t, os.WriteFile(file, b, 0644))
+	require.NoError(t, os.Chtimes(file, info.ModTime(), info.ModTime()))
+	time.Sleep(200 * time.Millisecond)
+	require.Equal(t, 0, len(h.joins))
+	modified := info.ModTime().Add(time.Second)
+	require.NoError(t, os.Chtimes(file, modified, modified))
+	require.Equal(t, map[string]string{
+		"id": "2", "addr": "127.0.0.1:8403", "voter": "false",
+	}, <-h.joins)
+	<-events
+
+	// a broken file keeps the last members
+	write(`[{"name": "0"`)
+	time.Sleep(200 * time.Millisecond)
+	require.Equal(t, 0, len(h.joins))
+	require.Equal(t, 0, len(h.leaves))
+	require.Equal(t, 2, len(s.Members()))
+}
+
+func TestStaticRetriesFailedJoins(t *testing.T) {
+	dir, err := ioutil.TempDir("", "static-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "members.json")
+	require.NoError(t, os.WriteFile(file, []byte(`[
+		{"name": "0", "rpc_addr": "127.0.0.1:8400"},
+		{"name": "1", "rpc_addr": "127.0.0.1:8401"}
+	]`), 0644))
+
+	h := &handler{
+		joins:    make(chan map[string]string, 3),
+		joinErrs: 2,
+	}
+	s, err := NewStatic(h, StaticConfig{
+		NodeName: "0",
+		File:     file,
+		Interval: 50 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer s.Shutdown()
+
+	// the member is joined on the third poll, and only once
+	select {
+	case join := <-h.joins:
+		require.Equal(t, "1", join["id"])
+	case <-time.After(time.Second):
+		t.Fatal("the failed join wasn't retried")
+	}
+	time.Sleep(200 * time.Millisecond)
+	require.Equal(t, 0, len(h.joins))
+}
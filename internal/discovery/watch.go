@@ -0,0 +1,48 @@
+package discovery
+
+import (
+	"sync"
+
+	"github.com/hashicorp/serf/serf"
+)
+
+// watchers fans the member events out to the providers' watchers.
+type watchers struct {
+	mu    sync.Mutex
+	chans map[chan serf.MemberEvent]struct{}
+}
+
+// Watch returns the channel of the member events from now on, and a func
+// to stop watching. The channel is closed if the watcher falls behind,
+// rather than hold up the provider.
+func (w *watchers) Watch() (<-chan serf.MemberEvent, func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.chans == nil {
+		w.chans = make(map[chan serf.MemberEvent]struct{})
+	}
+	ch := make(chan serf.MemberEvent, 64)
+	w.chans[ch] = struct{}{}
+
+	return ch, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if _, ok := w.chans[ch]; ok {
+			delete(w.chans, ch)
+			close(ch)
+		}
+	}
+}
+
+func (w *watchers) notify(e serf.MemberEvent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for ch := range w.chans {
+		select {
+		case ch <- e:
+		default:
+			delete(w.chans, ch)
+			close(ch)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package loadbalance
+
+import (
+	"context"
+	"strconv"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// PartitionKey is the metadata key of the partition the calls are for.
+// The requests name their partition too, the key has the picker route
+// the produces to the partition's leader.
+const PartitionKey = "proglog-partition"
+
+// WithPartition returns the context of the calls to the partition.
+func WithPartition(ctx context.Context, partition uint32) context.Context {
+	return metadata.AppendToOutgoingContext(
+		ctx, PartitionKey, strconv.FormatUint(uint64(partition), 10),
+	)
+}
+
+func partitionOf(ctx context.Context) uint32 {
+	if ctx == nil {
+		return 0
+	}
+	md, _ := metadata.FromOutgoingContext(ctx)
+	values := md.Get(PartitionKey)
+	if len(values) == 0 {
+		return 0
+	}
+	partition, err := strconv.ParseUint(values[len(values)-1], 10, 32)
+	if err != nil {
+		return 0
+	}
+	return uint32(partition)
+}
+
+// leaderOf is the resolver's attribute of the partitions a server leads.
+type leaderOf []uint32
+
+// Equal lets the addresses with the attribute be compared.
+func (l leaderOf) Equal(o interface{}) bool {
+	other, ok := o.(leaderOf)
+	if !ok || len(l) != len(other) {
+		return false
+	}
+	for i := range l {
+		if l[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -1,51 +1,109 @@
 package loadbalance
 
 import (
+	"math/rand"
 	"strings"
-	"sync"
-	"sync/atomic"
+	"time"
 
 	"google.golang.org/grpc/balancer"
 	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+
+	api "github.com/fedoroko/proglog/api/v1"
 )
 
 var _ base.PickerBuilder = (*Picker)(nil)
 
 type Picker struct {
-	mu        sync.Mutex
-	leader    balancer.SubConn
-	followers []balancer.SubConn
-	current   uint64
+	leader balancer.SubConn
+	// the leaders of the partitions, when the log runs a raft group per
+	// partition; the leader is the partition 0's
+	partitionLeaders map[uint32]balancer.SubConn
+	followers        []balancer.SubConn
+	replicas         []balancer.SubConn // non-voters, never receive produces
+	// the followers and replicas in the client's zone
+	localFollowers []balancer.SubConn
+	localReplicas  []balancer.SubConn
+	all            []balancer.SubConn
+	// the addresses of the servers, their stats and the sessions are
+	// kept by
+	addrs           map[balancer.SubConn]string
+	consumersByAddr map[string]balancer.SubConn
+	stats           *stats
+	sessions        *sessions
+	routes          *routeTable
+	// Routes are the routes of the balancer's config, added to the default
+	// ones in the pickers built.
+	Routes []Route
 }
 
-func (p *Picker) Build(buildInfo base.PickerBuildInfo) balancer.Picker {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-
-	var followers []balancer.SubConn
+// Build returns a picker of its own for each conn, so conns to different
+// clusters don't pick each other's servers. The pickers built by the same
+// builder share the servers' stats and the consumer sessions.
+func (b *Picker) Build(buildInfo base.PickerBuildInfo) balancer.Picker {
+	b.share()
+	p := &Picker{
+		stats:            b.stats,
+		sessions:         b.sessions,
+		routes:           newRouteTable(b.Routes),
+		addrs:            make(map[balancer.SubConn]string),
+		consumersByAddr:  make(map[string]balancer.SubConn),
+		partitionLeaders: make(map[uint32]balancer.SubConn),
+	}
+	var followers, replicas []balancer.SubConn
 	for sc, scInfo := range buildInfo.ReadySCs {
+		p.all = append(p.all, sc)
+		p.addrs[sc] = scInfo.Address.Addr
+		partitions, _ := scInfo.Address.Attributes.Value("leader_of").(leaderOf)
+		for _, partition := range partitions {
+			p.partitionLeaders[partition] = sc
+		}
 		isLeader := scInfo.Address.Attributes.Value("is_leader").(bool)
 		if isLeader {
 			p.leader = sc
 			continue
 		}
+		p.consumersByAddr[scInfo.Address.Addr] = sc
+		local, _ := scInfo.Address.Attributes.Value("local_zone").(bool)
+		if role, _ := scInfo.Address.Attributes.Value("role").(api.Role); role == api.Role_NONVOTER {
+			replicas = append(replicas, sc)
+			if local {
+				p.localReplicas = append(p.localReplicas, sc)
+			}
+			continue
+		}
 		followers = append(followers, sc)
+		if local {
+			p.localFollowers = append(p.localFollowers, sc)
+		}
 	}
 	p.followers = followers
+	p.replicas = replicas
 	return p
 }
 
 var _ balancer.Picker = (*Picker)(nil)
 
 func (p *Picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-
 	var result balancer.PickResult
-	if strings.Contains(info.FullMethodName, "Produce") || len(p.followers) == 0 {
+	switch p.routes.policy(info.FullMethodName) {
+	case Leader:
 		result.SubConn = p.leader
-	} else if strings.Contains(info.FullMethodName, "Consume") {
-		result.SubConn = p.nextFollower()
+		if partition := partitionOf(info.Ctx); partition != 0 {
+			result.SubConn = p.partitionLeaders[partition]
+		}
+	case Follower:
+		consumers := p.consumers()
+		if len(consumers) == 0 {
+			result.SubConn = p.leader
+			break
+		}
+		result.SubConn = p.pickConsumer(sessionOf(info.Ctx), consumers)
+		result.Done = p.stats.get(p.addrs[result.SubConn]).track(
+			strings.Contains(info.FullMethodName, "Stream"),
+		)
+	case Any:
+		result.SubConn = p.leastLoaded(p.all)
 	}
 	if result.SubConn == nil {
 		return result, balancer.ErrNoSubConnAvailable
@@ -53,15 +111,115 @@ func (p *Picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
 	return result, nil
 }
 
-func (p *Picker) nextFollower() balancer.SubConn {
-	curr := atomic.AddUint64(&p.current, uint64(1))
-	ln := uint64(len(p.followers))
-	idx := int(curr % ln)
-	return p.followers[idx]
+// consumers returns the servers to consume from: the replicas over the
+// followers, and those in the client's zone over the other zones'. The
+// ejected servers are left out, unless they're all ejected.
+func (p *Picker) consumers() []balancer.SubConn {
+	groups := [][]balancer.SubConn{
+		p.localReplicas,
+		p.localFollowers,
+		p.replicas,
+		p.followers,
+	}
+	now := time.Now()
+	for _, subConns := range groups {
+		var healthy []balancer.SubConn
+		for _, sc := range subConns {
+			if !p.stats.get(p.addrs[sc]).ejected(now) {
+				healthy = append(healthy, sc)
+			}
+		}
+		if len(healthy) != 0 {
+			return healthy
+		}
+	}
+	for _, subConns := range groups {
+		if len(subConns) != 0 {
+			return subConns
+		}
+	}
+	return nil
+}
+
+// pickConsumer picks the follower the session is bound to while it's
+// ready and not ejected, and binds the session to the least loaded of the
+// consumers otherwise. A session bound to a follower reconnecting is
+// served by the least loaded consumer meanwhile, and stays bound.
+func (p *Picker) pickConsumer(session string, consumers []balancer.SubConn) balancer.SubConn {
+	if session == "" {
+		return p.leastLoaded(consumers)
+	}
+	if addr := p.sessions.get(session); addr != "" &&
+		!p.stats.get(addr).ejected(time.Now()) {
+		if sc, ok := p.consumersByAddr[addr]; ok {
+			return sc
+		}
+		return p.leastLoaded(consumers)
+	}
+	sc := p.leastLoaded(consumers)
+	p.sessions.bind(session, p.addrs[sc])
+	return sc
+}
+
+// leastLoaded picks the less loaded of two servers picked at random, the
+// power of two choices: it avoids the slow servers without herding all
+// the calls to the fastest one.
+func (p *Picker) leastLoaded(subConns []balancer.SubConn) balancer.SubConn {
+	switch len(subConns) {
+	case 0:
+		return nil
+	case 1:
+		return subConns[0]
+	}
+	i := rand.Intn(len(subConns))
+	j := rand.Intn(len(subConns) - 1)
+	if j >= i {
+		j++
+	}
+	a, b := subConns[i], subConns[j]
+	if p.stats.get(p.addrs[b]).cost() < p.stats.get(p.addrs[a]).cost() {
+		return b
+	}
+	return a
+}
+
+// share sets up the stats and sessions shared by the pickers built.
+func (b *Picker) share() {
+	if b.stats == nil {
+		b.stats = newStats()
+		b.sessions = newSessions()
+	}
+}
+
+// retain keeps the stats and the sessions of the servers in the
+// resolver's state, whether they're ready or not, and drops those of the
+// servers gone.
+func (b *Picker) retain(state resolver.State) {
+	b.share()
+	addrs := make(map[string]bool, len(state.Addresses))
+	for _, addr := range state.Addresses {
+		addrs[addr.Addr] = true
+	}
+	b.stats.retain(addrs)
+	b.sessions.retain(addrs)
+}
+
+// builder builds the balancer of each conn, with a picker builder of its
+// own, so the conn's pickers share their servers' stats and routes.
+type builder struct{}
+
+func (builder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	picker := &Picker{}
+	return &routedBalancer{
+		Balancer: base.NewBalancerBuilder(Name, picker, base.Config{}).Build(cc, opts),
+		picker:   picker,
+	}
+}
+
+func (builder) Name() string {
+	return Name
 }
 
 func init() {
-	balancer.Register(
-		base.NewBalancerBuilder(Name, &Picker{}, base.Config{}),
-	)
+	balancer.Register(builder{})
 }
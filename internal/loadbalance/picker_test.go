@@ -1,15 +1,23 @@
 package loadbalance_test
 
 import (
+	"context"
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc/attributes"
 	"google.golang.org/grpc/balancer"
 	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/status"
 
+	api "github.com/fedoroko/proglog/api/v1"
 	"github.com/fedoroko/proglog/internal/loadbalance"
+	"github.com/fedoroko/proglog/internal/server"
 )
 
 func TestPickerNoSubConnAvailable(t *testing.T) {
@@ -39,37 +47,522 @@ func TestPickerProducesToLeader(t *testing.T) {
 	}
 }
 
+func TestPickerProducesToPartitionLeaders(t *testing.T) {
+	servers := &partitionedServers{leaders: map[string][]uint32{
+		"localhost:9001": {0},
+		"localhost:9002": {1, 3},
+		"localhost:9003": {2},
+	}}
+	r, conn := setupResolverTest(t, &server.Config{GetServerer: servers})
+	defer r.Close()
+
+	cc := &balancerConn{}
+	b := balancer.Get(loadbalance.Name).Build(cc, balancer.BuildOptions{})
+	defer b.Close()
+	require.NoError(t, b.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState: conn.State(),
+	}))
+	for _, sc := range cc.subConns {
+		b.UpdateSubConnState(sc, balancer.SubConnState{
+			ConnectivityState: connectivity.Ready,
+		})
+	}
+
+	for addr, partitions := range servers.leaders {
+		for _, partition := range partitions {
+			pick, err := cc.picker.Pick(balancer.PickInfo{
+				FullMethodName: "/log.vX.Log/Produce",
+				Ctx:            loadbalance.WithPartition(context.Background(), partition),
+			})
+			require.NoError(t, err)
+			require.Equal(t, addr, pick.SubConn.(*subConn).addrs[0].Addr)
+		}
+	}
+
+	// a partition with no leader waits for one
+	_, err := cc.picker.Pick(balancer.PickInfo{
+		FullMethodName: "/log.vX.Log/Produce",
+		Ctx:            loadbalance.WithPartition(context.Background(), 4),
+	})
+	require.Equal(t, balancer.ErrNoSubConnAvailable, err)
+}
+
 func TestPickerConsumesFromAllFollowers(t *testing.T) {
 	picker, subConns := setupTest()
 	info := balancer.PickInfo{
 		FullMethodName: "/log.vX.Log/Consume",
 	}
+	// the calls in flight spread the picks over the equally fast followers
+	picks := make(map[balancer.SubConn]int)
+	for i := 0; i < 6; i++ {
+		pick, err := picker.Pick(info)
+		require.NoError(t, err)
+		picks[pick.SubConn]++
+	}
+	require.Equal(t, map[balancer.SubConn]int{subConns[1]: 3, subConns[2]: 3}, picks)
+}
+
+func TestPickerConsumesFromFastFollowers(t *testing.T) {
+	picker, subConns := setupTest()
+	info := balancer.PickInfo{
+		FullMethodName: "/log.vX.Log/Consume",
+	}
+	slow := subConns[1]
+	for i := 0; i < 10; i++ {
+		pick, err := picker.Pick(info)
+		require.NoError(t, err)
+		if pick.SubConn == slow {
+			time.Sleep(5 * time.Millisecond)
+		}
+		pick.Done(balancer.DoneInfo{})
+	}
+
+	for i := 0; i < 10; i++ {
+		pick, err := picker.Pick(info)
+		require.NoError(t, err)
+		require.Equal(t, subConns[2], pick.SubConn)
+		pick.Done(balancer.DoneInfo{})
+	}
+}
+
+func TestPickerEjectsFailingFollowers(t *testing.T) {
+	picker, subConns := setupTest()
+	info := balancer.PickInfo{
+		FullMethodName: "/log.vX.Log/Consume",
+	}
+	failing := subConns[1]
+	failures := 0
+	for failures < 5 {
+		pick, err := picker.Pick(info)
+		require.NoError(t, err)
+		var doneInfo balancer.DoneInfo
+		if pick.SubConn == failing {
+			doneInfo.Err = status.Error(codes.Unavailable, "overloaded")
+			failures++
+		}
+		pick.Done(doneInfo)
+	}
+
+	for i := 0; i < 10; i++ {
+		pick, err := picker.Pick(info)
+		require.NoError(t, err)
+		require.Equal(t, subConns[2], pick.SubConn)
+		pick.Done(balancer.DoneInfo{})
+	}
+
+	// the errors of the calls gone wrong on the client's side don't count,
+	// the follower failing on the server's side is the one ejected
+	picker, subConns = setupTest()
+	failures = 0
+	for failures < 5 {
+		pick, err := picker.Pick(info)
+		require.NoError(t, err)
+		doneInfo := balancer.DoneInfo{Err: api.ErrOffsetOutOfRange{}.GRPCStatus().Err()}
+		if pick.SubConn == subConns[2] {
+			doneInfo.Err = status.Error(codes.Unavailable, "overloaded")
+			failures++
+		}
+		pick.Done(doneInfo)
+	}
+	for i := 0; i < 10; i++ {
+		pick, err := picker.Pick(info)
+		require.NoError(t, err)
+		require.Equal(t, subConns[1], pick.SubConn)
+		pick.Done(balancer.DoneInfo{})
+	}
+}
+
+func TestPickerConsumesFromEjectedFollowers(t *testing.T) {
+	picker, subConns := setupTest()
+	info := balancer.PickInfo{
+		FullMethodName: "/log.vX.Log/Consume",
+	}
+	// with every follower ejected, the picks go on as if none were
+	for i := 0; i < 20; i++ {
+		pick, err := picker.Pick(info)
+		require.NoError(t, err)
+		pick.Done(balancer.DoneInfo{Err: status.Error(codes.Unavailable, "down")})
+	}
+	pick, err := picker.Pick(info)
+	require.NoError(t, err)
+	require.Contains(t, subConns[1:], pick.SubConn)
+}
+
+func TestPickerConsumesFromReplicas(t *testing.T) {
+	picker, subConns := setupTest(api.Role_NONVOTER)
+	info := balancer.PickInfo{
+		FullMethodName: "/log.vX.Log/Consume",
+	}
+	for i := 0; i < 5; i++ {
+		pick, err := picker.Pick(info)
+		require.NoError(t, err)
+		require.Equal(t, subConns[3], pick.SubConn)
+	}
+
+	info.FullMethodName = "/log.vX.Log/Produce"
+	for i := 0; i < 5; i++ {
+		pick, err := picker.Pick(info)
+		require.NoError(t, err)
+		require.Equal(t, subConns[0], pick.SubConn)
+	}
+}
+
+func TestPickerNeverProducesToReplicas(t *testing.T) {
+	picker := &loadbalance.Picker{}
+	buildInfo := base.PickerBuildInfo{
+		ReadySCs: make(map[balancer.SubConn]base.SubConnInfo),
+	}
+	addr := resolver.Address{
+		Attributes: attributes.New("is_leader", false).
+			WithValue("role", api.Role_NONVOTER),
+	}
+	buildInfo.ReadySCs[&subConn{}] = base.SubConnInfo{Address: addr}
+
+	result, err := picker.Build(buildInfo).Pick(balancer.PickInfo{
+		FullMethodName: "/log.vX.Log/Produce",
+	})
+	require.Equal(t, balancer.ErrNoSubConnAvailable, err)
+	require.Nil(t, result.SubConn)
+}
+
+func TestPickerConsumesFromLocalZone(t *testing.T) {
+	picker, subConns := setupZoneTest(
+		zonedSubConn{role: api.Role_VOTER, local: true, leader: true},
+		zonedSubConn{role: api.Role_VOTER, local: false},
+		zonedSubConn{role: api.Role_VOTER, local: true},
+		zonedSubConn{role: api.Role_NONVOTER, local: false},
+	)
+	info := balancer.PickInfo{
+		FullMethodName: "/log.vX.Log/Consume",
+	}
+	// the follower in the zone over the replica in another
 	for i := 0; i < 5; i++ {
 		pick, err := picker.Pick(info)
 		require.NoError(t, err)
-		require.Equal(t, subConns[i%2+1], pick.SubConn)
+		require.Equal(t, subConns[2], pick.SubConn)
+	}
+
+	// falls back to the other zones
+	picker, subConns = setupZoneTest(
+		zonedSubConn{role: api.Role_VOTER, local: true, leader: true},
+		zonedSubConn{role: api.Role_VOTER, local: false},
+	)
+	pick, err := picker.Pick(info)
+	require.NoError(t, err)
+	require.Equal(t, subConns[1], pick.SubConn)
+}
+
+func TestPickerRoutesEveryMethod(t *testing.T) {
+	picker, subConns := setupTest()
+	for method, want := range map[string][]*subConn{
+		"/log.vX.Log/GetServers":           subConns,
+		"/log.vX.Log/WatchServers":         subConns,
+		"/log.v1.Admin/TransferLeadership": subConns[:1],
+		"/log.vX.Log/ConsumeStream":        subConns[1:],
+		"/log.vX.Log/ProduceStream":        subConns[:1],
+		// the methods without a route go to any server
+		"/grpc.health.v1.Health/Check": subConns,
+		"/log.vX.Log/ProduceStats":     subConns,
+	} {
+		pick, err := picker.Pick(balancer.PickInfo{FullMethodName: method})
+		require.NoError(t, err, method)
+		require.Contains(t, want, pick.SubConn, method)
+	}
+}
+
+func TestPickerRoutesByConfig(t *testing.T) {
+	parser := balancer.Get(loadbalance.Name).(balancer.ConfigParser)
+	config, err := parser.ParseConfig([]byte(`{"routes":[
+		{"method":"/log.vX.Log/Consume","policy":"leader"},
+		{"prefix":"/log.v1.Admin/Get","policy":"follower"}
+	]}`))
+	require.NoError(t, err)
+
+	picker, subConns := setupTest()
+	picker = (&loadbalance.Picker{
+		Routes: config.(*loadbalance.Config).Routes,
+	}).Build(buildInfo(subConns)).(*loadbalance.Picker)
+	for method, want := range map[string][]*subConn{
+		// the full name over the default bare one
+		"/log.vX.Log/Consume": subConns[:1],
+		"/log.vY.Log/Consume": subConns[1:],
+		// the longer prefix over the default one
+		"/log.v1.Admin/GetRaftStats": subConns[1:],
+		"/log.v1.Admin/AddVoter":     subConns[:1],
+	} {
+		pick, err := picker.Pick(balancer.PickInfo{FullMethodName: method})
+		require.NoError(t, err, method)
+		require.Contains(t, want, pick.SubConn, method)
+	}
+
+	for _, js := range []string{
+		`{"routes":[{"method":"Consume","policy":"nearest"}]}`,
+		`{"routes":[{"policy":"any"}]}`,
+		`{"routes":[{"method":"Consume","prefix":"/log.v1.Log/","policy":"any"}]}`,
+	} {
+		_, err = parser.ParseConfig([]byte(js))
+		require.Error(t, err, js)
+	}
+}
+
+func TestPickerKeepsSessionsToTheirFollowers(t *testing.T) {
+	b, cc, state := setupBalancerTest(t)
+	info := balancer.PickInfo{
+		FullMethodName: "/log.vX.Log/ConsumeStream",
+		Ctx:            loadbalance.WithSession(context.Background(), "consumer"),
+	}
+
+	// the session keeps to its follower, however loaded
+	pick, err := cc.picker.Pick(info)
+	require.NoError(t, err)
+	follower := pick.SubConn
+	for i := 0; i < 10; i++ {
+		pick, err = cc.picker.Pick(info)
+		require.NoError(t, err)
+		require.Equal(t, follower, pick.SubConn)
+	}
+
+	// and across the pickers built as the servers change
+	require.NoError(t, b.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState: state,
+	}))
+	pick, err = cc.picker.Pick(info)
+	require.NoError(t, err)
+	require.Equal(t, follower, pick.SubConn)
+
+	// until the follower's gone
+	var rest resolver.State
+	for _, addr := range state.Addresses {
+		if addr.Addr != follower.(*subConn).addrs[0].Addr {
+			rest.Addresses = append(rest.Addresses, addr)
+		}
+	}
+	require.NoError(t, b.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState: rest,
+	}))
+	pick, err = cc.picker.Pick(info)
+	require.NoError(t, err)
+	require.NotEqual(t, follower, pick.SubConn)
+	require.NotEqual(t, cc.subConns[0], pick.SubConn)
+	follower = pick.SubConn
+	for i := 0; i < 10; i++ {
+		pick, err = cc.picker.Pick(info)
+		require.NoError(t, err)
+		require.Equal(t, follower, pick.SubConn)
+	}
+
+	// the session doesn't come back with the old follower
+	require.NoError(t, b.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState: state,
+	}))
+	for _, sc := range cc.subConns[3:] {
+		b.UpdateSubConnState(sc, balancer.SubConnState{
+			ConnectivityState: connectivity.Ready,
+		})
 	}
+	pick, err = cc.picker.Pick(info)
+	require.NoError(t, err)
+	require.Equal(t, follower, pick.SubConn)
 }
 
-func setupTest() (*loadbalance.Picker, []*subConn) {
+func TestPickerKeepsSessionsAcrossReconnects(t *testing.T) {
+	b, cc, _ := setupBalancerTest(t)
+	info := balancer.PickInfo{
+		FullMethodName: "/log.vX.Log/ConsumeStream",
+		Ctx:            loadbalance.WithSession(context.Background(), "consumer"),
+	}
+	pick, err := cc.picker.Pick(info)
+	require.NoError(t, err)
+	follower := pick.SubConn
+
+	// the other follower serves the session while its own reconnects
+	b.UpdateSubConnState(follower, balancer.SubConnState{
+		ConnectivityState: connectivity.TransientFailure,
+	})
+	pick, err = cc.picker.Pick(info)
+	require.NoError(t, err)
+	require.NotEqual(t, follower, pick.SubConn)
+	require.NotEqual(t, cc.subConns[0], pick.SubConn)
+
+	// and the session's back on its follower once it's ready
+	b.UpdateSubConnState(follower, balancer.SubConnState{
+		ConnectivityState: connectivity.Ready,
+	})
+	for i := 0; i < 10; i++ {
+		pick, err = cc.picker.Pick(info)
+		require.NoError(t, err)
+		require.Equal(t, follower, pick.SubConn)
+	}
+}
+
+func TestPickerMovesSessionsOffEjectedFollowers(t *testing.T) {
+	picker, subConns := setupTest()
+	info := balancer.PickInfo{
+		FullMethodName: "/log.vX.Log/Consume",
+		Ctx:            loadbalance.WithSession(context.Background(), "consumer"),
+	}
+	pick, err := picker.Pick(info)
+	require.NoError(t, err)
+	failing := pick.SubConn
+	pick.Done(balancer.DoneInfo{Err: status.Error(codes.Unavailable, "overloaded")})
+	for i := 1; i < 5; i++ {
+		pick, err = picker.Pick(info)
+		require.NoError(t, err)
+		require.Equal(t, failing, pick.SubConn)
+		pick.Done(balancer.DoneInfo{Err: status.Error(codes.Unavailable, "overloaded")})
+	}
+
+	pick, err = picker.Pick(info)
+	require.NoError(t, err)
+	require.NotEqual(t, failing, pick.SubConn)
+	require.Contains(t, subConns[1:], pick.SubConn)
+}
+
+func TestPickerKeepsEjectionsAcrossReconnects(t *testing.T) {
+	b, cc, _ := setupBalancerTest(t)
+	info := balancer.PickInfo{
+		FullMethodName: "/log.vX.Log/Consume",
+	}
+	pick, err := cc.picker.Pick(info)
+	require.NoError(t, err)
+	failing := pick.SubConn
+	pick.Done(balancer.DoneInfo{Err: status.Error(codes.Unavailable, "overloaded")})
+	for failures := 1; failures < 5; {
+		pick, err = cc.picker.Pick(info)
+		require.NoError(t, err)
+		var doneInfo balancer.DoneInfo
+		if pick.SubConn == failing {
+			doneInfo.Err = status.Error(codes.Unavailable, "overloaded")
+			failures++
+		}
+		pick.Done(doneInfo)
+	}
+
+	// the ejected follower stays ejected as it reconnects
+	b.UpdateSubConnState(failing, balancer.SubConnState{
+		ConnectivityState: connectivity.TransientFailure,
+	})
+	b.UpdateSubConnState(failing, balancer.SubConnState{
+		ConnectivityState: connectivity.Ready,
+	})
+	for i := 0; i < 10; i++ {
+		pick, err = cc.picker.Pick(info)
+		require.NoError(t, err)
+		require.NotEqual(t, failing, pick.SubConn)
+		require.NotEqual(t, cc.subConns[0], pick.SubConn)
+		pick.Done(balancer.DoneInfo{})
+	}
+}
+
+type zonedSubConn struct {
+	role   api.Role
+	local  bool
+	leader bool
+}
+
+// setupZoneTest builds a picker over a sub conn per each of the given ones.
+func setupZoneTest(conns ...zonedSubConn) (balancer.Picker, []*subConn) {
 	var subConns []*subConn
 	buildInfo := base.PickerBuildInfo{
 		ReadySCs: make(map[balancer.SubConn]base.SubConnInfo),
 	}
-	for i := 0; i < 3; i++ {
+	for i, conn := range conns {
 		sc := &subConn{}
 		addr := resolver.Address{
+			Addr: fmt.Sprintf("localhost:%d", 9001+i),
+			Attributes: attributes.New("is_leader", conn.leader).
+				WithValue("role", conn.role).
+				WithValue("local_zone", conn.local),
+		}
+		sc.UpdateAddresses([]resolver.Address{addr})
+		buildInfo.ReadySCs[sc] = base.SubConnInfo{Address: addr}
+		subConns = append(subConns, sc)
+	}
+	return (&loadbalance.Picker{}).Build(buildInfo), subConns
+}
+
+// setupTest builds a picker over a leader, two followers and a sub conn
+// per each of the given extra roles.
+func setupTest(roles ...api.Role) (*loadbalance.Picker, []*subConn) {
+	var subConns []*subConn
+	buildInfo := base.PickerBuildInfo{
+		ReadySCs: make(map[balancer.SubConn]base.SubConnInfo),
+	}
+	for i := 0; i < 3+len(roles); i++ {
+		sc := &subConn{}
+		addr := resolver.Address{
+			Addr:       fmt.Sprintf("localhost:%d", 9001+i),
 			Attributes: attributes.New("is_leader", i == 0),
 		}
+		if i >= 3 {
+			addr.Attributes = addr.Attributes.WithValue("role", roles[i-3])
+		}
 		sc.UpdateAddresses([]resolver.Address{addr})
 		buildInfo.ReadySCs[sc] = base.SubConnInfo{Address: addr}
 		subConns = append(subConns, sc)
 	}
-	picker := &loadbalance.Picker{}
-	picker.Build(buildInfo)
+	picker := (&loadbalance.Picker{}).Build(buildInfo).(*loadbalance.Picker)
 	return picker, subConns
 }
 
+// setupBalancerTest builds the balancer over a leader and two followers,
+// has their sub conns connect, and returns the resolver's state.
+func setupBalancerTest(t *testing.T) (balancer.Balancer, *balancerConn, resolver.State) {
+	t.Helper()
+	cc := &balancerConn{}
+	b := balancer.Get(loadbalance.Name).Build(cc, balancer.BuildOptions{})
+	t.Cleanup(b.Close)
+
+	var state resolver.State
+	for i := 0; i < 3; i++ {
+		state.Addresses = append(state.Addresses, resolver.Address{
+			Addr:       fmt.Sprintf("localhost:%d", 9001+i),
+			Attributes: attributes.New("is_leader", i == 0),
+		})
+	}
+	require.NoError(t, b.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState: state,
+	}))
+	for _, sc := range cc.subConns {
+		b.UpdateSubConnState(sc, balancer.SubConnState{
+			ConnectivityState: connectivity.Ready,
+		})
+	}
+	return b, cc, state
+}
+
+// balancerConn records the sub conns of the balancer and its last picker.
+type balancerConn struct {
+	balancer.ClientConn
+	subConns []*subConn
+	picker   balancer.Picker
+}
+
+func (c *balancerConn) NewSubConn(
+	addrs []resolver.Address, _ balancer.NewSubConnOptions,
+) (balancer.SubConn, error) {
+	sc := &subConn{addrs: addrs}
+	c.subConns = append(c.subConns, sc)
+	return sc, nil
+}
+
+func (c *balancerConn) RemoveSubConn(balancer.SubConn) {}
+
+func (c *balancerConn) UpdateState(state balancer.State) {
+	c.picker = state.Picker
+}
+
+// buildInfo returns the build info of the sub conns, set up already.
+func buildInfo(subConns []*subConn) base.PickerBuildInfo {
+	buildInfo := base.PickerBuildInfo{
+		ReadySCs: make(map[balancer.SubConn]base.SubConnInfo),
+	}
+	for _, sc := range subConns {
+		buildInfo.ReadySCs[sc] = base.SubConnInfo{Address: sc.addrs[0]}
+	}
+	return buildInfo
+}
+
 type subConn struct {
 	addrs []resolver.Address
 }
@@ -83,3 +576,22 @@ func (s *subConn) Connect() {}
 func (s *subConn) GetOrBuildProducer(_ balancer.ProducerBuilder) (p balancer.Producer, close func()) {
 	return nil, nil
 }
+
+// partitionedServers are the servers of a log running a raft group per
+// partition, with the partitions each one leads.
+type partitionedServers struct {
+	leaders map[string][]uint32
+}
+
+func (s *partitionedServers) GetServers() ([]*api.Server, error) {
+	var servers []*api.Server
+	for addr, partitions := range s.leaders {
+		servers = append(servers, &api.Server{
+			Id:       addr,
+			RpcAddr:  addr,
+			IsLeader: partitions[0] == 0,
+			LeaderOf: partitions,
+		})
+	}
+	return servers, nil
+}
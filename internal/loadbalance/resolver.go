@@ -2,8 +2,11 @@ package loadbalance
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"sync"
+	"time"
 
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
@@ -17,31 +20,69 @@ import (
 type Resolver struct {
 	mu            sync.Mutex
 	clientConn    resolver.ClientConn
-	resolverConn  *grpc.ClientConn
 	serviceConfig *serviceconfig.ParseResult
 	logger        *zap.Logger
+	// zone is the client's zone, given in the target's zone query
+	// parameter, e.g. proglog:///localhost:8400?zone=us-east-1a.
+	zone string
+	// seeds are the servers the target lists, comma separated, e.g.
+	// proglog:///10.0.0.1:8400,10.0.0.2:8400. Once the servers are
+	// resolved, they're asked first, and the seeds only if all of them
+	// fail.
+	seeds      []string
+	discovered []string
+
+	// connMu guards the conn the servers are resolved through, dialed
+	// to one endpoint at a time
+	connMu       sync.Mutex
+	resolverConn *grpc.ClientConn
+	endpoint     string
+	dialOpts     []grpc.DialOption
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
 }
 
+// the resolver polls the servers while it can't watch them, backing off
+// from the min to the max interval
+var (
+	minPollInterval = time.Second
+	maxPollInterval = 30 * time.Second
+	// resolveTimeout bounds the wait for each endpoint's servers
+	resolveTimeout = 5 * time.Second
+)
+
 var _ resolver.Builder = (*Resolver)(nil)
 
-func (r *Resolver) Build(
+// Build returns a resolver of its own for each conn, so conns to
+// different clusters don't resolve each other's servers.
+func (*Resolver) Build(
 	target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions,
 ) (resolver.Resolver, error) {
-	r.logger = zap.L().Named("resolver")
-	r.clientConn = cc
-	var dialOpts []grpc.DialOption
-	if opts.DialCreds != nil {
-		dialOpts = append(dialOpts, grpc.WithTransportCredentials(opts.DialCreds))
+	r := &Resolver{
+		clientConn: cc,
+		logger:     zap.L().Named("resolver"),
+		zone:       target.URL.Query().Get("zone"),
+		done:       make(chan struct{}),
 	}
-	r.serviceConfig = r.clientConn.ParseServiceConfig(
-		fmt.Sprintf(`{"loadBalancingConfig":[{"%s":{}}]}`, Name),
-	)
-	var err error
-	r.resolverConn, err = grpc.Dial(target.Endpoint, dialOpts...)
-	if err != nil {
-		return nil, err
+	for _, seed := range strings.Split(target.Endpoint, ",") {
+		if seed = strings.TrimSpace(seed); seed != "" {
+			r.seeds = append(r.seeds, seed)
+		}
 	}
+	if len(r.seeds) == 0 {
+		return nil, fmt.Errorf("no servers in target: %s", target.URL.String())
+	}
+	if opts.DialCreds != nil {
+		r.dialOpts = append(r.dialOpts, grpc.WithTransportCredentials(opts.DialCreds))
+	}
+	r.serviceConfig = r.clientConn.ParseServiceConfig(ServiceConfig())
+	// a seed that's down doesn't fail the build, the resolver reports it
+	// and goes on with the next one
 	r.ResolveNow(resolver.ResolveNowOptions{})
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	go r.watch()
 	return r, nil
 }
 
@@ -58,29 +99,166 @@ func init() {
 var _ resolver.Resolver = (*Resolver)(nil)
 
 func (r *Resolver) ResolveNow(_ resolver.ResolveNowOptions) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-
-	client := api.NewLogClient(r.resolverConn)
-	ctx := context.Background()
-	res, err := client.GetServers(ctx, &api.GetServersRequest{})
+	servers, err := r.getServers()
 	if err != nil {
 		r.logger.Error(
 			"failed to resolver server",
 			zap.Error(err),
 		)
+		r.clientConn.ReportError(err)
+		return
+	}
+
+	r.updateState(servers)
+}
+
+// getServers asks the endpoints for the servers in turn, starting with
+// the one the conn is dialed to, until one answers.
+func (r *Resolver) getServers() ([]*api.Server, error) {
+	r.connMu.Lock()
+	defer r.connMu.Unlock()
+
+	var errs []string
+	for _, endpoint := range r.endpoints() {
+		if err := r.dial(endpoint); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", endpoint, err))
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+		res, err := api.NewLogClient(r.resolverConn).GetServers(ctx, &api.GetServersRequest{})
+		cancel()
+		if err == nil {
+			return res.Servers, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", endpoint, err))
+	}
+
+	return nil, errors.New(strings.Join(errs, "; "))
+}
+
+// endpoints lists the endpoints to resolve the servers through: the
+// current one, the discovered servers, then the seeds.
+func (r *Resolver) endpoints() []string {
+	candidates := []string{r.endpoint}
+	r.mu.Lock()
+	candidates = append(candidates, r.discovered...)
+	r.mu.Unlock()
+	candidates = append(candidates, r.seeds...)
+
+	seen := make(map[string]bool, len(candidates))
+	var endpoints []string
+	for _, endpoint := range candidates {
+		if endpoint != "" && !seen[endpoint] {
+			seen[endpoint] = true
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints
+}
+
+// dial points the conn at the endpoint, unless it's there already.
+func (r *Resolver) dial(endpoint string) error {
+	if r.resolverConn != nil && r.endpoint == endpoint {
+		return nil
+	}
+	conn, err := grpc.Dial(endpoint, r.dialOpts...)
+	if err != nil {
+		return err
+	}
+	r.closeConn()
+	r.resolverConn, r.endpoint = conn, endpoint
+	return nil
+}
+
+func (r *Resolver) closeConn() {
+	if r.resolverConn == nil {
 		return
 	}
+	if err := r.resolverConn.Close(); err != nil {
+		r.logger.Error(
+			"failed to close conn",
+			zap.Error(err),
+		)
+	}
+}
+
+// watch has the server push the servers as they change, so the clients
+// follow the leader as soon as it's elected. While the watch is down,
+// e.g. the server doesn't serve it, the servers are polled instead.
+func (r *Resolver) watch() {
+	defer close(r.done)
+	interval := minPollInterval
+	for {
+		err := r.watchServers(func() {
+			interval = minPollInterval
+		})
+		if r.ctx.Err() != nil {
+			return
+		}
+		r.logger.Debug("servers watch ended", zap.Error(err))
+
+		select {
+		case <-time.After(interval):
+		case <-r.ctx.Done():
+			return
+		}
+		if interval *= 2; interval > maxPollInterval {
+			interval = maxPollInterval
+		}
+		r.ResolveNow(resolver.ResolveNowOptions{})
+	}
+}
+
+// watchServers updates the state with the servers pushed by the server,
+// calling received on each push, until the watch ends.
+func (r *Resolver) watchServers(received func()) error {
+	r.connMu.Lock()
+	conn := r.resolverConn
+	r.connMu.Unlock()
+	if conn == nil {
+		return errors.New("no server resolved")
+	}
+
+	client := api.NewLogClient(conn)
+	stream, err := client.WatchServers(r.ctx, &api.WatchServersRequest{})
+	if err != nil {
+		return err
+	}
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		received()
+		r.updateState(res.Servers)
+	}
+}
+
+func (r *Resolver) updateState(servers []*api.Server) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
 	var addrs []resolver.Address
-	for _, server := range res.Servers {
+	r.discovered = r.discovered[:0]
+	for _, server := range servers {
+		r.discovered = append(r.discovered, server.RpcAddr)
+		attrs := attributes.New(
+			"is_leader",
+			server.IsLeader,
+		).WithValue(
+			"role",
+			server.Role,
+		)
+		if len(server.LeaderOf) != 0 {
+			attrs = attrs.WithValue("leader_of", leaderOf(server.LeaderOf))
+		}
+		if r.zone != "" {
+			attrs = attrs.WithValue("local_zone", server.Zone == r.zone)
+		}
 		addrs = append(addrs,
 			resolver.Address{
-				Addr: server.RpcAddr,
-				Attributes: attributes.New(
-					"is_leader",
-					server.IsLeader,
-				),
+				Addr:       server.RpcAddr,
+				Attributes: attrs,
 			},
 		)
 	}
@@ -92,10 +270,9 @@ func (r *Resolver) ResolveNow(_ resolver.ResolveNowOptions) {
 }
 
 func (r *Resolver) Close() {
-	if err := r.resolverConn.Close(); err != nil {
-		r.logger.Error(
-			"failed to close conn",
-			zap.Error(err),
-		)
-	}
+	r.cancel()
+	<-r.done
+	r.connMu.Lock()
+	defer r.connMu.Unlock()
+	r.closeConn()
 }
@@ -1,8 +1,11 @@
 package loadbalance_test
 
 import (
+	"context"
 	"net"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
@@ -18,9 +21,109 @@ import (
 )
 
 func TestResolver(t *testing.T) {
+	servers := &getServers{leader: "localhost:9001"}
+	r, conn := setupResolverTest(t, &server.Config{GetServerer: servers})
+	defer r.Close()
+
+	wantState := resolver.State{
+		Addresses: []resolver.Address{
+			{
+				Addr: "localhost:9001",
+				Attributes: attributes.New("is_leader", true).
+					WithValue("role", api.Role_VOTER),
+			},
+			{
+				Addr: "localhost:9002",
+				Attributes: attributes.New("is_leader", false).
+					WithValue("role", api.Role_VOTER),
+			},
+		},
+	}
+
+	require.Equal(t, wantState, conn.State())
+
+	conn.UpdateState(resolver.State{})
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	require.Equal(t, wantState, conn.State())
+
+	// the server doesn't serve the watch, so the resolver polls it
+	servers.setLeader("localhost:9002")
+	require.Eventually(t, func() bool {
+		addrs := conn.State().Addresses
+		return len(addrs) == 2 && addrs[1].Attributes.Value("is_leader") == true
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestResolverWatchesServers(t *testing.T) {
+	watcher := &watchServers{servers: make(chan []*api.Server)}
+	r, conn := setupResolverTest(t, &server.Config{
+		GetServerer:   &getServers{leader: "localhost:9001"},
+		ServerWatcher: watcher,
+	})
+	defer r.Close()
+
+	// the new leader is pushed as soon as it's elected
+	watcher.servers <- []*api.Server{
+		{Id: "leader", RpcAddr: "localhost:9001"},
+		{Id: "follower", RpcAddr: "localhost:9002", IsLeader: true},
+	}
+	require.Eventually(t, func() bool {
+		addrs := conn.State().Addresses
+		return len(addrs) == 2 && addrs[1].Attributes.Value("is_leader") == true
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestResolverSeeds(t *testing.T) {
+	addrs := make([]string, 2)
+	servers := make([]*getServers, 2)
+	stops := make([]func(), 2)
+	for i := range addrs {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		addrs[i] = l.Addr().String()
+		servers[i] = &getServers{}
+		stops[i] = setupServer(t, l, &server.Config{GetServerer: servers[i]})
+	}
+	// each server sees itself as the leader, so the state tells which
+	// one was asked
+	for i := range servers {
+		servers[i].addrs = addrs
+		servers[i].leader = addrs[i]
+	}
+	dead := deadAddr(t)
+
+	// the first seed is down, the second one resolves the servers
+	r, conn := buildResolver(t, dead+","+addrs[0])
+	defer r.Close()
+	require.Equal(t, addrs[0], leaderAddr(conn.State()))
+	require.NoError(t, conn.Err())
+
+	// the first server is gone, the second one was discovered
+	stops[0]()
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	require.Equal(t, addrs[1], leaderAddr(conn.State()))
+	require.NoError(t, conn.Err())
+
+	// every server is gone
+	stops[1]()
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	require.Error(t, conn.Err())
+	require.Contains(t, conn.Err().Error(), dead)
+}
+
+func setupResolverTest(t *testing.T, serverConfig *server.Config) (
+	resolver.Resolver, *clientConn,
+) {
+	t.Helper()
 	l, err := net.Listen("tcp", "127.0.0.1:0")
 	require.NoError(t, err)
+	setupServer(t, l, serverConfig)
+
+	return buildResolver(t, l.Addr().String())
+}
 
+func setupServer(t *testing.T, l net.Listener, serverConfig *server.Config) (stop func()) {
+	t.Helper()
 	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
 		CertFile:      config.ServerCertFile,
 		KeyFile:       config.ServerKeyFile,
@@ -31,15 +134,18 @@ func TestResolver(t *testing.T) {
 	require.NoError(t, err)
 	serverCreds := credentials.NewTLS(tlsConfig)
 
-	srv, err := server.NewGRPCServer(&server.Config{
-		GetServerer: &getServers{},
-	}, grpc.Creds(serverCreds))
+	srv, err := server.NewGRPCServer(serverConfig, grpc.Creds(serverCreds))
 	require.NoError(t, err)
 
 	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+	return srv.Stop
+}
 
+func buildResolver(t *testing.T, endpoint string) (resolver.Resolver, *clientConn) {
+	t.Helper()
 	conn := &clientConn{}
-	tlsConfig, err = config.SetupTLSConfig(config.TLSConfig{
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
 		CertFile:      config.RootClientCertFile,
 		KeyFile:       config.RootClientKeyFile,
 		CAFile:        config.CAFile,
@@ -52,64 +158,118 @@ func TestResolver(t *testing.T) {
 		DialCreds: clientCreds,
 	}
 
-	r := &loadbalance.Resolver{}
-	_, err = r.Build(
-		resolver.Target{Endpoint: l.Addr().String()},
+	r, err := (&loadbalance.Resolver{}).Build(
+		resolver.Target{Endpoint: endpoint},
 		conn,
 		opts,
 	)
 	require.NoError(t, err)
 
-	wantState := resolver.State{
-		Addresses: []resolver.Address{
-			{
-				Addr:       "localhost:9001",
-				Attributes: attributes.New("is_leader", true),
-			},
-			{
-				Addr:       "localhost:9002",
-				Attributes: attributes.New("is_leader", false),
-			},
-		},
-	}
+	return r, conn
+}
 
-	require.Equal(t, wantState, conn.state)
+// deadAddr returns an address nothing listens on.
+func deadAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+	return addr
+}
 
-	conn.state.Addresses = nil
-	r.ResolveNow(resolver.ResolveNowOptions{})
-	require.Equal(t, wantState, conn.state)
+func leaderAddr(state resolver.State) string {
+	for _, addr := range state.Addresses {
+		if addr.Attributes.Value("is_leader") == true {
+			return addr.Addr
+		}
+	}
+	return ""
 }
 
-type getServers struct{}
+type getServers struct {
+	mu     sync.Mutex
+	leader string
+	addrs  []string // of the servers, if not the default ones
+}
 
 func (s *getServers) GetServers() ([]*api.Server, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.addrs != nil {
+		var servers []*api.Server
+		for _, addr := range s.addrs {
+			servers = append(servers, &api.Server{
+				Id:       addr,
+				RpcAddr:  addr,
+				IsLeader: s.leader == addr,
+			})
+		}
+		return servers, nil
+	}
 	return []*api.Server{
 		{
 			Id:       "leader",
 			RpcAddr:  "localhost:9001",
-			IsLeader: true,
+			IsLeader: s.leader == "localhost:9001",
 		},
 		{
 			Id:       "follower",
 			RpcAddr:  "localhost:9002",
-			IsLeader: false,
+			IsLeader: s.leader == "localhost:9002",
 		},
 	}, nil
 }
 
+func (s *getServers) setLeader(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.leader = addr
+}
+
+type watchServers struct {
+	servers chan []*api.Server
+}
+
+func (w *watchServers) WatchServers(ctx context.Context) (<-chan []*api.Server, error) {
+	return w.servers, nil
+}
+
 var _ resolver.ClientConn = (*clientConn)(nil)
 
 type clientConn struct {
 	resolver.ClientConn
+	mu    sync.Mutex
 	state resolver.State
+	err   error
 }
 
 func (c *clientConn) UpdateState(state resolver.State) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.state = state
+	c.err = nil
 	return nil
 }
 
-func (c *clientConn) ReportError(err error) {}
+func (c *clientConn) State() resolver.State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+func (c *clientConn) ReportError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = err
+}
+
+// Err returns the error reported last, if the state wasn't updated since.
+func (c *clientConn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
 
 func (c *clientConn) NewAddress(addrs []resolver.Address) {}
 
@@ -0,0 +1,159 @@
+package loadbalance
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// Policy tells which servers the RPCs are sent to.
+type Policy string
+
+const (
+	// Leader sends the RPCs to the leader only, e.g. the produces, as
+	// only the leader appends to the log.
+	Leader Policy = "leader"
+	// Follower sends the RPCs to the followers and replicas, and to the
+	// leader when there are none, e.g. the consumes.
+	Follower Policy = "follower"
+	// Any sends the RPCs to any server.
+	Any Policy = "any"
+)
+
+// Route routes the RPCs of a method, or of the methods with a prefix,
+// by a policy. The method is either the full name, /log.v1.Log/Consume,
+// or the bare one, Consume, matching the method of any service.
+type Route struct {
+	Method string `json:"method,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+	Policy Policy `json:"policy"`
+}
+
+// defaultRoutes route every RPC of the log, the methods not routed go
+// to any server.
+var defaultRoutes = []Route{
+	{Method: "Produce", Policy: Leader},
+	{Method: "ProduceStream", Policy: Leader},
+	{Method: "Consume", Policy: Follower},
+	{Method: "ConsumeStream", Policy: Follower},
+	{Method: "GetServers", Policy: Any},
+	{Method: "WatchServers", Policy: Any},
+	// raft changes the cluster through the leader
+	{Prefix: "/log.v1.Admin/", Policy: Leader},
+}
+
+// Config is the balancer's config, given in the service config:
+//
+//	{"loadBalancingConfig":[{"proglog":{"routes":[
+//	  {"prefix":"/log.v1.Admin/","policy":"any"}
+//	]}}]}
+//
+// The routes are added to the default ones, and override those of the
+// same method or prefix. A method routes over the prefixes, and a longer
+// prefix over a shorter one.
+type Config struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+	Routes                            []Route `json:"routes,omitempty"`
+}
+
+// ServiceConfig returns the service config balancing the RPCs with the
+// routes. The resolver sets the service config with the default routes,
+// so a client routing its own way dials with both
+// grpc.WithDefaultServiceConfig(ServiceConfig(routes...)) and
+// grpc.WithDisableServiceConfig().
+func ServiceConfig(routes ...Route) string {
+	b, _ := json.Marshal(map[string]interface{}{
+		"loadBalancingConfig": []map[string]*Config{{
+			Name: {Routes: routes},
+		}},
+	})
+	return string(b)
+}
+
+var _ balancer.ConfigParser = builder{}
+
+func (builder) ParseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	config := &Config{}
+	if err := json.Unmarshal(js, config); err != nil {
+		return nil, err
+	}
+	for _, route := range config.Routes {
+		if (route.Method == "") == (route.Prefix == "") {
+			return nil, fmt.Errorf("route needs either a method or a prefix: %+v", route)
+		}
+		switch route.Policy {
+		case Leader, Follower, Any:
+		default:
+			return nil, fmt.Errorf("unknown route policy: %q", route.Policy)
+		}
+	}
+	return config, nil
+}
+
+// routeTable looks up the policies of the methods.
+type routeTable struct {
+	methods  map[string]Policy
+	prefixes []Route // the longest first
+}
+
+var defaultRouteTable = newRouteTable(nil)
+
+func newRouteTable(routes []Route) *routeTable {
+	t := &routeTable{methods: make(map[string]Policy)}
+	prefixes := make(map[string]Policy)
+	for _, route := range append(append([]Route{}, defaultRoutes...), routes...) {
+		if route.Method != "" {
+			t.methods[route.Method] = route.Policy
+		} else {
+			prefixes[route.Prefix] = route.Policy
+		}
+	}
+	for prefix, policy := range prefixes {
+		t.prefixes = append(t.prefixes, Route{Prefix: prefix, Policy: policy})
+	}
+	sort.Slice(t.prefixes, func(i, j int) bool {
+		return len(t.prefixes[i].Prefix) > len(t.prefixes[j].Prefix)
+	})
+	return t
+}
+
+// policy returns the policy of the method, given by its full name.
+func (t *routeTable) policy(fullMethod string) Policy {
+	if t == nil {
+		t = defaultRouteTable
+	}
+	if policy, ok := t.methods[fullMethod]; ok {
+		return policy
+	}
+	if i := strings.LastIndex(fullMethod, "/"); i != -1 {
+		if policy, ok := t.methods[fullMethod[i+1:]]; ok {
+			return policy
+		}
+	}
+	for _, route := range t.prefixes {
+		if strings.HasPrefix(fullMethod, route.Prefix) {
+			return route.Policy
+		}
+	}
+	return Any
+}
+
+// routedBalancer hands the routes of the balancer's config, and the
+// resolver's addresses, over to the picker builder, ahead of the pickers
+// built with the new state.
+type routedBalancer struct {
+	balancer.Balancer
+	picker *Picker
+}
+
+func (b *routedBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	if config, ok := s.BalancerConfig.(*Config); ok {
+		b.picker.Routes = config.Routes
+	}
+	b.picker.retain(s.ResolverState)
+	return b.Balancer.UpdateClientConnState(s)
+}
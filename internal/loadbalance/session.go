@@ -0,0 +1,91 @@
+package loadbalance
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// SessionKey is the metadata key of the consumer sessions. The consumes
+// of a session keep to the same follower while it's healthy, so a
+// consumer reconnecting its stream doesn't see the log go backwards on a
+// follower lagging behind the previous one.
+const SessionKey = "proglog-session"
+
+// WithSession returns the context of the calls of the consumer session.
+func WithSession(ctx context.Context, session string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, SessionKey, session)
+}
+
+func sessionOf(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	md, _ := metadata.FromOutgoingContext(ctx)
+	if values := md.Get(SessionKey); len(values) != 0 {
+		return values[len(values)-1]
+	}
+	return ""
+}
+
+const (
+	// past maxSessions, the sessions idle for sessionTTL are forgotten
+	maxSessions = 1024
+	sessionTTL  = time.Hour
+)
+
+// sessions bind the consumer sessions to the addresses of their
+// followers. Like the stats, they outlive the pickers.
+type sessions struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+type session struct {
+	addr     string
+	lastUsed time.Time
+}
+
+func newSessions() *sessions {
+	return &sessions{sessions: make(map[string]*session)}
+}
+
+// get returns the address the session is bound to, if any.
+func (s *sessions) get(id string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[id]
+	if !ok {
+		return ""
+	}
+	session.lastUsed = time.Now()
+	return session.addr
+}
+
+func (s *sessions) bind(id, addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if _, ok := s.sessions[id]; !ok && len(s.sessions) >= maxSessions {
+		for id, session := range s.sessions {
+			if now.Sub(session.lastUsed) > sessionTTL {
+				delete(s.sessions, id)
+			}
+		}
+	}
+	s.sessions[id] = &session{addr: addr, lastUsed: now}
+}
+
+// retain forgets the sessions bound to the addresses gone from the
+// resolver's state.
+func (s *sessions) retain(addrs map[string]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, session := range s.sessions {
+		if !addrs[session.addr] {
+			delete(s.sessions, id)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package loadbalance
+
+import (
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// decay is the weight of the latest call in the averages
+	decay = 0.2
+	// a server failing maxFailures calls in a row is ejected, left out of
+	// the picks for ejectionTime
+	maxFailures  = 5
+	ejectionTime = 10 * time.Second
+)
+
+// stats track the load of a conn's servers by their addresses: the moving
+// averages of their latency and error rate, and their calls in flight.
+// They outlive the pickers, built anew on every change of the servers, and
+// the servers' reconnects, so a server ejected stays so while it's down.
+type stats struct {
+	mu    sync.Mutex
+	addrs map[string]*subConnStats
+}
+
+func newStats() *stats {
+	return &stats{addrs: make(map[string]*subConnStats)}
+}
+
+func (s *stats) get(addr string) *subConnStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats, ok := s.addrs[addr]
+	if !ok {
+		stats = &subConnStats{}
+		s.addrs[addr] = stats
+	}
+	return stats
+}
+
+// retain drops the stats of the servers gone from the resolver's state.
+func (s *stats) retain(addrs map[string]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for addr := range s.addrs {
+		if !addrs[addr] {
+			delete(s.addrs, addr)
+		}
+	}
+}
+
+type subConnStats struct {
+	mu           sync.Mutex
+	latency      float64 // in nanoseconds
+	errorRate    float64
+	inflight     int
+	failures     int // in a row
+	ejectedUntil time.Time
+}
+
+// cost estimates how long a new call would take, as the calls in flight
+// queue up ahead of it. The errors weigh in as if they took the calls
+// twice as long, to be retried.
+func (s *subConnStats) cost() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return (s.latency + 1) * float64(s.inflight+1) * (1 + s.errorRate)
+}
+
+func (s *subConnStats) ejected(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return now.Before(s.ejectedUntil)
+}
+
+// track counts a call in flight, and returns the func to call when it's
+// done. The latency of the streams, open for as long as the client
+// consumes, isn't tracked.
+func (s *subConnStats) track(stream bool) func(balancer.DoneInfo) {
+	s.mu.Lock()
+	s.inflight++
+	s.mu.Unlock()
+	start := time.Now()
+
+	return func(info balancer.DoneInfo) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.inflight--
+		if !stream {
+			latency := float64(time.Since(start))
+			if s.latency == 0 {
+				// the first call sets the average off
+				s.latency = latency
+			} else {
+				s.latency = ewma(s.latency, latency)
+			}
+		}
+		if !failed(info.Err) {
+			s.errorRate = ewma(s.errorRate, 0)
+			s.failures = 0
+			return
+		}
+		s.errorRate = ewma(s.errorRate, 1)
+		if s.failures++; s.failures >= maxFailures {
+			s.failures = 0
+			s.ejectedUntil = time.Now().Add(ejectionTime)
+		}
+	}
+}
+
+func ewma(avg, value float64) float64 {
+	return decay*value + (1-decay)*avg
+}
+
+// failed tells whether the call failed on the server's side, as opposed
+// to the calls the client got wrong or gave up on, e.g. consuming past
+// the end of the log.
+func failed(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable,
+		codes.DeadlineExceeded,
+		codes.ResourceExhausted,
+		codes.Internal,
+		codes.Unknown:
+		return true
+	}
+	return false
+}
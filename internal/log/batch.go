@@ -0,0 +1,144 @@
+package log
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hashicorp/raft"
+
+	api "github.com/fedoroko/proglog/api/v1"
+)
+
+// batcher implements group commit: appends arriving within the window
+// are applied as a single raft entry, so replication is paid once per batch.
+type batcher struct {
+	raft     *raft.Raft
+	window   time.Duration
+	maxBytes int
+	appends  chan *pendingAppend
+	closed   chan struct{}
+}
+
+// pendingAppend is an append waiting for its batch to be committed.
+type pendingAppend struct {
+	record *api.Record
+	offset uint64
+	index  uint64
+	err    error
+	done   chan struct{}
+}
+
+func newBatcher(r *raft.Raft, c Config) *batcher {
+	b := &batcher{
+		raft:     r,
+		window:   c.Batch.Window,
+		maxBytes: c.Batch.MaxBytes,
+		appends:  make(chan *pendingAppend),
+		closed:   make(chan struct{}),
+	}
+	if b.maxBytes == 0 {
+		b.maxBytes = 1 << 20
+	}
+
+	go b.run()
+	return b
+}
+
+// append enqueues the record and blocks until its batch is applied.
+// Returns the record's offset and the raft index of the batch.
+func (b *batcher) append(record *api.Record) (uint64, uint64, error) {
+	p := &pendingAppend{
+		record: record,
+		done:   make(chan struct{}),
+	}
+	select {
+	case b.appends <- p:
+	case <-b.closed:
+		return 0, 0, raft.ErrRaftShutdown
+	}
+
+	<-p.done
+	return p.offset, p.index, p.err
+}
+
+func (b *batcher) run() {
+	for {
+		var batch []*pendingAppend
+		select {
+		case p := <-b.appends:
+			batch = append(batch, p)
+		case <-b.closed:
+			return
+		}
+
+		size := proto.Size(batch[0].record)
+		timer := time.NewTimer(b.window)
+	collect:
+		for size < b.maxBytes {
+			select {
+			case p := <-b.appends:
+				batch = append(batch, p)
+				size += proto.Size(p.record)
+			case <-timer.C:
+				break collect
+			case <-b.closed:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		b.apply(batch)
+	}
+}
+
+// apply hands the batch over to raft and responds to its appends
+// asynchronously, so the next batch is collected while this one replicates.
+func (b *batcher) apply(batch []*pendingAppend) {
+	req := &api.ProduceBatchRequest{}
+	for _, p := range batch {
+		req.Records = append(req.Records, p.record)
+	}
+	data, err := encodeRequest(BatchAppendRequestType, req)
+	if err != nil {
+		respond(batch, err)
+		return
+	}
+
+	timeout := 10 * time.Second
+	future := b.raft.Apply(data, timeout)
+	go func() {
+		if err := future.Error(); err != nil {
+			respond(batch, err)
+			return
+		}
+
+		switch res := future.Response().(type) {
+		case error:
+			respond(batch, res)
+		case *api.ProduceBatchResponse:
+			if len(res.Offsets) != len(batch) {
+				respond(batch, fmt.Errorf("applied %d of %d records", len(res.Offsets), len(batch)))
+				return
+			}
+			for i, p := range batch {
+				p.offset = res.Offsets[i]
+				p.index = future.Index()
+				close(p.done)
+			}
+		default:
+			respond(batch, fmt.Errorf("unexpected batch response: %T", res))
+		}
+	}()
+}
+
+func respond(batch []*pendingAppend, err error) {
+	for _, p := range batch {
+		p.err = err
+		close(p.done)
+	}
+}
+
+func (b *batcher) close() {
+	close(b.closed)
+}
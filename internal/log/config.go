@@ -1,16 +1,38 @@
 package log
 
-import "github.com/hashicorp/raft"
+import (
+	"time"
+
+	"github.com/hashicorp/raft"
+)
 
 type Config struct {
 	Raft struct {
 		raft.Config
-		StreamLayer *StreamLayer
-		Bootstrap   bool
+		StreamLayer    *StreamLayer
+		Bootstrap      bool
+		SessionTimeout time.Duration
+		SnapshotRetain int
+		// VerifyPeers rejects the peers whose TLS certificates don't name,
+		// in the common name or a DNS SAN, the raft server they connect as.
+		VerifyPeers bool
 	}
 	Segment struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
 	}
+	// Batch coalesces concurrent appends into a single raft entry.
+	// Appends are applied one by one if Window is zero.
+	Batch struct {
+		Window   time.Duration
+		MaxBytes int
+	}
+	// Partitions configures a PartitionedLog: the number of partitions,
+	// each run by its own raft group, and how often the leaders are
+	// balanced across the servers.
+	Partitions struct {
+		Count           int
+		BalanceInterval time.Duration
+	}
 }
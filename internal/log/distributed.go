@@ -2,25 +2,37 @@ package log
 
 import (
 	"bytes"
-	"crypto/tls"
+	"context"
 	"fmt"
-	"io"
-	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/hashicorp/raft"
 	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
 
 	api "github.com/fedoroko/proglog/api/v1"
 )
 
 type DistributedLog struct {
-	config Config
-	log    *Log
-	raft   *raft.Raft
+	config      Config
+	log         *Log
+	fsm         *FSM
+	raft        *raft.Raft
+	logStore    *logStore
+	stableStore *raftboltdb.BoltStore
+	hasState    bool
+	batcher     *batcher
+
+	watchers     serverWatchers
+	observer     *raft.Observer
+	observations chan raft.Observation
+	stopObserver sync.Once
 }
 
 func NewDistributedLog(dataDir string, config Config) (*DistributedLog, error) {
@@ -33,6 +45,9 @@ func NewDistributedLog(dataDir string, config Config) (*DistributedLog, error) {
 	if err := l.setupRaft(dataDir); err != nil {
 		return nil, err
 	}
+	if config.Batch.Window != 0 {
+		l.batcher = newBatcher(l.raft, config)
+	}
 
 	return l, nil
 }
@@ -48,7 +63,8 @@ func (l *DistributedLog) setupLog(dataDir string) error {
 }
 
 func (l *DistributedLog) setupRaft(dataDir string) error {
-	fsm := &FSM{log: l.log}
+	l.fsm = newFSM(l.log)
+	l.fsm.onConfiguration = l.watchers.notify
 	logDir := filepath.Join(dataDir, "raft", "log")
 	if err := os.MkdirAll(logDir, 0755); err != nil {
 		return err
@@ -56,31 +72,46 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 
 	logConfig := l.config
 	logConfig.Segment.InitialOffset = 1
-	logStore, err := newLogStore(logDir, logConfig)
+	var err error
+	l.logStore, err = newLogStore(logDir, logConfig)
 	if err != nil {
 		return err
 	}
 
-	stableStore, err := raftboltdb.NewBoltStore(
+	l.stableStore, err = raftboltdb.NewBoltStore(
 		filepath.Join(dataDir, "raft", "stable"),
 	)
 	if err != nil {
 		return err
 	}
 	retain := 1
-	snapshotStore, err := raft.NewFileSnapshotStore(
-		filepath.Join(dataDir, "raft"),
-		retain,
-		os.Stderr,
-	)
+	if l.config.Raft.SnapshotRetain != 0 {
+		retain = l.config.Raft.SnapshotRetain
+	}
+	snapshotStore, err := newSnapshotStore(filepath.Join(dataDir, "raft"), retain)
 	if err != nil {
 		return err
 	}
+	l.fsm.segmentCache = snapshotStore.cache
+
+	streamLayer := l.config.Raft.StreamLayer
+	streamLayer.setLocalID(l.config.Raft.LocalID)
+	if l.config.Raft.VerifyPeers {
+		if err = streamLayer.verifyPeers(); err != nil {
+			return err
+		}
+		if err = verifyCertificate(streamLayer.serverTLSConfig, l.config.Raft.LocalID); err != nil {
+			return err
+		}
+		if err = verifyCertificate(streamLayer.peerTLSConfig, l.config.Raft.LocalID); err != nil {
+			return err
+		}
+	}
 
 	maxPool := 5
 	timeout := 10 * time.Second
 	transport := raft.NewNetworkTransport(
-		l.config.Raft.StreamLayer,
+		streamLayer,
 		maxPool,
 		timeout,
 		os.Stderr,
@@ -100,29 +131,53 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 	if l.config.Raft.CommitTimeout != 0 {
 		config.CommitTimeout = l.config.Raft.CommitTimeout
 	}
+	if l.config.Raft.SnapshotInterval != 0 {
+		config.SnapshotInterval = l.config.Raft.SnapshotInterval
+	}
+	if l.config.Raft.SnapshotThreshold != 0 {
+		config.SnapshotThreshold = l.config.Raft.SnapshotThreshold
+	}
+	if l.config.Raft.TrailingLogs != 0 {
+		config.TrailingLogs = l.config.Raft.TrailingLogs
+	}
+	// the FSM restores the snapshot on start only if its log is behind,
+	// rather than raft rewriting the whole log on every start
+	config.NoSnapshotRestoreOnStart = true
+
+	// a node with existing state rejoins the configuration it has persisted,
+	// so the cluster is bootstrapped only once, on a fresh data dir.
+	l.hasState, err = raft.HasExistingState(
+		l.logStore,
+		l.stableStore,
+		snapshotStore,
+	)
+	if err != nil {
+		return err
+	}
+	if err = l.recoverCluster(dataDir, config, snapshotStore, transport); err != nil {
+		return err
+	}
+	if err = l.fsm.restoreLatest(snapshotStore); err != nil {
+		return err
+	}
 
 	l.raft, err = raft.NewRaft(
 		config,
-		fsm,
-		logStore,
-		stableStore,
+		l.fsm,
+		l.logStore,
+		l.stableStore,
 		snapshotStore,
 		transport,
 	)
 	if err != nil {
 		return err
 	}
+	streamLayer.setServers(func() []raft.Server {
+		return l.raft.GetConfiguration().Configuration().Servers
+	})
+	l.observe()
 
-	//hasState, err := raft.HasExistingState(
-	//	logStore,
-	//	stableStore,
-	//	snapshotStore,
-	//)
-	//if err != nil {
-	//	return err
-	//}
-	//if l.config.Raft.Bootstrap && !hasState {
-	if l.config.Raft.Bootstrap {
+	if l.config.Raft.Bootstrap && !l.hasState {
 		cfg := raft.Configuration{
 			Servers: []raft.Server{{
 				ID:      config.LocalID,
@@ -136,17 +191,53 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 }
 
 func (l *DistributedLog) Append(record *api.Record) (uint64, error) {
-	res, err := l.apply(
+	off, _, err := l.AppendSession(record)
+	return off, err
+}
+
+// AppendSession appends the record and returns its offset along with
+// a session token, that encodes the raft index of the write.
+func (l *DistributedLog) AppendSession(record *api.Record) (uint64, []byte, error) {
+	if l.batcher != nil {
+		off, index, err := l.batcher.append(record)
+		if err != nil {
+			return 0, nil, err
+		}
+		return off, encodeSessionToken(index), nil
+	}
+
+	res, index, err := l.apply(
 		AppendRequestType,
 		&api.ProduceRequest{Record: record},
 	)
 	if err != nil {
-		return 0, err
+		return 0, nil, err
 	}
-	return res.(*api.ProduceResponse).Offset, nil
+	return res.(*api.ProduceResponse).Offset, encodeSessionToken(index), nil
 }
 
-func (l *DistributedLog) apply(reqType RequestType, req proto.Message) (interface{}, error) {
+func (l *DistributedLog) apply(reqType RequestType, req proto.Message) (interface{}, uint64, error) {
+	b, err := encodeRequest(reqType, req)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	timeout := 10 * time.Second
+	future := l.raft.Apply(b, timeout)
+	if future.Error() != nil {
+		return nil, 0, future.Error()
+	}
+
+	res := future.Response()
+	if err, ok := res.(error); ok {
+		return nil, 0, err
+	}
+
+	return res, future.Index(), nil
+}
+
+// encodeRequest prefixes the marshaled request with its type byte.
+func encodeRequest(reqType RequestType, req proto.Message) ([]byte, error) {
 	var buf bytes.Buffer
 	_, err := buf.Write([]byte{byte(reqType)})
 	if err != nil {
@@ -163,37 +254,81 @@ func (l *DistributedLog) apply(reqType RequestType, req proto.Message) (interfac
 		return nil, err
 	}
 
-	timeout := 10 * time.Second
-	future := l.raft.Apply(buf.Bytes(), timeout)
-	if future.Error() != nil {
-		return nil, future.Error()
+	return buf.Bytes(), nil
+}
+
+func (l *DistributedLog) Read(offset uint64) (*api.Record, error) {
+	return l.log.Read(offset)
+}
+
+// WaitForSession blocks until the local FSM has applied the write
+// the token was issued for, or until the session timeout expires. It
+// returns the caller's Canceled or DeadlineExceeded status if the
+// caller's context ends first.
+func (l *DistributedLog) WaitForSession(ctx context.Context, token []byte) error {
+	index, err := decodeSessionToken(token)
+	if err != nil {
+		return err
 	}
 
-	res := future.Response()
-	if err, ok := res.(error); ok {
-		return nil, err
+	timeout := l.config.Raft.SessionTimeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
 	}
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
-	return res, nil
+	if err = l.fsm.waitForIndex(waitCtx, index); err != nil {
+		if ctx.Err() != nil {
+			return status.FromContextError(ctx.Err()).Err()
+		}
+		return api.ErrSessionTimeout{Index: index}
+	}
+
+	return nil
 }
 
-func (l *DistributedLog) Read(offset uint64) (*api.Record, error) {
-	return l.log.Read(offset)
+const sessionTokenWidth = 8
+
+func encodeSessionToken(index uint64) []byte {
+	b := make([]byte, sessionTokenWidth)
+	enc.PutUint64(b, index)
+	return b
 }
 
-func (l *DistributedLog) Join(id, addr string) error {
+func decodeSessionToken(token []byte) (uint64, error) {
+	if len(token) != sessionTokenWidth {
+		return 0, api.ErrInvalidSessionToken{}
+	}
+
+	return enc.Uint64(token), nil
+}
+
+// Join adds the server to the cluster. Voters take part in elections and
+// commit quorum, non-voters only replicate the log and serve reads.
+func (l *DistributedLog) Join(id, addr string, voter bool) error {
 	configFuture := l.raft.GetConfiguration()
 	if err := configFuture.Error(); err != nil {
 		return err
 	}
 	serverID := raft.ServerID(id)
 	serverAddr := raft.ServerAddress(addr)
+	suffrage := raft.Nonvoter
+	if voter {
+		suffrage = raft.Voter
+	}
 	for _, srv := range configFuture.Configuration().Servers {
-		if srv.ID == serverID || srv.Address == serverAddr {
-			if srv.ID == serverID && srv.Address == serverAddr {
+		if srv.ID == serverID && srv.Address == serverAddr {
+			if srv.Suffrage == suffrage {
 				return nil
 			}
-
+			if !voter {
+				return l.raft.DemoteVoter(serverID, 0, 0).Error()
+			}
+			// adding a non-voter as a voter promotes it in place
+			break
+		}
+		if srv.ID == serverID || srv.Address == serverAddr {
 			removeFuture := l.raft.RemoveServer(serverID, 0, 0)
 			if err := removeFuture.Error(); err != nil {
 				return err
@@ -201,7 +336,12 @@ func (l *DistributedLog) Join(id, addr string) error {
 		}
 	}
 
-	addFuture := l.raft.AddVoter(serverID, serverAddr, 0, 0)
+	var addFuture raft.IndexFuture
+	if voter {
+		addFuture = l.raft.AddVoter(serverID, serverAddr, 0, 0)
+	} else {
+		addFuture = l.raft.AddNonvoter(serverID, serverAddr, 0, 0)
+	}
 	if err := addFuture.Error(); err != nil {
 		return err
 	}
@@ -231,11 +371,31 @@ func (l *DistributedLog) WaitForLeader(timeout time.Duration) error {
 	}
 }
 
+// HasExistingState reports whether the node was started over
+// the raft state of a previous run.
+func (l *DistributedLog) HasExistingState() bool {
+	return l.hasState
+}
+
+func (l *DistributedLog) IsLeader() bool {
+	return l.raft.State() == raft.Leader
+}
+
 func (l *DistributedLog) Close() error {
+	if l.batcher != nil {
+		l.batcher.close()
+	}
+	l.stopObserving()
 	f := l.raft.Shutdown()
 	if err := f.Error(); err != nil {
 		return err
 	}
+	if err := l.stableStore.Close(); err != nil {
+		return err
+	}
+	if err := l.logStore.Close(); err != nil {
+		return err
+	}
 
 	return l.log.Close()
 }
@@ -249,231 +409,234 @@ func (l *DistributedLog) GetServers() ([]*api.Server, error) {
 	var servers []*api.Server
 	_, leaderID := l.raft.LeaderWithID()
 	for _, server := range future.Configuration().Servers {
+		role := api.Role_VOTER
+		if server.Suffrage == raft.Nonvoter {
+			role = api.Role_NONVOTER
+		}
 		servers = append(servers, &api.Server{
 			Id:       string(server.ID),
 			RpcAddr:  string(server.Address),
 			IsLeader: leaderID == server.ID,
+			Role:     role,
 		})
 	}
 
 	return servers, nil
 }
 
-var _ raft.FSM = (*FSM)(nil)
-
-type FSM struct {
-	log *Log
-}
-
-type RequestType uint8
-
-const (
-	AppendRequestType RequestType = 0
-)
-
-func (l *FSM) Apply(record *raft.Log) interface{} {
-	buf := record.Data
-	reqType := RequestType(buf[0])
-	switch reqType {
-	case AppendRequestType:
-		return l.applyAppend(buf[1:])
+// TransferLeadership hands the leadership over to the server with the id,
+// or to the most up to date server if the id is empty.
+func (l *DistributedLog) TransferLeadership(id string) error {
+	if id == "" {
+		return l.raft.LeadershipTransfer().Error()
 	}
 
-	return nil
-}
-
-func (l *FSM) applyAppend(b []byte) interface{} {
-	var req api.ProduceRequest
-	err := proto.Unmarshal(b, &req)
-	if err != nil {
+	future := l.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
 		return err
 	}
-
-	offset, err := l.log.Append(req.Record)
-	if err != nil {
-		return err
+	for _, server := range future.Configuration().Servers {
+		if server.ID == raft.ServerID(id) {
+			return l.raft.LeadershipTransferToServer(server.ID, server.Address).Error()
+		}
 	}
 
-	return &api.ProduceResponse{Offset: offset}
+	return fmt.Errorf("unknown server: %s", id)
 }
 
-func (l *FSM) Snapshot() (raft.FSMSnapshot, error) {
-	r := l.log.Reader()
-	return &snapshot{reader: r}, nil
+// Barrier blocks until the FSM has applied every entry committed before
+// the call, so the leader's reads are up to date. Only the leader can
+// issue it.
+func (l *DistributedLog) Barrier() error {
+	return l.raft.Barrier(10 * time.Second).Error()
 }
 
-var _ raft.FSMSnapshot = (*snapshot)(nil)
-
-type snapshot struct {
-	reader io.Reader
-}
+func (l *DistributedLog) RaftStats() (*api.RaftStats, error) {
+	stats := l.raft.Stats()
+	res := &api.RaftStats{
+		Id:           string(l.config.Raft.LocalID),
+		State:        stats["state"],
+		LastLogIndex: l.raft.LastIndex(),
+		AppliedIndex: l.raft.AppliedIndex(),
+		LastContact:  durationpb.New(0),
+	}
 
-func (s *snapshot) Persist(sink raft.SnapshotSink) error {
-	if _, err := io.Copy(sink, s.reader); err != nil {
-		_ = sink.Cancel()
-		return err
+	var err error
+	if res.Term, err = strconv.ParseUint(stats["term"], 10, 64); err != nil {
+		return nil, err
+	}
+	if res.CommitIndex, err = strconv.ParseUint(stats["commit_index"], 10, 64); err != nil {
+		return nil, err
+	}
+	if last := l.raft.LastContact(); !last.IsZero() && l.raft.State() != raft.Leader {
+		res.LastContact = durationpb.New(time.Since(last))
 	}
 
-	return sink.Close()
+	return res, nil
 }
 
-func (s *snapshot) Release() {}
-
-func (l *FSM) Restore(r io.ReadCloser) error {
-	b := make([]byte, lenWidth)
-	var buf bytes.Buffer
-	for i := 0; ; i++ {
-		_, err := io.ReadFull(r, b)
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return err
-		}
-
-		size := int64(enc.Uint64(b))
-		if _, err = io.CopyN(&buf, r, size); err != nil {
-			return err
-		}
+var _ raft.FSM = (*FSM)(nil)
 
-		record := &api.Record{}
-		if err = proto.Unmarshal(buf.Bytes(), record); err != nil {
-			return err
-		}
-		if i == 0 {
-			l.log.Config.Segment.InitialOffset = record.Offset
-			if err = l.log.Reset(); err != nil {
-				return err
-			}
-		}
-		if _, err = l.log.Append(record); err != nil {
-			return err
-		}
+type FSM struct {
+	log *Log
 
-		buf.Reset()
-	}
-	return nil
+	mu        sync.Mutex
+	index     uint64        // last applied raft index
+	appliedCh chan struct{} // closed and replaced on every apply
+	// onConfiguration is called as configurations are committed
+	onConfiguration func()
+	// segmentCache keeps the sealed segments the snapshots reference
+	segmentCache *segmentCache
 }
 
-var _ raft.LogStore = (*logStore)(nil)
-
-type logStore struct {
-	*Log
+func newFSM(log *Log) *FSM {
+	return &FSM{
+		log:       log,
+		index:     lastAppliedIndex(log),
+		appliedCh: make(chan struct{}),
+	}
 }
 
-func newLogStore(dir string, c Config) (*logStore, error) {
-	log, err := NewLog(dir, c)
+// lastAppliedIndex returns the raft index of the last record in the log.
+// Every record keeps the index of the entry it was applied from, so it's
+// persisted atomically with the record itself.
+func lastAppliedIndex(log *Log) uint64 {
+	off, err := log.HighestOffset()
 	if err != nil {
-		return nil, err
+		return 0
+	}
+	record, err := log.Read(off)
+	if err != nil {
+		return 0
 	}
 
-	return &logStore{log}, err
+	return record.RaftIndex
 }
 
-func (l *logStore) FirstIndex() (uint64, error) {
-	return l.LowestOffset()
-}
+type RequestType uint8
 
-func (l *logStore) LastIndex() (uint64, error) {
-	return l.HighestOffset()
-}
+const (
+	AppendRequestType      RequestType = 0
+	BatchAppendRequestType RequestType = 1
+)
 
-func (l *logStore) GetLog(index uint64, out *raft.Log) error {
-	in, err := l.Read(index)
-	if err != nil {
-		return err
+func (l *FSM) Apply(record *raft.Log) interface{} {
+	l.mu.Lock()
+	applied := l.index
+	l.mu.Unlock()
+	buf := record.Data
+	reqType := RequestType(buf[0])
+	if record.Index < applied ||
+		record.Index == applied && reqType != BatchAppendRequestType {
+		return nil // entry replayed after restart, already in the log
 	}
-	out.Data = in.Value
-	out.Index = in.Offset
-	out.Type = raft.LogType(in.Type)
-	out.Term = in.Term
-	return nil
-}
-
-func (l *logStore) StoreLog(record *raft.Log) error {
-	return l.StoreLogs([]*raft.Log{record})
-}
 
-func (l *logStore) StoreLogs(records []*raft.Log) error {
-	for _, record := range records {
-		if _, err := l.Append(&api.Record{
-			Value: record.Data,
-			Term:  record.Term,
-			Type:  uint32(record.Type),
-		}); err != nil {
-			return err
-		}
+	var res interface{}
+	switch reqType {
+	case AppendRequestType:
+		res = l.applyAppend(buf[1:], record.Index)
+	case BatchAppendRequestType:
+		res = l.applyBatchAppend(buf[1:], record.Index, record.Index == applied)
 	}
 
-	return nil
+	l.setApplied(record.Index)
+	return res
 }
 
-func (l *logStore) DeleteRange(min, max uint64) error {
-	return l.Truncate(max)
+func (l *FSM) setApplied(index uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.index = index
+	close(l.appliedCh)
+	l.appliedCh = make(chan struct{})
 }
 
-var _ raft.StreamLayer = (*StreamLayer)(nil)
-
-type StreamLayer struct {
-	ln              net.Listener
-	serverTLSConfig *tls.Config
-	peerTLSConfig   *tls.Config
-}
+func (l *FSM) waitForIndex(ctx context.Context, index uint64) error {
+	for {
+		l.mu.Lock()
+		applied, ch := l.index, l.appliedCh
+		l.mu.Unlock()
+		if applied >= index {
+			return nil
+		}
 
-func NewStreamLayer(ln net.Listener, serverTLSConfig, peerTLSConfig *tls.Config) *StreamLayer {
-	return &StreamLayer{
-		ln:              ln,
-		serverTLSConfig: serverTLSConfig,
-		peerTLSConfig:   peerTLSConfig,
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ch:
+		}
 	}
 }
 
-const RaftRPC = 1
-
-func (s *StreamLayer) Dial(addr raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
-	dialer := &net.Dialer{Timeout: timeout}
-	var conn, err = dialer.Dial("tcp", string(addr))
-	if err != nil {
-		return nil, err
-	}
-	_, err = conn.Write([]byte{byte(RaftRPC)})
+func (l *FSM) applyAppend(b []byte, index uint64) interface{} {
+	var req api.ProduceRequest
+	err := proto.Unmarshal(b, &req)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if s.peerTLSConfig != nil {
-		conn = tls.Client(conn, s.peerTLSConfig)
+	req.Record.RaftIndex = index
+	offset, err := l.log.Append(req.Record)
+	if err != nil {
+		return err
 	}
 
-	return conn, nil
+	return &api.ProduceResponse{Offset: offset}
 }
 
-func (s *StreamLayer) Accept() (net.Conn, error) {
-	conn, err := s.ln.Accept()
-	if err != nil {
-		return nil, err
-	}
-
-	b := make([]byte, 1)
-	_, err = conn.Read(b)
+// applyBatchAppend appends every record of the batch. A batch replayed after
+// a crash in the middle of it resumes right after its last persisted record.
+func (l *FSM) applyBatchAppend(b []byte, index uint64, replayed bool) interface{} {
+	var req api.ProduceBatchRequest
+	err := proto.Unmarshal(b, &req)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if bytes.Compare([]byte{byte(RaftRPC)}, b) != 0 {
-		return nil, fmt.Errorf("not a raft rpc")
+	records := req.Records
+	if replayed {
+		skip := appendedFrom(l.log, index)
+		if skip >= len(records) {
+			return nil
+		}
+		records = records[skip:]
 	}
 
-	if s.serverTLSConfig != nil {
-		return tls.Server(conn, s.serverTLSConfig), nil
+	res := &api.ProduceBatchResponse{}
+	for _, record := range records {
+		record.RaftIndex = index
+		offset, err := l.log.Append(record)
+		if err != nil {
+			return err
+		}
+		res.Offsets = append(res.Offsets, offset)
 	}
 
-	return conn, nil
+	return res
 }
 
-func (s *StreamLayer) Close() error {
-	return s.ln.Close()
-}
+// appendedFrom counts the trailing records of the log applied from the index.
+func appendedFrom(log *Log, index uint64) int {
+	lowest, err := log.LowestOffset()
+	if err != nil {
+		return 0
+	}
+	off, err := log.HighestOffset()
+	if err != nil {
+		return 0
+	}
+
+	var n int
+	for ; off >= lowest; off-- {
+		record, err := log.Read(off)
+		if err != nil || record.RaftIndex != index {
+			break
+		}
+		n++
+		if off == 0 {
+			break
+		}
+	}
 
-func (s *StreamLayer) Addr() net.Addr {
-	return s.ln.Addr()
+	return n
 }
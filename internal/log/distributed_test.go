@@ -1,17 +1,30 @@
 package log_test
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/big"
 	"net"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/hashicorp/raft"
 	"github.com/stretchr/testify/require"
 	"github.com/travisjeffery/go-dynaport"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	api "github.com/fedoroko/proglog/api/v1"
 	"github.com/fedoroko/proglog/internal/log"
@@ -50,7 +63,7 @@ func TestMultipleNodes(t *testing.T) {
 		require.NoError(t, err)
 
 		if i != 0 {
-			err = logs[0].Join(fmt.Sprintf("%d", i), ln.Addr().String())
+			err = logs[0].Join(fmt.Sprintf("%d", i), ln.Addr().String(), true)
 			require.NoError(t, err)
 		} else {
 			err = l.WaitForLeader(3 * time.Second)
@@ -117,3 +130,576 @@ func TestMultipleNodes(t *testing.T) {
 	require.Equal(t, []byte("hello again"), record.Value)
 	require.Equal(t, off, record.Offset)
 }
+
+func TestReadYourWrites(t *testing.T) {
+	logs := setupCluster(t, 2, 0, func(c *log.Config) {
+		c.Raft.SessionTimeout = 200 * time.Millisecond
+	})
+
+	off, token, err := logs[0].AppendSession(&api.Record{Value: []byte("hello")})
+	require.NoError(t, err)
+	require.NotEmpty(t, token)
+
+	err = logs[1].WaitForSession(context.Background(), token)
+	require.NoError(t, err)
+
+	record, err := logs[1].Read(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello"), record.Value)
+
+	err = logs[1].WaitForSession(context.Background(), []byte("bad"))
+	require.IsType(t, api.ErrInvalidSessionToken{}, err)
+
+	future := make([]byte, 8)
+	future[0] = 1
+	err = logs[1].WaitForSession(context.Background(), future)
+	require.IsType(t, api.ErrSessionTimeout{}, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = logs[1].WaitForSession(ctx, future)
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	err = logs[1].WaitForSession(ctx, future)
+	require.Equal(t, codes.Canceled, status.Code(err))
+}
+
+func TestNonvoters(t *testing.T) {
+	logs := setupCluster(t, 2, 1)
+
+	servers, err := logs[0].GetServers()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(servers))
+	require.Equal(t, api.Role_VOTER, servers[0].Role)
+	require.Equal(t, api.Role_VOTER, servers[1].Role)
+	require.Equal(t, api.Role_NONVOTER, servers[2].Role)
+
+	off, err := logs[0].Append(&api.Record{Value: []byte("hello")})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		got, err := logs[2].Read(off)
+		return err == nil && reflect.DeepEqual([]byte("hello"), got.Value)
+	}, 2*time.Second, 50*time.Millisecond)
+
+	err = logs[0].Join("2", servers[2].RpcAddr, true)
+	require.NoError(t, err)
+	servers, err = logs[0].GetServers()
+	require.NoError(t, err)
+	require.Equal(t, api.Role_VOTER, servers[2].Role)
+
+	err = logs[0].Join("2", servers[2].RpcAddr, false)
+	require.NoError(t, err)
+	servers, err = logs[0].GetServers()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(servers))
+	require.Equal(t, api.Role_NONVOTER, servers[2].Role)
+}
+
+func TestRestartAppliesOnce(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "distributed-log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+	port := dynaport.Get(1)[0]
+
+	l := newTestLog(t, 0, port, dataDir, true)
+	require.NoError(t, l.WaitForLeader(3*time.Second))
+	for i := 0; i < 3; i++ {
+		off, err := l.Append(&api.Record{Value: []byte("hello")})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+	require.NoError(t, l.Close())
+
+	l = newTestLog(t, 0, port, dataDir, true)
+	defer l.Close()
+	require.NoError(t, l.WaitForLeader(3*time.Second))
+
+	off, err := l.Append(&api.Record{Value: []byte("hello again")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+
+	record, err := l.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello again"), record.Value)
+}
+
+func TestBatchAppend(t *testing.T) {
+	logs := setupCluster(t, 2, 0, withBatching)
+
+	type appended struct {
+		i   int
+		off uint64
+		err error
+	}
+	count := 50
+	results := make(chan appended, count)
+	for i := 0; i < count; i++ {
+		go func(i int) {
+			off, err := logs[0].Append(&api.Record{
+				Value: []byte(fmt.Sprintf("%d", i)),
+			})
+			results <- appended{i: i, off: off, err: err}
+		}(i)
+	}
+
+	offsets := make([]uint64, count)
+	for j := 0; j < count; j++ {
+		res := <-results
+		require.NoError(t, res.err)
+		offsets[res.i] = res.off
+	}
+
+	seen := make(map[uint64]bool)
+	for i, off := range offsets {
+		require.False(t, seen[off])
+		seen[off] = true
+		require.Eventually(t, func() bool {
+			record, err := logs[1].Read(off)
+			return err == nil &&
+				reflect.DeepEqual([]byte(fmt.Sprintf("%d", i)), record.Value)
+		}, 2*time.Second, 50*time.Millisecond)
+	}
+}
+
+func TestSnapshotInstall(t *testing.T) {
+	compact := func(c *log.Config) {
+		c.Raft.SnapshotInterval = 50 * time.Millisecond
+		c.Raft.SnapshotThreshold = 8
+		c.Raft.TrailingLogs = 2
+	}
+	logs := setupCluster(t, 1, 0, compact)
+
+	for i := 0; i < 50; i++ {
+		_, err := logs[0].Append(&api.Record{Value: []byte(fmt.Sprintf("%d", i))})
+		require.NoError(t, err)
+	}
+	// wait for the leader to compact its raft log past the first entries
+	time.Sleep(500 * time.Millisecond)
+
+	dataDir, err := ioutil.TempDir("", "distributed-log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+	port := dynaport.Get(1)[0]
+	follower := newTestLog(t, 1, port, dataDir, false, compact)
+	defer follower.Close()
+	err = logs[0].Join("1", fmt.Sprintf("127.0.0.1:%d", port), true)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		for i := 0; i < 50; i++ {
+			record, err := follower.Read(uint64(i))
+			if err != nil || !reflect.DeepEqual([]byte(fmt.Sprintf("%d", i)), record.Value) {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 100*time.Millisecond)
+
+	off, err := logs[0].Append(&api.Record{Value: []byte("after install")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(50), off)
+	require.Eventually(t, func() bool {
+		record, err := follower.Read(off)
+		return err == nil && reflect.DeepEqual([]byte("after install"), record.Value)
+	}, 2*time.Second, 50*time.Millisecond)
+}
+
+func TestTransferLeadership(t *testing.T) {
+	logs := setupCluster(t, 3, 0)
+
+	stats, err := logs[0].RaftStats()
+	require.NoError(t, err)
+	require.Equal(t, "Leader", stats.State)
+	require.Equal(t, stats.CommitIndex, stats.AppliedIndex)
+
+	// the target has to catch up with the leader to win the election
+	require.Eventually(t, func() bool {
+		target, err := logs[2].RaftStats()
+		return err == nil && target.AppliedIndex == stats.AppliedIndex
+	}, 3*time.Second, 50*time.Millisecond)
+
+	require.NoError(t, logs[0].TransferLeadership("2"))
+	require.Eventually(t, func() bool {
+		servers, err := logs[2].GetServers()
+		return err == nil && len(servers) == 3 && servers[2].IsLeader
+	}, 3*time.Second, 50*time.Millisecond)
+
+	stats, err = logs[0].RaftStats()
+	require.NoError(t, err)
+	require.Equal(t, "Follower", stats.State)
+	require.True(t, stats.Term > 1)
+
+	require.Error(t, logs[2].TransferLeadership("unknown"))
+}
+
+func TestWatchServers(t *testing.T) {
+	logs := setupCluster(t, 2, 0)
+	// a follower learns of the configuration changes too
+	changes, stop := logs[1].WatchServers()
+	defer stop()
+
+	require.Eventually(t, func() bool {
+		servers, err := logs[1].GetServers()
+		return err == nil && len(servers) == 2
+	}, 3*time.Second, 50*time.Millisecond)
+
+	ports := dynaport.Get(1)
+	dataDir, err := ioutil.TempDir("", "distributed-log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+	l := newTestLog(t, 2, ports[0], dataDir, false)
+	defer l.Close()
+	require.NoError(t, logs[0].Join("2", fmt.Sprintf("127.0.0.1:%d", ports[0]), true))
+	waitForServers(t, changes, logs[1], func(servers []*api.Server) bool {
+		return len(servers) == 3
+	})
+
+	require.Eventually(t, func() bool {
+		target, err := l.RaftStats()
+		return err == nil && target.AppliedIndex > 0
+	}, 3*time.Second, 50*time.Millisecond)
+	require.NoError(t, logs[0].TransferLeadership("1"))
+	waitForServers(t, changes, logs[1], func(servers []*api.Server) bool {
+		return servers[1].IsLeader
+	})
+
+	// closing the log ends the watch
+	require.NoError(t, logs[1].Close())
+	for range changes {
+	}
+}
+
+// waitForServers waits for a signal of the servers getting to the state
+// the func checks for.
+func waitForServers(
+	t *testing.T, changes <-chan struct{}, l *log.DistributedLog, ok func([]*api.Server) bool,
+) {
+	t.Helper()
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case <-changes:
+			servers, err := l.GetServers()
+			require.NoError(t, err)
+			if ok(servers) {
+				return
+			}
+		case <-timeout:
+			t.Fatal("servers didn't change")
+		}
+	}
+}
+
+func BenchmarkAppend(b *testing.B) {
+	for _, batching := range []bool{false, true} {
+		for _, producers := range []int{1, 10, 100} {
+			b.Run(fmt.Sprintf("batching=%t/producers=%d", batching, producers), func(b *testing.B) {
+				var opts []func(*log.Config)
+				if batching {
+					opts = append(opts, withBatching)
+				}
+				l := setupCluster(b, 3, 0, opts...)[0]
+				record := &api.Record{Value: []byte("hello world")}
+
+				b.ResetTimer()
+				var wg sync.WaitGroup
+				for p := 0; p < producers; p++ {
+					wg.Add(1)
+					go func(p int) {
+						defer wg.Done()
+						for i := p; i < b.N; i += producers {
+							if _, err := l.Append(record); err != nil {
+								b.Error(err)
+								return
+							}
+						}
+					}(p)
+				}
+				wg.Wait()
+			})
+		}
+	}
+}
+
+func withBatching(c *log.Config) {
+	c.Batch.Window = time.Millisecond
+}
+
+func TestRecoverCluster(t *testing.T) {
+	ports := dynaport.Get(3)
+	var dataDirs []string
+	var logs []*log.DistributedLog
+	for i := 0; i < 3; i++ {
+		dataDir, err := ioutil.TempDir("", "distributed-log-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dataDir)
+		dataDirs = append(dataDirs, dataDir)
+
+		l := newTestLog(t, i, ports[i], dataDir, i == 0)
+		if i == 0 {
+			require.NoError(t, l.WaitForLeader(3*time.Second))
+		} else {
+			require.NoError(t, logs[0].Join(
+				fmt.Sprintf("%d", i),
+				fmt.Sprintf("127.0.0.1:%d", ports[i]),
+				true,
+			))
+		}
+		logs = append(logs, l)
+	}
+
+	off, err := logs[0].Append(&api.Record{Value: []byte("hello")})
+	require.NoError(t, err)
+	servers, err := logs[0].GetServers()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(servers))
+
+	// the cluster loses two of the three servers for good
+	for _, l := range logs {
+		require.NoError(t, l.Close())
+	}
+	peersFile := filepath.Join(dataDirs[0], log.PeersFile)
+	require.NoError(t, log.WritePeers(peersFile, servers[:1]))
+
+	l := newTestLog(t, 0, ports[0], dataDirs[0], false)
+	defer l.Close()
+	require.NoError(t, l.WaitForLeader(3*time.Second))
+	_, err = os.Stat(peersFile)
+	require.True(t, os.IsNotExist(err))
+
+	servers, err = l.GetServers()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(servers))
+	got, err := l.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello"), got.Value)
+
+	off, err = l.Append(&api.Record{Value: []byte("world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+}
+
+func TestVerifyPeers(t *testing.T) {
+	ca := newTestCA(t)
+	ports := dynaport.Get(3)
+	layers := make([]*log.StreamLayer, 3)
+	newNode := func(id int, certName string, verify bool) (*log.DistributedLog, error) {
+		dataDir, err := ioutil.TempDir("", "distributed-log-test")
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = os.RemoveAll(dataDir) })
+		ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", ports[id]))
+		require.NoError(t, err)
+
+		serverTLSConfig, peerTLSConfig := ca.issue(t, certName)
+		layers[id] = log.NewStreamLayer(ln, serverTLSConfig, peerTLSConfig)
+		config := log.Config{}
+		config.Raft.StreamLayer = layers[id]
+		config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", id))
+		config.Raft.HeartbeatTimeout = 100 * time.Millisecond
+		config.Raft.ElectionTimeout = 100 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 100 * time.Millisecond
+		config.Raft.CommitTimeout = 50 * time.Millisecond
+		config.Raft.Bootstrap = id == 0
+		config.Raft.VerifyPeers = verify
+
+		l, err := log.NewDistributedLog(dataDir, config)
+		if err != nil {
+			_ = ln.Close()
+			return nil, err
+		}
+		t.Cleanup(func() { _ = l.Close() })
+		return l, nil
+	}
+
+	leader, err := newNode(0, "0", true)
+	require.NoError(t, err)
+	require.NoError(t, leader.WaitForLeader(3*time.Second))
+	follower, err := newNode(1, "1", true)
+	require.NoError(t, err)
+	require.NoError(t, leader.Join("1", fmt.Sprintf("127.0.0.1:%d", ports[1]), true))
+
+	// a node can't verify its peers with a certificate for another node
+	_, err = newNode(2, "1", true)
+	require.ErrorContains(t, err, `doesn't name raft server "2"`)
+
+	// nor with a server that doesn't require the peers' certificates
+	dataDir, err := ioutil.TempDir("", "distributed-log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	serverTLSConfig, peerTLSConfig := ca.issue(t, "3")
+	serverTLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	config := log.Config{}
+	config.Raft.StreamLayer = log.NewStreamLayer(ln, serverTLSConfig, peerTLSConfig)
+	config.Raft.LocalID = "3"
+	config.Raft.VerifyPeers = true
+	_, err = log.NewDistributedLog(dataDir, config)
+	require.ErrorContains(t, err, "verify client certificates")
+
+	// an impostor doesn't check its own certificate
+	impostor, err := newNode(2, "mallory", false)
+	require.NoError(t, err)
+	impostorAddr := fmt.Sprintf("127.0.0.1:%d", ports[2])
+	require.NoError(t, leader.Join("2", impostorAddr, true))
+
+	off, err := leader.Append(&api.Record{Value: []byte("hello")})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		_, err := follower.Read(off)
+		return err == nil
+	}, 3*time.Second, 50*time.Millisecond)
+	time.Sleep(500 * time.Millisecond)
+	_, err = impostor.Read(off)
+	require.Error(t, err)
+
+	_, err = layers[0].Dial(raft.ServerAddress(impostorAddr), time.Second)
+	require.ErrorContains(t, err, `presented a certificate for [mallory], not for raft server "2"`)
+
+	// the leader doesn't accept the impostor's connections either, as it
+	// connects as raft server "2"
+	leaderAddr := fmt.Sprintf("127.0.0.1:%d", ports[0])
+	conn, err := layers[2].Dial(raft.ServerAddress(leaderAddr), time.Second)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	// nor the preamble in the clear
+	plain, err := net.Dial("tcp", leaderAddr)
+	require.NoError(t, err)
+	defer plain.Close()
+	_, err = plain.Write([]byte{log.RaftRPC, 0, 0, 0, 0, 0, 1, '2'})
+	require.NoError(t, err)
+	_, err = plain.Read(make([]byte, 1))
+	require.Error(t, err)
+}
+
+// testCA issues the certificates of the nodes in a test cluster.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue returns the server and peer TLS configs of the node with
+// a certificate for the name.
+func (ca *testCA) issue(t *testing.T, name string) (*tls.Config, *tls.Config) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    ca.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      ca.pool,
+		ServerName:   "127.0.0.1",
+	}
+}
+
+func setupCluster(
+	t testing.TB, voters, nonvoters int, opts ...func(*log.Config),
+) []*log.DistributedLog {
+	t.Helper()
+	var logs []*log.DistributedLog
+	nodeCount := voters + nonvoters
+	ports := dynaport.Get(nodeCount)
+	for i := 0; i < nodeCount; i++ {
+		dataDir, err := ioutil.TempDir("", "distributed-log-test")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = os.RemoveAll(dataDir)
+		})
+
+		l := newTestLog(t, i, ports[i], dataDir, i == 0, opts...)
+		t.Cleanup(func() {
+			_ = l.Close()
+		})
+
+		if i != 0 {
+			err = logs[0].Join(
+				fmt.Sprintf("%d", i),
+				fmt.Sprintf("127.0.0.1:%d", ports[i]),
+				i < voters,
+			)
+			require.NoError(t, err)
+		} else {
+			err = l.WaitForLeader(3 * time.Second)
+			require.NoError(t, err)
+		}
+
+		logs = append(logs, l)
+	}
+
+	return logs
+}
+
+func newTestLog(
+	t testing.TB, id, port int, dataDir string, bootstrap bool, opts ...func(*log.Config),
+) *log.DistributedLog {
+	t.Helper()
+	ln, err := net.Listen(
+		"tcp",
+		fmt.Sprintf("127.0.0.1:%d", port),
+	)
+	require.NoError(t, err)
+
+	config := log.Config{}
+	config.Raft.StreamLayer = log.NewStreamLayer(ln, nil, nil)
+	config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", id))
+	config.Raft.HeartbeatTimeout = 100 * time.Millisecond
+	config.Raft.ElectionTimeout = 100 * time.Millisecond
+	config.Raft.LeaderLeaseTimeout = 100 * time.Millisecond
+	config.Raft.CommitTimeout = 50 * time.Millisecond
+	config.Raft.Bootstrap = bootstrap
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	l, err := log.NewDistributedLog(dataDir, config)
+	require.NoError(t, err)
+
+	return l
+}
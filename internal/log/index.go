@@ -91,6 +91,23 @@ func (index *index) Write(off uint32, pos uint64) error {
 	return nil
 }
 
+// Truncate drops every entry after the first n ones.
+// The dropped entries are overwritten by the following writes.
+func (index *index) Truncate(n uint64) {
+	if size := n * endWidth; size < index.size {
+		index.size = size
+	}
+}
+
+// Sync commits the mapped data to stable storage.
+func (index *index) Sync() error {
+	if err := index.mmap.Sync(gommap.MS_SYNC); err != nil {
+		return err
+	}
+
+	return index.file.Sync()
+}
+
 // Name returns name of underlying file
 func (index *index) Name() string {
 	return index.file.Name()
@@ -82,7 +82,7 @@ func (l *Log) Read(off uint64) (*api.Record, error) {
 	defer l.mu.RUnlock()
 	var s *segment
 	for _, segment := range l.segments {
-		if segment.baseOffset <= off && off <= segment.nextOffset {
+		if segment.baseOffset <= off && off < segment.nextOffset {
 			s = segment
 			break
 		}
@@ -118,6 +118,10 @@ func (l *Log) Reset() error {
 	if err := l.Remove(); err != nil {
 		return err
 	}
+	if err := os.MkdirAll(l.Dir, 0755); err != nil {
+		return err
+	}
+	l.segments = nil
 
 	return l.setup()
 }
@@ -156,6 +160,101 @@ func (l *Log) Truncate(lowest uint64) error {
 	return nil
 }
 
+// TruncateBefore removes every record with an offset lower than off.
+// Unlike Truncate it's exact: a segment holding records on both sides
+// of off is rewritten into a new segment, that starts at off.
+func (l *Log) TruncateBefore(off uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var segments []*segment
+	for _, s := range l.segments {
+		if s.baseOffset >= off {
+			segments = append(segments, s)
+			continue
+		}
+		if s.nextOffset <= off && s != l.activeSegment {
+			if err := s.Remove(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		ns, err := l.rewriteSegment(s, off)
+		if err != nil {
+			return err
+		}
+		if s == l.activeSegment {
+			l.activeSegment = ns
+		}
+		segments = append(segments, ns)
+	}
+	l.segments = segments
+	return nil
+}
+
+// rewriteSegment copies records of s starting from off into a new segment
+// with off as its base offset, and removes s.
+func (l *Log) rewriteSegment(s *segment, off uint64) (*segment, error) {
+	ns, err := newSegment(l.Dir, off, l.Config)
+	if err != nil {
+		return nil, err
+	}
+	for o := off; o < s.nextOffset; o++ {
+		record, err := s.Read(o)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = ns.Append(record); err != nil {
+			return nil, err
+		}
+	}
+
+	return ns, s.Remove()
+}
+
+// TruncateAfter removes every record with an offset greater than off.
+func (l *Log) TruncateAfter(off uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var segments []*segment
+	for _, s := range l.segments {
+		if s.baseOffset > off {
+			if err := s.Remove(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := s.TruncateAfter(off); err != nil {
+			return err
+		}
+		segments = append(segments, s)
+	}
+	l.segments = segments
+	if len(segments) == 0 {
+		return l.newSegment(off + 1)
+	}
+
+	// a suffix deleted on a segment boundary leaves a full segment last,
+	// so a new one is rolled the way Append does
+	l.activeSegment = segments[len(segments)-1]
+	if l.activeSegment.IsMaxed() {
+		return l.newSegment(l.activeSegment.nextOffset)
+	}
+	return nil
+}
+
+// removeSegments closes the log's segments and removes their files.
+func (l *Log) removeSegments() error {
+	for _, s := range l.segments {
+		if err := s.Remove(); err != nil {
+			return err
+		}
+	}
+	l.segments = nil
+	l.activeSegment = nil
+	return nil
+}
+
 func (l *Log) Reader() io.Reader {
 	l.mu.Lock()
 	defer l.mu.Unlock()
@@ -20,6 +20,9 @@ func TestLog(t *testing.T) {
 		"init with existing segments":       testInitExisting,
 		"reader":                            testReader,
 		"truncate":                          testTruncate,
+		"read across segments":              testReadAcrossSegments,
+		"truncate before":                   testTruncateBefore,
+		"truncate after":                    testTruncateAfter,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := ioutil.TempDir(".", "store-test")
@@ -95,6 +98,62 @@ func testReader(t *testing.T, log *Log) {
 	require.Equal(t, record.Value, read.Value)
 }
 
+func testReadAcrossSegments(t *testing.T, log *Log) {
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte{byte(i)}})
+		require.NoError(t, err)
+	}
+	require.True(t, len(log.segments) > 1)
+
+	for i := 0; i < 3; i++ {
+		read, err := log.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, []byte{byte(i)}, read.Value)
+	}
+}
+
+func testTruncateBefore(t *testing.T, log *Log) {
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte{byte(i)}})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.TruncateBefore(2))
+
+	off, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	_, err = log.Read(1)
+	require.Error(t, err)
+	read, err := log.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte{2}, read.Value)
+
+	off, err = log.Append(&api.Record{Value: []byte{3}})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+}
+
+func testTruncateAfter(t *testing.T, log *Log) {
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte{byte(i)}})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.TruncateAfter(0))
+
+	off, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	_, err = log.Read(1)
+	require.Error(t, err)
+
+	off, err = log.Append(&api.Record{Value: []byte{4}})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	read, err := log.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte{4}, read.Value)
+}
+
 func testTruncate(t *testing.T, log *Log) {
 	record := &api.Record{Value: []byte("hello world")}
 	for i := 0; i < 3; i++ {
@@ -0,0 +1,120 @@
+package log
+
+import (
+	"errors"
+
+	"github.com/hashicorp/raft"
+
+	api "github.com/fedoroko/proglog/api/v1"
+)
+
+var _ raft.LogStore = (*logStore)(nil)
+
+// logStore keeps raft's log in a Log, where a record's offset is
+// the entry's raft index.
+type logStore struct {
+	*Log
+}
+
+func newLogStore(dir string, c Config) (*logStore, error) {
+	log, err := NewLog(dir, c)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logStore{log}, err
+}
+
+// bounds returns the first and the last index, both zero if the log is empty.
+func (l *logStore) bounds() (first, last uint64) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	first = l.segments[0].baseOffset
+	next := l.activeSegment.nextOffset
+	if first == next {
+		return 0, 0
+	}
+
+	return first, next - 1
+}
+
+func (l *logStore) FirstIndex() (uint64, error) {
+	first, _ := l.bounds()
+	return first, nil
+}
+
+func (l *logStore) LastIndex() (uint64, error) {
+	_, last := l.bounds()
+	return last, nil
+}
+
+func (l *logStore) GetLog(index uint64, out *raft.Log) error {
+	in, err := l.Read(index)
+	if errors.As(err, &api.ErrOffsetOutOfRange{}) {
+		return raft.ErrLogNotFound
+	}
+	if err != nil {
+		return err
+	}
+	out.Data = in.Value
+	out.Index = in.Offset
+	out.Type = raft.LogType(in.Type)
+	out.Term = in.Term
+	return nil
+}
+
+func (l *logStore) StoreLog(record *raft.Log) error {
+	return l.StoreLogs([]*raft.Log{record})
+}
+
+// StoreLogs appends the entries at their indexes. An entry overlapping
+// the log truncates the conflicting tail, and an entry past the end of
+// the log (or into an empty one) starts the log over from its index.
+func (l *logStore) StoreLogs(records []*raft.Log) error {
+	for _, record := range records {
+		first, last := l.bounds()
+		switch {
+		case first == 0 || record.Index > last+1:
+			if err := l.resetTo(record.Index); err != nil {
+				return err
+			}
+		case record.Index <= last:
+			if err := l.TruncateAfter(record.Index - 1); err != nil {
+				return err
+			}
+		}
+
+		if _, err := l.Append(&api.Record{
+			Value: record.Data,
+			Term:  record.Term,
+			Type:  uint32(record.Type),
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeleteRange removes entries from min to max inclusive. Raft deletes
+// either a prefix, when compacting after a snapshot, or a suffix, when
+// a follower's entries conflict with the leader's.
+func (l *logStore) DeleteRange(min, max uint64) error {
+	first, _ := l.bounds()
+	if min <= first {
+		return l.TruncateBefore(max + 1)
+	}
+
+	return l.TruncateAfter(min - 1)
+}
+
+// resetTo removes every entry and starts the log over from the index.
+func (l *logStore) resetTo(index uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.removeSegments(); err != nil {
+		return err
+	}
+
+	return l.newSegment(index)
+}
@@ -0,0 +1,294 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+)
+
+// TestLogStore mirrors the LogStore tests of hashicorp/raft's own
+// inmem_store.
+func TestLogStore(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T, store *logStore,
+	){
+		"first index":                       testLogStoreFirstIndex,
+		"last index":                        testLogStoreLastIndex,
+		"get log":                           testLogStoreGetLog,
+		"set log":                           testLogStoreSetLog,
+		"set logs":                          testLogStoreSetLogs,
+		"delete range":                      testLogStoreDeleteRange,
+		"delete suffix on conflict":         testLogStoreDeleteSuffix,
+		"store logs past the end":           testLogStoreGap,
+		"delete range across segments":      testLogStoreDeleteAcrossSegments,
+		"reopen after compaction":           testLogStoreReopen,
+		"store logs overwrite conflicting":  testLogStoreOverwrite,
+		"delete everything then store logs": testLogStoreDeleteAll,
+		"delete suffix on segment boundary": testLogStoreDeleteOnBoundary,
+		"match the in-memory store":         testLogStoreMatchesInmem,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "logstore-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1024
+			// a full index rolls the segments, as appending to it fails
+			c.Segment.MaxIndexBytes = 3 * endWidth
+			c.Segment.InitialOffset = 1
+			store, err := newLogStore(dir, c)
+			require.NoError(t, err)
+			defer store.Close()
+
+			fn(t, store)
+		})
+	}
+}
+
+func testRaftLog(idx uint64, data string) *raft.Log {
+	return &raft.Log{
+		Data:  []byte(data),
+		Index: idx,
+		Term:  idx,
+		Type:  raft.LogCommand,
+	}
+}
+
+func storeTestLogs(t *testing.T, store *logStore, from, to uint64) {
+	t.Helper()
+	var logs []*raft.Log
+	for i := from; i <= to; i++ {
+		logs = append(logs, testRaftLog(i, fmt.Sprintf("log%d", i)))
+	}
+	require.NoError(t, store.StoreLogs(logs))
+}
+
+func requireIndexes(t *testing.T, store *logStore, first, last uint64) {
+	t.Helper()
+	gotFirst, err := store.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, first, gotFirst)
+	gotLast, err := store.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, last, gotLast)
+}
+
+func testLogStoreFirstIndex(t *testing.T, store *logStore) {
+	idx, err := store.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), idx)
+
+	storeTestLogs(t, store, 1, 3)
+	idx, err = store.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), idx)
+}
+
+func testLogStoreLastIndex(t *testing.T, store *logStore) {
+	idx, err := store.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), idx)
+
+	storeTestLogs(t, store, 1, 3)
+	idx, err = store.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), idx)
+}
+
+func testLogStoreGetLog(t *testing.T, store *logStore) {
+	log := new(raft.Log)
+	require.Equal(t, raft.ErrLogNotFound, store.GetLog(1, log))
+
+	storeTestLogs(t, store, 1, 3)
+	require.NoError(t, store.GetLog(2, log))
+	require.Equal(t, testRaftLog(2, "log2"), log)
+}
+
+func testLogStoreSetLog(t *testing.T, store *logStore) {
+	want := testRaftLog(1, "log1")
+	require.NoError(t, store.StoreLog(want))
+
+	got := new(raft.Log)
+	require.NoError(t, store.GetLog(1, got))
+	require.Equal(t, want, got)
+}
+
+func testLogStoreSetLogs(t *testing.T, store *logStore) {
+	storeTestLogs(t, store, 1, 2)
+
+	got := new(raft.Log)
+	require.NoError(t, store.GetLog(1, got))
+	require.Equal(t, testRaftLog(1, "log1"), got)
+	require.NoError(t, store.GetLog(2, got))
+	require.Equal(t, testRaftLog(2, "log2"), got)
+}
+
+func testLogStoreDeleteRange(t *testing.T, store *logStore) {
+	storeTestLogs(t, store, 1, 3)
+	require.NoError(t, store.DeleteRange(1, 2))
+
+	log := new(raft.Log)
+	require.Equal(t, raft.ErrLogNotFound, store.GetLog(1, log))
+	require.Equal(t, raft.ErrLogNotFound, store.GetLog(2, log))
+	require.NoError(t, store.GetLog(3, log))
+	requireIndexes(t, store, 3, 3)
+}
+
+func testLogStoreDeleteSuffix(t *testing.T, store *logStore) {
+	storeTestLogs(t, store, 1, 5)
+	require.NoError(t, store.DeleteRange(3, 5))
+	requireIndexes(t, store, 1, 2)
+
+	require.NoError(t, store.StoreLog(testRaftLog(3, "new3")))
+	got := new(raft.Log)
+	require.NoError(t, store.GetLog(3, got))
+	require.Equal(t, testRaftLog(3, "new3"), got)
+	requireIndexes(t, store, 1, 3)
+}
+
+func testLogStoreGap(t *testing.T, store *logStore) {
+	storeTestLogs(t, store, 1, 3)
+	require.NoError(t, store.StoreLog(testRaftLog(10, "log10")))
+	requireIndexes(t, store, 10, 10)
+
+	got := new(raft.Log)
+	require.Equal(t, raft.ErrLogNotFound, store.GetLog(3, got))
+	require.NoError(t, store.GetLog(10, got))
+	require.Equal(t, testRaftLog(10, "log10"), got)
+}
+
+func testLogStoreDeleteAcrossSegments(t *testing.T, store *logStore) {
+	storeTestLogs(t, store, 1, 10)
+	require.True(t, len(store.segments) > 2)
+
+	require.NoError(t, store.DeleteRange(1, 4))
+	requireIndexes(t, store, 5, 10)
+	require.NoError(t, store.DeleteRange(8, 10))
+	requireIndexes(t, store, 5, 7)
+
+	got := new(raft.Log)
+	for i := uint64(5); i <= 7; i++ {
+		require.NoError(t, store.GetLog(i, got))
+		require.Equal(t, testRaftLog(i, fmt.Sprintf("log%d", i)), got)
+	}
+
+	storeTestLogs(t, store, 8, 9)
+	requireIndexes(t, store, 5, 9)
+}
+
+func testLogStoreReopen(t *testing.T, store *logStore) {
+	storeTestLogs(t, store, 1, 10)
+	require.NoError(t, store.DeleteRange(1, 6))
+	require.NoError(t, store.Close())
+
+	reopened, err := newLogStore(store.Dir, store.Config)
+	require.NoError(t, err)
+	requireIndexes(t, reopened, 7, 10)
+	got := new(raft.Log)
+	require.NoError(t, reopened.GetLog(7, got))
+	require.Equal(t, testRaftLog(7, "log7"), got)
+	store.Log = reopened.Log
+}
+
+func testLogStoreOverwrite(t *testing.T, store *logStore) {
+	storeTestLogs(t, store, 1, 5)
+	require.NoError(t, store.StoreLogs([]*raft.Log{
+		testRaftLog(2, "new2"),
+		testRaftLog(3, "new3"),
+	}))
+	requireIndexes(t, store, 1, 3)
+
+	got := new(raft.Log)
+	require.NoError(t, store.GetLog(2, got))
+	require.Equal(t, testRaftLog(2, "new2"), got)
+}
+
+func testLogStoreDeleteAll(t *testing.T, store *logStore) {
+	storeTestLogs(t, store, 1, 5)
+	require.NoError(t, store.DeleteRange(1, 5))
+	requireIndexes(t, store, 0, 0)
+
+	storeTestLogs(t, store, 6, 7)
+	requireIndexes(t, store, 6, 7)
+}
+
+func testLogStoreDeleteOnBoundary(t *testing.T, store *logStore) {
+	storeTestLogs(t, store, 1, 10)
+	require.True(t, len(store.segments) > 2)
+
+	// the suffix deleted is the second segment on, leaving the full
+	// first segment last
+	boundary := store.segments[1].baseOffset
+	require.NoError(t, store.DeleteRange(boundary, 10))
+	requireIndexes(t, store, 1, boundary-1)
+
+	storeTestLogs(t, store, boundary, 10)
+	requireIndexes(t, store, 1, 10)
+	got := new(raft.Log)
+	require.NoError(t, store.GetLog(10, got))
+	require.Equal(t, testRaftLog(10, "log10"), got)
+
+	// and so is a conflicting entry overwriting the next segment
+	boundary = store.segments[2].baseOffset
+	require.NoError(t, store.StoreLog(testRaftLog(boundary, "new")))
+	requireIndexes(t, store, 1, boundary)
+	storeTestLogs(t, store, boundary+1, boundary+2)
+	requireIndexes(t, store, 1, boundary+2)
+}
+
+// testLogStoreMatchesInmem stores and deletes the entries the way raft
+// does, and checks the store against raft's own in-memory one.
+func testLogStoreMatchesInmem(t *testing.T, store *logStore) {
+	inmem := raft.NewInmemStore()
+	random := rand.New(rand.NewSource(1))
+	requireSame := func() {
+		t.Helper()
+		first, err := inmem.FirstIndex()
+		require.NoError(t, err)
+		last, err := inmem.LastIndex()
+		require.NoError(t, err)
+		requireIndexes(t, store, first, last)
+		for i := first; i <= last && last != 0; i++ {
+			want, got := new(raft.Log), new(raft.Log)
+			require.NoError(t, inmem.GetLog(i, want))
+			require.NoError(t, store.GetLog(i, got))
+			require.Equal(t, want.Index, got.Index)
+			require.Equal(t, want.Term, got.Term)
+			require.Equal(t, want.Data, got.Data)
+		}
+	}
+
+	next := uint64(1)
+	for step := 0; step < 200; step++ {
+		first, _ := inmem.FirstIndex()
+		last, _ := inmem.LastIndex()
+		switch op := random.Intn(4); {
+		case op == 0 && last > first:
+			// compaction
+			max := first + uint64(random.Intn(int(last-first)))
+			require.NoError(t, inmem.DeleteRange(first, max))
+			require.NoError(t, store.DeleteRange(first, max))
+		case op == 1 && last > first:
+			// a conflicting suffix
+			min := first + 1 + uint64(random.Intn(int(last-first)))
+			require.NoError(t, inmem.DeleteRange(min, last))
+			require.NoError(t, store.DeleteRange(min, last))
+			next = min
+		default:
+			var logs []*raft.Log
+			for n := random.Intn(4) + 1; n > 0; n-- {
+				logs = append(logs, testRaftLog(next, fmt.Sprintf("log%d-%d", next, step)))
+				next++
+			}
+			require.NoError(t, inmem.StoreLogs(logs))
+			require.NoError(t, store.StoreLogs(logs))
+		}
+		requireSame()
+	}
+}
@@ -0,0 +1,264 @@
+package log
+
+import (
+	"errors"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/raft"
+
+	api "github.com/fedoroko/proglog/api/v1"
+)
+
+// PartitionedLog runs a raft group per partition, so the partitions'
+// writes go through different leaders instead of a single one. The groups
+// share the stream layer, and have the same servers as members.
+type PartitionedLog struct {
+	config     Config
+	partitions []*DistributedLog
+	watchers   serverWatchers
+	closed     chan struct{}
+	done       chan struct{}
+}
+
+func NewPartitionedLog(dataDir string, config Config) (*PartitionedLog, error) {
+	count := config.Partitions.Count
+	if count == 0 {
+		count = 1
+	}
+	l := &PartitionedLog{
+		config: config,
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	for i := 0; i < count; i++ {
+		c := config
+		if i != 0 {
+			var err error
+			c.Raft.StreamLayer, err = config.Raft.StreamLayer.Group(uint32(i))
+			if err != nil {
+				_ = l.closePartitions()
+				return nil, err
+			}
+		}
+
+		partition, err := NewDistributedLog(filepath.Join(dataDir, strconv.Itoa(i)), c)
+		if err != nil {
+			_ = c.Raft.StreamLayer.Close()
+			_ = l.closePartitions()
+			return nil, err
+		}
+		l.partitions = append(l.partitions, partition)
+	}
+
+	for _, p := range l.partitions {
+		changes, _ := p.WatchServers()
+		go func() {
+			for range changes {
+				l.watchers.notify()
+			}
+		}()
+	}
+	go l.balanceLoop()
+	return l, nil
+}
+
+// Partition returns the log of the partition.
+func (l *PartitionedLog) Partition(id uint32) (*DistributedLog, error) {
+	if int(id) >= len(l.partitions) {
+		return nil, api.ErrUnknownPartition{Partition: id}
+	}
+
+	return l.partitions[id], nil
+}
+
+func (l *PartitionedLog) Append(partition uint32, record *api.Record) (uint64, error) {
+	p, err := l.Partition(partition)
+	if err != nil {
+		return 0, err
+	}
+
+	return p.Append(record)
+}
+
+func (l *PartitionedLog) Read(partition uint32, offset uint64) (*api.Record, error) {
+	p, err := l.Partition(partition)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.Read(offset)
+}
+
+// Join adds the server to the groups this server leads. Every server
+// gets the join, so each group is joined by its own leader.
+func (l *PartitionedLog) Join(id, addr string, voter bool) error {
+	return l.leaderDo(func(p *DistributedLog) error {
+		return p.Join(id, addr, voter)
+	})
+}
+
+// Leave removes the server from the groups this server leads.
+func (l *PartitionedLog) Leave(id string) error {
+	return l.leaderDo(func(p *DistributedLog) error {
+		return p.Leave(id)
+	})
+}
+
+// TransferLeadership hands the leadership of the partitions this server
+// leads over to the server, or to any other if the id is empty.
+func (l *PartitionedLog) TransferLeadership(id string) error {
+	return l.leaderDo(func(p *DistributedLog) error {
+		return p.TransferLeadership(id)
+	})
+}
+
+// leaderDo calls fn with each partition led by this server. It returns
+// raft.ErrNotLeader if the server doesn't lead any.
+func (l *PartitionedLog) leaderDo(fn func(p *DistributedLog) error) error {
+	led := false
+	for _, p := range l.partitions {
+		if !p.IsLeader() {
+			continue
+		}
+		led = true
+		if err := fn(p); err != nil && !errors.Is(err, raft.ErrNotLeader) {
+			return err
+		}
+	}
+	if !led {
+		return raft.ErrNotLeader
+	}
+
+	return nil
+}
+
+// WaitForLeader waits for every partition to elect a leader.
+func (l *PartitionedLog) WaitForLeader(timeout time.Duration) error {
+	errs := make(chan error, len(l.partitions))
+	for _, p := range l.partitions {
+		go func(p *DistributedLog) {
+			errs <- p.WaitForLeader(timeout)
+		}(p)
+	}
+
+	var err error
+	for range l.partitions {
+		if e := <-errs; e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// GetServers returns the servers with the partitions each one leads.
+func (l *PartitionedLog) GetServers() ([]*api.Server, error) {
+	servers, err := l.partitions[0].GetServers()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, p := range l.partitions {
+		_, leaderID := p.raft.LeaderWithID()
+		for _, server := range servers {
+			if server.Id == string(leaderID) {
+				server.LeaderOf = append(server.LeaderOf, uint32(i))
+			}
+		}
+	}
+
+	return servers, nil
+}
+
+// WatchServers returns a channel signalled whenever the servers of any
+// partition change, see DistributedLog.WatchServers.
+func (l *PartitionedLog) WatchServers() (<-chan struct{}, func()) {
+	return l.watchers.watch()
+}
+
+// Balance hands the leadership of the partitions this server leads over
+// to the voters leading the fewest partitions, until this server leads
+// no more than its fair share. Each server balances its own partitions,
+// so the leaders spread across the cluster as every server does.
+func (l *PartitionedLog) Balance() error {
+	servers, err := l.GetServers()
+	if err != nil {
+		return err
+	}
+
+	led := make(map[string]int)
+	var voters []string
+	for _, server := range servers {
+		if server.Role == api.Role_VOTER {
+			voters = append(voters, server.Id)
+			led[server.Id] = len(server.LeaderOf)
+		}
+	}
+	if len(voters) == 0 {
+		return nil
+	}
+	fair := (len(l.partitions) + len(voters) - 1) / len(voters)
+	local := string(l.config.Raft.LocalID)
+
+	for _, p := range l.partitions {
+		if led[local] <= fair {
+			return nil
+		}
+		if !p.IsLeader() {
+			continue
+		}
+
+		sort.Slice(voters, func(i, j int) bool {
+			return led[voters[i]] < led[voters[j]]
+		})
+		target := voters[0]
+		if target == local || led[target]+1 > fair {
+			return nil
+		}
+		if err = p.TransferLeadership(target); err != nil {
+			return err
+		}
+		led[local]--
+		led[target]++
+	}
+
+	return nil
+}
+
+func (l *PartitionedLog) balanceLoop() {
+	defer close(l.done)
+	interval := l.config.Partitions.BalanceInterval
+	if interval == 0 {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// a failed transfer is retried on the next tick
+			_ = l.Balance()
+		case <-l.closed:
+			return
+		}
+	}
+}
+
+func (l *PartitionedLog) Close() error {
+	close(l.closed)
+	<-l.done
+	defer l.watchers.close()
+	return l.closePartitions()
+}
+
+func (l *PartitionedLog) closePartitions() error {
+	for _, p := range l.partitions {
+		if err := p.Close(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
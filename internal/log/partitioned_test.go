@@ -0,0 +1,93 @@
+package log_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/go-dynaport"
+
+	api "github.com/fedoroko/proglog/api/v1"
+	"github.com/fedoroko/proglog/internal/log"
+)
+
+func TestPartitionedLog(t *testing.T) {
+	nodeCount, partitions := 3, 3
+	ports := dynaport.Get(nodeCount)
+	var logs []*log.PartitionedLog
+	for i := 0; i < nodeCount; i++ {
+		dataDir, err := ioutil.TempDir("", "partitioned-log-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dataDir)
+
+		ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", ports[i]))
+		require.NoError(t, err)
+
+		config := log.Config{}
+		config.Raft.StreamLayer = log.NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", i))
+		config.Raft.HeartbeatTimeout = 100 * time.Millisecond
+		config.Raft.ElectionTimeout = 100 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 100 * time.Millisecond
+		config.Raft.CommitTimeout = 50 * time.Millisecond
+		config.Raft.Bootstrap = i == 0
+		config.Partitions.Count = partitions
+		config.Partitions.BalanceInterval = 100 * time.Millisecond
+
+		l, err := log.NewPartitionedLog(dataDir, config)
+		require.NoError(t, err)
+		defer l.Close()
+
+		if i == 0 {
+			require.NoError(t, l.WaitForLeader(3*time.Second))
+		} else {
+			require.NoError(t, logs[0].Join(
+				fmt.Sprintf("%d", i), ln.Addr().String(), true,
+			))
+		}
+		logs = append(logs, l)
+	}
+
+	// every server ends up leading a partition
+	leaders := make(map[uint32]int)
+	require.Eventually(t, func() bool {
+		servers, err := logs[0].GetServers()
+		if err != nil || len(servers) != nodeCount {
+			return false
+		}
+		for i, server := range servers {
+			if len(server.LeaderOf) != 1 {
+				return false
+			}
+			leaders[server.LeaderOf[0]] = i
+		}
+		return true
+	}, 10*time.Second, 100*time.Millisecond)
+
+	// the partitions are separate logs, each with its own offsets
+	for partition := uint32(0); partition < uint32(partitions); partition++ {
+		off, err := logs[leaders[partition]].Append(partition, &api.Record{
+			Value: []byte{byte(partition)},
+		})
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), off)
+	}
+	for _, l := range logs {
+		for partition := uint32(0); partition < uint32(partitions); partition++ {
+			require.Eventually(t, func() bool {
+				got, err := l.Read(partition, 0)
+				return err == nil && got.Value[0] == byte(partition)
+			}, 3*time.Second, 50*time.Millisecond)
+		}
+	}
+
+	_, err := logs[0].Read(uint32(partitions), 0)
+	require.Error(t, err)
+	_, err = logs[leaders[0]].Append(1, &api.Record{Value: []byte("foo")})
+	require.Error(t, err)
+}
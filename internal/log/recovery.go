@@ -0,0 +1,75 @@
+package log
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/raft"
+
+	api "github.com/fedoroko/proglog/api/v1"
+)
+
+// PeersFile is the file an operator drops into the data dir of each
+// surviving server to recover a cluster that has lost its quorum. The
+// servers start over with the configuration listed in the file.
+const PeersFile = "peers.json"
+
+// peerEntry is a server in the peers file, in the format of
+// raft.ReadConfigJSON.
+type peerEntry struct {
+	ID       string `json:"id"`
+	Address  string `json:"address"`
+	NonVoter bool   `json:"non_voter"`
+}
+
+// WritePeers writes the servers into a peers file at the path.
+func WritePeers(path string, servers []*api.Server) error {
+	peers := make([]peerEntry, 0, len(servers))
+	for _, server := range servers {
+		peers = append(peers, peerEntry{
+			ID:       server.Id,
+			Address:  server.RpcAddr,
+			NonVoter: server.Role == api.Role_NONVOTER,
+		})
+	}
+	b, err := json.MarshalIndent(peers, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, b, 0644)
+}
+
+// recoverCluster replaces the persisted raft configuration with the one in
+// the peers file, if the data dir has one, and removes the file once it's
+// applied, so the next start doesn't recover again.
+func (l *DistributedLog) recoverCluster(
+	dataDir string,
+	config *raft.Config,
+	snapshotStore raft.SnapshotStore,
+	transport raft.Transport,
+) error {
+	path := filepath.Join(dataDir, PeersFile)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	configuration, err := raft.ReadConfigJSON(path)
+	if err != nil {
+		return err
+	}
+	if err = raft.RecoverCluster(
+		config,
+		l.fsm,
+		l.logStore,
+		l.stableStore,
+		snapshotStore,
+		transport,
+		configuration,
+	); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
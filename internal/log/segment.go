@@ -95,6 +95,27 @@ func (s *segment) Read(off uint64) (*api.Record, error) {
 	return record, err
 }
 
+// TruncateAfter drops every record with an offset greater than off.
+func (s *segment) TruncateAfter(off uint64) error {
+	if off+1 >= s.nextOffset {
+		return nil
+	}
+	if off+1 <= s.baseOffset {
+		s.index.Truncate(0)
+		s.nextOffset = s.baseOffset
+		return s.store.Truncate(0)
+	}
+
+	rel := off + 1 - s.baseOffset
+	_, pos, err := s.index.Read(int64(rel)) // position of the first dropped record
+	if err != nil {
+		return err
+	}
+	s.index.Truncate(rel)
+	s.nextOffset = off + 1
+	return s.store.Truncate(pos)
+}
+
 func (s *segment) IsMaxed() bool {
 	return s.store.size >= s.config.Segment.MaxStoreBytes ||
 		s.index.size >= s.config.Segment.MaxIndexBytes
@@ -0,0 +1,382 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hashicorp/raft"
+
+	api "github.com/fedoroko/proglog/api/v1"
+)
+
+// snapshotMagic starts the snapshots in the segment format, ahead of their
+// version. The snapshots taken before are a stream of records, which starts
+// with a record's length, so it never reads as the magic.
+var snapshotMagic = []byte("PLSN")
+
+const (
+	snapshotVersion uint32 = 1
+	// snapshotPrefixWidth is a width of the snapshot's prefix: the magic and
+	// the version, 4 bytes each, the offset next to the snapshot's last
+	// record and the count of cached segments, 8 bytes each.
+	snapshotPrefixWidth = 4 + 4 + 2*lenWidth
+)
+
+// snapshotHeaderWidth is a width of the segment's header in a snapshot:
+// base offset, store size and index size, 8 bytes each.
+const snapshotHeaderWidth = 3 * lenWidth
+
+// segmentHeader describes a segment in the snapshot.
+type segmentHeader struct {
+	baseOffset uint64
+	storeSize  uint64
+	indexSize  uint64
+}
+
+func (h segmentHeader) encode() []byte {
+	b := make([]byte, snapshotHeaderWidth)
+	enc.PutUint64(b[0:lenWidth], h.baseOffset)
+	enc.PutUint64(b[lenWidth:2*lenWidth], h.storeSize)
+	enc.PutUint64(b[2*lenWidth:], h.indexSize)
+	return b
+}
+
+func decodeSegmentHeader(b []byte) segmentHeader {
+	return segmentHeader{
+		baseOffset: enc.Uint64(b[0:lenWidth]),
+		storeSize:  enc.Uint64(b[lenWidth : 2*lenWidth]),
+		indexSize:  enc.Uint64(b[2*lenWidth:]),
+	}
+}
+
+// snapshotPrefix starts the snapshots in the segment format.
+type snapshotPrefix struct {
+	nextOffset uint64
+	cached     []segmentHeader
+}
+
+func (p snapshotPrefix) encode() []byte {
+	b := make([]byte, snapshotPrefixWidth, snapshotPrefixWidth+len(p.cached)*snapshotHeaderWidth)
+	copy(b, snapshotMagic)
+	enc.PutUint32(b[4:8], snapshotVersion)
+	enc.PutUint64(b[8:8+lenWidth], p.nextOffset)
+	enc.PutUint64(b[8+lenWidth:], uint64(len(p.cached)))
+	for _, h := range p.cached {
+		b = append(b, h.encode()...)
+	}
+	return b
+}
+
+// readSnapshotPrefix reads the prefix of the snapshot. A snapshot taken
+// before the segment format has none: then the prefix is nil, and the bytes
+// read are returned to be read again as records.
+func readSnapshotPrefix(r io.Reader) (*snapshotPrefix, []byte, error) {
+	b := make([]byte, snapshotPrefixWidth)
+	n, err := io.ReadFull(r, b)
+	if n < len(snapshotMagic) || !bytes.Equal(b[:len(snapshotMagic)], snapshotMagic) {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+		return nil, b[:n], err
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if v := enc.Uint32(b[4:8]); v != snapshotVersion {
+		return nil, nil, fmt.Errorf(
+			"snapshot version %d is unsupported, expected %d",
+			v, snapshotVersion,
+		)
+	}
+
+	p := &snapshotPrefix{
+		nextOffset: enc.Uint64(b[8 : 8+lenWidth]),
+		cached:     make([]segmentHeader, enc.Uint64(b[8+lenWidth:])),
+	}
+	header := make([]byte, snapshotHeaderWidth)
+	for i := range p.cached {
+		if _, err = io.ReadFull(r, header); err != nil {
+			return nil, nil, err
+		}
+		p.cached[i] = decodeSegmentHeader(header)
+	}
+
+	return p, nil, nil
+}
+
+// segmentSnapshot is a view of the segment's persisted prefix. Segments are
+// append-only, so the prefix doesn't change while the snapshot is persisted.
+type segmentSnapshot struct {
+	segmentHeader
+	store *store
+	index *index
+}
+
+func (l *FSM) Snapshot() (raft.FSMSnapshot, error) {
+	return &snapshot{
+		segments: l.log.snapshotSegments(),
+		cache:    l.segmentCache,
+	}, nil
+}
+
+var _ raft.FSMSnapshot = (*snapshot)(nil)
+
+// snapshot ships the log's segment files whole, instead of re-encoding
+// every record, so both persisting and restoring it are plain file copies.
+// The sealed segments are linked into the segment cache once and only
+// referenced by the snapshot, which holds the active segment alone:
+//
+//	magic | version | next offset | count of cached segments |
+//	their headers | header | store | index of each segment in line
+//
+// The snapshot store opens the snapshots with the cached segments put in
+// line, so the snapshots restored and sent to the followers are whole.
+type snapshot struct {
+	segments []segmentSnapshot
+	cache    *segmentCache
+}
+
+func (s *snapshot) Persist(sink raft.SnapshotSink) error {
+	if err := s.persist(sink); err != nil {
+		_ = sink.Cancel()
+		return err
+	}
+
+	return sink.Close()
+}
+
+func (s *snapshot) persist(w io.Writer) error {
+	var cached []segmentSnapshot
+	inline := s.segments
+	if s.cache != nil && len(s.segments) > 1 {
+		cached = s.segments[:len(s.segments)-1]
+		inline = s.segments[len(s.segments)-1:]
+	}
+
+	prefix := snapshotPrefix{nextOffset: s.nextOffset()}
+	for _, seg := range cached {
+		if err := s.cache.put(seg); err != nil {
+			return err
+		}
+		prefix.cached = append(prefix.cached, seg.segmentHeader)
+	}
+	if _, err := w.Write(prefix.encode()); err != nil {
+		return err
+	}
+
+	for _, seg := range inline {
+		if _, err := w.Write(seg.encode()); err != nil {
+			return err
+		}
+		store := io.NewSectionReader(seg.store, 0, int64(seg.storeSize))
+		if _, err := io.Copy(w, store); err != nil {
+			return err
+		}
+		index := io.NewSectionReader(seg.index.file, 0, int64(seg.indexSize))
+		if _, err := io.Copy(w, index); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// nextOffset returns the offset next to the snapshot's last record.
+func (s *snapshot) nextOffset() uint64 {
+	last := s.segments[len(s.segments)-1]
+	return last.baseOffset + last.indexSize/endWidth
+}
+
+func (s *snapshot) Release() {}
+
+// Restore replaces the log with the segment files shipped in the snapshot,
+// opened with every segment in line. The snapshots taken before the segment
+// format are restored record by record.
+func (l *FSM) Restore(r io.ReadCloser) error {
+	defer r.Close()
+	prefix, read, err := readSnapshotPrefix(r)
+	if err != nil {
+		return err
+	}
+	switch {
+	case prefix == nil:
+		err = l.log.restoreRecords(io.MultiReader(bytes.NewReader(read), r))
+	case len(prefix.cached) != 0:
+		err = errors.New("snapshot references cached segments")
+	default:
+		err = l.log.install(r)
+	}
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.index = lastAppliedIndex(l.log)
+	return nil
+}
+
+// restoreLatest restores the latest snapshot on start, unless the log
+// reaches it already. The log persists the records it applies, so raft
+// doesn't restore the snapshot on every start, and the entries the log has
+// applied past the snapshot are skipped when raft replays them.
+func (l *FSM) restoreLatest(store raft.SnapshotStore) error {
+	snapshots, err := store.List()
+	if err != nil || len(snapshots) == 0 {
+		return err
+	}
+	meta, rc, err := store.Open(snapshots[0].ID)
+	if err != nil {
+		return err
+	}
+	prefix, read, err := readSnapshotPrefix(rc)
+	if err != nil {
+		_ = rc.Close()
+		return err
+	}
+
+	l.mu.Lock()
+	applied := l.index
+	l.mu.Unlock()
+	// the snapshots in the record stream format carry no offset, so only
+	// the raft index tells whether the log reaches them
+	if prefix != nil && l.log.nextOffset() >= prefix.nextOffset ||
+		prefix == nil && applied >= meta.Index {
+		return rc.Close()
+	}
+	if prefix != nil {
+		read = prefix.encode()
+	}
+
+	return l.Restore(&openedSnapshot{
+		Reader:  io.MultiReader(bytes.NewReader(read), rc),
+		closers: []io.Closer{rc},
+	})
+}
+
+// nextOffset returns the offset next to the log's last record.
+func (l *Log) nextOffset() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.activeSegment.nextOffset
+}
+
+// snapshotSegments returns the persisted prefixes of all the log's segments.
+func (l *Log) snapshotSegments() []segmentSnapshot {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	segments := make([]segmentSnapshot, len(l.segments))
+	for i, s := range l.segments {
+		segments[i] = segmentSnapshot{
+			segmentHeader: segmentHeader{
+				baseOffset: s.baseOffset,
+				storeSize:  s.store.size,
+				indexSize:  s.index.size,
+			},
+			store: s.store,
+			index: s.index,
+		}
+	}
+
+	return segments
+}
+
+// install removes the log's segments and writes the ones read from r
+// in their place, then opens the log over the new files.
+func (l *Log) install(r io.Reader) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.removeSegments(); err != nil {
+		return err
+	}
+
+	header := make([]byte, snapshotHeaderWidth)
+	for i := 0; ; i++ {
+		_, err := io.ReadFull(r, header)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		h := decodeSegmentHeader(header)
+		if i == 0 {
+			l.Config.Segment.InitialOffset = h.baseOffset
+		}
+		if err = installFile(
+			path.Join(l.Dir, fmt.Sprintf("%d%s", h.baseOffset, ".store")),
+			r,
+			int64(h.storeSize),
+		); err != nil {
+			return err
+		}
+		if err = installFile(
+			path.Join(l.Dir, fmt.Sprintf("%d%s", h.baseOffset, ".index")),
+			r,
+			int64(h.indexSize),
+		); err != nil {
+			return err
+		}
+	}
+
+	return l.setup()
+}
+
+// restoreRecords replaces the log with the records read from r, each
+// prefixed with its length.
+func (l *Log) restoreRecords(r io.Reader) error {
+	b := make([]byte, lenWidth)
+	var buf bytes.Buffer
+	for i := 0; ; i++ {
+		_, err := io.ReadFull(r, b)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		size := int64(enc.Uint64(b))
+		if _, err = io.CopyN(&buf, r, size); err != nil {
+			return err
+		}
+
+		record := &api.Record{}
+		if err = proto.Unmarshal(buf.Bytes(), record); err != nil {
+			return err
+		}
+		if i == 0 {
+			l.Config.Segment.InitialOffset = record.Offset
+			if err = l.Reset(); err != nil {
+				return err
+			}
+		}
+		if _, err = l.Append(record); err != nil {
+			return err
+		}
+
+		buf.Reset()
+	}
+	return nil
+}
+
+func installFile(name string, r io.Reader, size int64) error {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.CopyN(f, r, size); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
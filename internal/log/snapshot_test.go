@@ -0,0 +1,268 @@
+package log
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+
+	api "github.com/fedoroko/proglog/api/v1"
+)
+
+func TestSnapshot(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.Segment.InitialOffset = 4
+
+	src := newSnapshotTestLog(t, c)
+	for i := 0; i < 5; i++ {
+		_, err := src.Append(&api.Record{
+			Value:     []byte("hello world"),
+			RaftIndex: uint64(10 + i),
+		})
+		require.NoError(t, err)
+	}
+	require.True(t, len(src.segments) > 1)
+
+	snap, err := newFSM(src).Snapshot()
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, snap.(*snapshot).persist(&buf))
+
+	// records appended after the snapshot was taken aren't in it
+	_, err = src.Append(&api.Record{Value: []byte("not in snapshot")})
+	require.NoError(t, err)
+
+	dst := newSnapshotTestLog(t, Config{})
+	_, err = dst.Append(&api.Record{Value: []byte("stale")})
+	require.NoError(t, err)
+
+	fsm := newFSM(dst)
+	require.NoError(t, fsm.Restore(ioutil.NopCloser(&buf)))
+	require.Equal(t, uint64(14), fsm.index)
+
+	lowest, err := dst.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), lowest)
+	highest, err := dst.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(8), highest)
+
+	for off := lowest; off <= highest; off++ {
+		record, err := dst.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello world"), record.Value)
+		require.Equal(t, off, record.Offset)
+	}
+
+	off, err := dst.Append(&api.Record{Value: []byte("after restore")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(9), off)
+}
+
+func TestSnapshotRestoresRecordStream(t *testing.T) {
+	// the snapshots taken before the segment format are a stream of records,
+	// each prefixed with its length
+	var buf bytes.Buffer
+	for i := 0; i < 3; i++ {
+		b, err := proto.Marshal(&api.Record{
+			Value:     []byte("hello world"),
+			Offset:    uint64(4 + i),
+			RaftIndex: uint64(10 + i),
+		})
+		require.NoError(t, err)
+		size := make([]byte, lenWidth)
+		enc.PutUint64(size, uint64(len(b)))
+		buf.Write(size)
+		buf.Write(b)
+	}
+
+	dst := newSnapshotTestLog(t, Config{})
+	fsm := newFSM(dst)
+	require.NoError(t, fsm.Restore(ioutil.NopCloser(&buf)))
+	require.Equal(t, uint64(12), fsm.index)
+
+	lowest, err := dst.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), lowest)
+	highest, err := dst.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), highest)
+
+	// a newer version isn't read as records
+	b := snapshotPrefix{}.encode()
+	enc.PutUint32(b[4:8], snapshotVersion+1)
+	err = fsm.Restore(ioutil.NopCloser(bytes.NewReader(b)))
+	require.ErrorContains(t, err, "unsupported")
+}
+
+func TestSnapshotCachesSealedSegmentsOnce(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	src := newSnapshotTestLog(t, c)
+	append := func(n int) {
+		for i := 0; i < n; i++ {
+			_, err := src.Append(&api.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+		}
+	}
+	append(8)
+	require.True(t, len(src.segments) > 2)
+
+	dir, err := ioutil.TempDir("", "snapshot-store-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := newSnapshotStore(dir, 2)
+	require.NoError(t, err)
+	fsm := newFSM(src)
+	fsm.segmentCache = store.cache
+	persist := func(index uint64) *raft.SnapshotMeta {
+		snap, err := fsm.Snapshot()
+		require.NoError(t, err)
+		sink, err := store.Create(raft.SnapshotVersionMax, index, 1, raft.Configuration{}, 1, nil)
+		require.NoError(t, err)
+		require.NoError(t, snap.Persist(sink))
+		snapshots, err := store.List()
+		require.NoError(t, err)
+		return snapshots[0]
+	}
+	cached := func() map[string]time.Time {
+		entries, err := os.ReadDir(store.cache.dir)
+		require.NoError(t, err)
+		modified := make(map[string]time.Time)
+		for _, entry := range entries {
+			info, err := entry.Info()
+			require.NoError(t, err)
+			modified[entry.Name()] = info.ModTime()
+		}
+		return modified
+	}
+
+	persist(1)
+	first := cached()
+	// a store and an index file per sealed segment, linked rather than copied
+	require.Equal(t, 2*(len(src.segments)-1), len(first))
+	for _, s := range src.segments[:len(src.segments)-1] {
+		key := segmentHeader{baseOffset: s.baseOffset, storeSize: s.store.size}.key()
+		for name, cachedName := range map[string]string{
+			s.store.Name():      store.cache.path(key, ".store"),
+			s.index.file.Name(): store.cache.path(key, ".index"),
+		} {
+			segment, err := os.Stat(name)
+			require.NoError(t, err)
+			cached, err := os.Stat(cachedName)
+			require.NoError(t, err)
+			require.True(t, os.SameFile(segment, cached), cachedName)
+		}
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	append(5)
+	meta := persist(2)
+	second := cached()
+	for name, modified := range first {
+		require.Equal(t, modified, second[name], name)
+	}
+	require.True(t, len(second) > len(first))
+
+	// the snapshot holds the active segment in line, the sealed ones
+	// only referenced
+	active := src.activeSegment
+	sealed := int64(0)
+	for _, s := range src.segments[:len(src.segments)-1] {
+		sealed += int64(s.store.size + s.index.size)
+	}
+	inline := int64(active.store.size + active.index.size)
+	headers := int64(snapshotPrefixWidth + len(src.segments)*snapshotHeaderWidth)
+	require.Equal(t, inline+headers, meta.Size)
+
+	// opened, the snapshot is whole
+	meta, rc, err := store.Open(meta.ID)
+	require.NoError(t, err)
+	require.Equal(t, sealed+inline+headers, meta.Size)
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Equal(t, meta.Size, n)
+
+	dst := newSnapshotTestLog(t, Config{})
+	require.NoError(t, newFSM(dst).Restore(ioutil.NopCloser(&buf)))
+	highest, err := dst.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(12), highest)
+	for off := uint64(0); off <= highest; off++ {
+		record, err := dst.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello world"), record.Value)
+	}
+
+	// the segments no snapshot references anymore are pruned
+	require.NoError(t, src.TruncateBefore(src.activeSegment.baseOffset))
+	persist(3)
+	persist(4)
+	require.Equal(t, 0, len(cached()))
+}
+
+func TestSnapshotRestoresLatestOnlyIfLogIsBehind(t *testing.T) {
+	src := newSnapshotTestLog(t, Config{})
+	for i := 0; i < 3; i++ {
+		_, err := src.Append(&api.Record{
+			Value:     []byte("hello world"),
+			RaftIndex: uint64(10 + i),
+		})
+		require.NoError(t, err)
+	}
+
+	dir, err := ioutil.TempDir("", "snapshot-store-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := newSnapshotStore(dir, 1)
+	require.NoError(t, err)
+	snap, err := newFSM(src).Snapshot()
+	require.NoError(t, err)
+	// the index past the last record's is the election's no-op entry
+	sink, err := store.Create(raft.SnapshotVersionMax, 13, 1, raft.Configuration{}, 1, nil)
+	require.NoError(t, err)
+	require.NoError(t, snap.Persist(sink))
+
+	// the log reaches the snapshot, so its files are left as they are
+	name := src.activeSegment.store.Name()
+	before, err := os.Stat(name)
+	require.NoError(t, err)
+	require.NoError(t, newFSM(src).restoreLatest(store))
+	after, err := os.Stat(name)
+	require.NoError(t, err)
+	require.True(t, os.SameFile(before, after))
+
+	dst := newSnapshotTestLog(t, Config{})
+	fsm := newFSM(dst)
+	require.NoError(t, fsm.restoreLatest(store))
+	require.Equal(t, uint64(12), fsm.index)
+	highest, err := dst.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), highest)
+}
+
+func newSnapshotTestLog(t *testing.T, c Config) *Log {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "snapshot-test")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+
+	return l
+}
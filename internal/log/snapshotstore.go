@@ -0,0 +1,267 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/raft"
+)
+
+var _ raft.SnapshotStore = (*snapshotStore)(nil)
+
+// snapshotStore keeps the snapshots in a file snapshot store, and the
+// sealed segments they reference in the segment cache.
+type snapshotStore struct {
+	*raft.FileSnapshotStore
+	cache *segmentCache
+}
+
+func newSnapshotStore(dir string, retain int) (*snapshotStore, error) {
+	files, err := raft.NewFileSnapshotStore(dir, retain, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	cache, err := newSegmentCache(filepath.Join(dir, "segments"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &snapshotStore{FileSnapshotStore: files, cache: cache}, nil
+}
+
+func (s *snapshotStore) Create(
+	version raft.SnapshotVersion,
+	index, term uint64,
+	configuration raft.Configuration,
+	configurationIndex uint64,
+	trans raft.Transport,
+) (raft.SnapshotSink, error) {
+	sink, err := s.FileSnapshotStore.Create(
+		version, index, term, configuration, configurationIndex, trans,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &snapshotSink{SnapshotSink: sink, store: s}, nil
+}
+
+// Open opens the snapshot with the cached segments put in line, ahead of
+// the segments in line already. The snapshots taken before the segment
+// format are opened as they are.
+func (s *snapshotStore) Open(id string) (*raft.SnapshotMeta, io.ReadCloser, error) {
+	meta, rc, err := s.FileSnapshotStore.Open(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	prefix, read, err := readSnapshotPrefix(rc)
+	if err != nil {
+		_ = rc.Close()
+		return nil, nil, err
+	}
+	opened := &openedSnapshot{closers: []io.Closer{rc}}
+	if prefix == nil {
+		opened.Reader = io.MultiReader(bytes.NewReader(read), rc)
+		return meta, opened, nil
+	}
+
+	// the cached segments' files are all opened up front, so they're read
+	// whole even if a newer snapshot prunes them meanwhile
+	inline := snapshotPrefix{nextOffset: prefix.nextOffset}
+	readers := []io.Reader{bytes.NewReader(inline.encode())}
+	for _, header := range prefix.cached {
+		r, err := s.cache.open(header, opened)
+		if err != nil {
+			_ = opened.Close()
+			return nil, nil, err
+		}
+		readers = append(readers, r)
+		meta.Size += int64(header.storeSize + header.indexSize)
+	}
+	opened.Reader = io.MultiReader(append(readers, rc)...)
+
+	return meta, opened, nil
+}
+
+// prune removes the cached segments that no snapshot references anymore.
+func (s *snapshotStore) prune() error {
+	snapshots, err := s.List()
+	if err != nil {
+		return err
+	}
+
+	keep := make(map[string]bool)
+	for _, meta := range snapshots {
+		_, rc, err := s.FileSnapshotStore.Open(meta.ID)
+		if err != nil {
+			return err
+		}
+		prefix, _, err := readSnapshotPrefix(rc)
+		_ = rc.Close()
+		if err != nil {
+			return err
+		}
+		if prefix == nil {
+			continue
+		}
+		for _, header := range prefix.cached {
+			keep[header.key()] = true
+		}
+	}
+
+	return s.cache.prune(keep)
+}
+
+// snapshotSink prunes the segment cache once the snapshot is persisted,
+// and the snapshots past the retained ones reaped.
+type snapshotSink struct {
+	raft.SnapshotSink
+	store *snapshotStore
+}
+
+func (s *snapshotSink) Close() error {
+	if err := s.SnapshotSink.Close(); err != nil {
+		return err
+	}
+
+	return s.store.prune()
+}
+
+type openedSnapshot struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (s *openedSnapshot) Close() error {
+	var err error
+	for _, c := range s.closers {
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// key identifies the segment's link in the cache. The log removes sealed
+// segments whole and never truncates them, so a link keeps the segment's
+// contents as they were cached.
+func (h segmentHeader) key() string {
+	return fmt.Sprintf("%d-%d", h.baseOffset, h.storeSize)
+}
+
+// segmentCache keeps links to the sealed segments the snapshots reference,
+// so each segment is linked once rather than copied on every snapshot.
+type segmentCache struct {
+	dir string
+}
+
+func newSegmentCache(dir string) (*segmentCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &segmentCache{dir: dir}, nil
+}
+
+func (c *segmentCache) path(key, ext string) string {
+	return filepath.Join(c.dir, key+ext)
+}
+
+// put links the segment into the cache, unless it's there already. The
+// sealed segments don't change in place, so the links share their files. The
+// store file is linked into place last, so it's there only if the index file
+// is.
+func (c *segmentCache) put(seg segmentSnapshot) error {
+	key := seg.key()
+	storePath := c.path(key, ".store")
+	if _, err := os.Stat(storePath); err == nil {
+		return nil
+	}
+
+	// the links share the segment's files, so they're written out first
+	if err := seg.index.Sync(); err != nil {
+		return err
+	}
+	if err := seg.store.Sync(); err != nil {
+		return err
+	}
+	if err := link(
+		seg.index.Name(),
+		c.path(key, ".index"),
+		io.NewSectionReader(seg.index.file, 0, int64(seg.indexSize)),
+		int64(seg.indexSize),
+	); err != nil {
+		return err
+	}
+	if err := link(
+		seg.store.Name(),
+		storePath+".tmp",
+		io.NewSectionReader(seg.store, 0, int64(seg.storeSize)),
+		int64(seg.storeSize),
+	); err != nil {
+		return err
+	}
+
+	return os.Rename(storePath+".tmp", storePath)
+}
+
+// link hard-links the file into the cache, or copies its prefix read from r
+// if it can't, as across file systems.
+func link(src, dst string, r io.Reader, size int64) error {
+	// a file left by a failed put may be a link, so it's removed rather than
+	// written over
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	return installFile(dst, r, size)
+}
+
+// open returns the reader of the cached segment, in line with its header.
+// The files opened are added to the snapshot's to close.
+func (c *segmentCache) open(h segmentHeader, opened *openedSnapshot) (io.Reader, error) {
+	store, err := os.Open(c.path(h.key(), ".store"))
+	if err != nil {
+		return nil, err
+	}
+	opened.closers = append(opened.closers, store)
+	index, err := os.Open(c.path(h.key(), ".index"))
+	if err != nil {
+		return nil, err
+	}
+	opened.closers = append(opened.closers, index)
+
+	return io.MultiReader(
+		bytes.NewReader(h.encode()),
+		io.NewSectionReader(store, 0, int64(h.storeSize)),
+		io.NewSectionReader(index, 0, int64(h.indexSize)),
+	), nil
+}
+
+// prune removes the cached segments but those kept.
+func (c *segmentCache) prune(keep map[string]bool) error {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		// the links left half done are removed too
+		name := entry.Name()
+		ext := filepath.Ext(name)
+		if ext != ".tmp" && keep[strings.TrimSuffix(name, ext)] {
+			continue
+		}
+		if err = os.Remove(filepath.Join(c.dir, name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
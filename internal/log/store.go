@@ -86,6 +86,32 @@ func (store *store) ReadAt(p []byte, offset int64) (int, error) {
 	return store.File.ReadAt(p, offset)
 }
 
+// Sync flushes the buffered records and commits the file to stable storage.
+func (store *store) Sync() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err := store.buf.Flush(); err != nil {
+		return err
+	}
+
+	return store.File.Sync()
+}
+
+// Truncate drops everything written after the size
+func (store *store) Truncate(size uint64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err := store.buf.Flush(); err != nil {
+		return err
+	}
+	if err := store.File.Truncate(int64(size)); err != nil {
+		return err
+	}
+
+	store.size = size
+	return nil
+}
+
 func (store *store) Close() error {
 	store.mu.Lock()
 	defer store.mu.Unlock()
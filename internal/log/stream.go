@@ -0,0 +1,477 @@
+package log
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
+)
+
+var _ raft.StreamLayer = (*StreamLayer)(nil)
+
+// StreamLayer connects the servers of a raft group. The stream layers of
+// several groups share a listener, each connection starting with
+// a preamble that names its group and the server dialing. With TLS,
+// the preamble is sent once the handshake is done.
+type StreamLayer struct {
+	mux             *streamMux
+	group           uint32
+	conns           chan net.Conn
+	closed          chan struct{}
+	closeOnce       sync.Once
+	serverTLSConfig *tls.Config
+	peerTLSConfig   *tls.Config
+
+	// servers returns the raft configuration the peers are verified
+	// against. It's set once raft is up if peer verification is enabled.
+	mu      sync.RWMutex
+	localID raft.ServerID
+	verify  bool
+	servers func() []raft.Server
+}
+
+// NewStreamLayer returns the stream layer of the group 0 on the listener.
+// The other groups' stream layers are made with Group.
+func NewStreamLayer(ln net.Listener, serverTLSConfig, peerTLSConfig *tls.Config) *StreamLayer {
+	mux := &streamMux{
+		ln:        ln,
+		tlsConfig: serverTLSConfig,
+		logger:    zap.L().Named("stream"),
+		groups:    make(map[uint32]*StreamLayer),
+		done:      make(chan struct{}),
+	}
+	s, _ := mux.register(0, serverTLSConfig, peerTLSConfig)
+	return s
+}
+
+// Group returns the stream layer of another raft group,
+// sharing the listener and the TLS configs with this one.
+func (s *StreamLayer) Group(id uint32) (*StreamLayer, error) {
+	return s.mux.register(id, s.serverTLSConfig, s.peerTLSConfig)
+}
+
+// RaftRPC is the first byte of a raft connection's preamble.
+const RaftRPC = 1
+
+// raftProto is the ALPN protocol the raft connections negotiate over TLS,
+// which tells them from the gRPC ones on a shared port, as their
+// preambles are sent through TLS.
+const raftProto = "proglog-raft"
+
+// recordTypeHandshake is the first byte of a TLS connection.
+const recordTypeHandshake = 0x16
+
+// preambleWidth is a width of the raft connection's preamble:
+// the RaftRPC byte, the group ID and the length of the dialing server's ID,
+// followed by the ID.
+const preambleWidth = 1 + 4 + 2
+
+// MatchRaftRPC reports whether the connection is a raft one, to tell them
+// from the other connections on a shared port: in the clear it starts with
+// the RaftRPC byte, and over TLS it negotiates the raft protocol.
+func MatchRaftRPC(r io.Reader) bool {
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return false
+	}
+	switch b[0] {
+	case RaftRPC:
+		return true
+	case recordTypeHandshake:
+	default:
+		return false
+	}
+
+	// the client hello is read by a TLS server that stops right after
+	var protos []string
+	hello := &helloConn{Reader: io.MultiReader(bytes.NewReader(b), r)}
+	_ = tls.Server(hello, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			protos = info.SupportedProtos
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	for _, proto := range protos {
+		if proto == raftProto {
+			return true
+		}
+	}
+
+	return false
+}
+
+var errHelloRead = errors.New("client hello read")
+
+// helloConn is a connection read only, for a TLS server to read
+// the client hello from. What the server writes is dropped.
+type helloConn struct {
+	io.Reader
+}
+
+func (c *helloConn) Write(b []byte) (int, error)      { return len(b), nil }
+func (c *helloConn) Close() error                     { return nil }
+func (c *helloConn) LocalAddr() net.Addr              { return nil }
+func (c *helloConn) RemoteAddr() net.Addr             { return nil }
+func (c *helloConn) SetDeadline(time.Time) error      { return nil }
+func (c *helloConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *helloConn) SetWriteDeadline(time.Time) error { return nil }
+
+func (s *StreamLayer) Dial(addr raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn, err = dialer.Dial("tcp", string(addr))
+	if err != nil {
+		return nil, err
+	}
+
+	if s.peerTLSConfig != nil {
+		config := s.peerTLSConfig.Clone()
+		config.NextProtos = []string{raftProto}
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			return s.verifyServer(addr, state)
+		}
+		tlsConn := tls.Client(conn, config)
+		if err = tlsConn.SetDeadline(time.Now().Add(timeout)); err == nil {
+			err = tlsConn.Handshake()
+		}
+		if err == nil {
+			err = tlsConn.SetDeadline(time.Time{})
+		}
+		if err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("failed to connect to peer at %s: %w", addr, err)
+		}
+		conn = tlsConn
+	}
+
+	if _, err = conn.Write(s.preamble()); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (s *StreamLayer) preamble() []byte {
+	s.mu.RLock()
+	id := s.localID
+	s.mu.RUnlock()
+
+	preamble := make([]byte, preambleWidth+len(id))
+	preamble[0] = RaftRPC
+	enc.PutUint32(preamble[1:5], s.group)
+	enc.PutUint16(preamble[5:preambleWidth], uint16(len(id)))
+	copy(preamble[preambleWidth:], id)
+	return preamble
+}
+
+func (s *StreamLayer) Accept() (net.Conn, error) {
+	s.mux.serve()
+	var conn net.Conn
+	select {
+	case conn = <-s.conns:
+	case <-s.closed:
+		return nil, net.ErrClosed
+	case <-s.mux.done:
+		return nil, s.mux.err
+	}
+
+	return conn, nil
+}
+
+// setLocalID sets the ID of the raft server, which the stream layer
+// connects to its peers as.
+func (s *StreamLayer) setLocalID(id raft.ServerID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.localID = id
+}
+
+// verifyPeers makes the stream layer reject the peers whose certificates
+// don't name the raft server they connect as. Until setServers is called
+// all the peers are rejected.
+func (s *StreamLayer) verifyPeers() error {
+	if s.serverTLSConfig == nil || s.peerTLSConfig == nil {
+		return fmt.Errorf("verifying peers requires both server and peer TLS configs")
+	}
+	if s.serverTLSConfig.ClientAuth < tls.RequireAndVerifyClientCert {
+		return fmt.Errorf("verifying peers requires the server TLS config to verify client certificates")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.verify = true
+	return nil
+}
+
+func (s *StreamLayer) setServers(servers func() []raft.Server) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.servers = servers
+}
+
+func (s *StreamLayer) configuration() (servers []raft.Server, verify bool, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.verify {
+		return nil, false, nil
+	}
+	if s.servers == nil {
+		return nil, true, fmt.Errorf("raft isn't running yet")
+	}
+
+	return s.servers(), true, nil
+}
+
+// verifyServer checks that the server at the address presents
+// the certificate of the raft server configured at it.
+func (s *StreamLayer) verifyServer(addr raft.ServerAddress, state tls.ConnectionState) error {
+	servers, verify, err := s.configuration()
+	if !verify || err != nil {
+		return err
+	}
+
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("peer at %s presented no certificate", addr)
+	}
+	names := certificateNames(state.PeerCertificates[0])
+	for _, server := range servers {
+		if server.Address != addr {
+			continue
+		}
+		if !names[string(server.ID)] {
+			return fmt.Errorf(
+				"peer at %s presented a certificate for %v, not for raft server %q",
+				addr, keys(names), server.ID,
+			)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown peer at %s", addr)
+}
+
+// verifyClient checks that the connecting peer presents the certificate
+// of the raft server it connects as, and that the server is configured.
+// A server with no configuration yet is waiting to be joined, so it
+// accepts any server with its certificate.
+func (s *StreamLayer) verifyClient(id raft.ServerID, state tls.ConnectionState) error {
+	servers, verify, err := s.configuration()
+	if !verify || err != nil {
+		return err
+	}
+
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("peer connecting as raft server %q presented no certificate", id)
+	}
+	names := certificateNames(state.PeerCertificates[0])
+	if !names[string(id)] {
+		return fmt.Errorf(
+			"peer presented a certificate for %v, not for raft server %q",
+			keys(names), id,
+		)
+	}
+	if len(servers) == 0 {
+		return nil
+	}
+	for _, server := range servers {
+		if server.ID == id {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown raft server %q", id)
+}
+
+// certificateNames returns the names a certificate is issued for,
+// its common name and its DNS SANs.
+func certificateNames(cert *x509.Certificate) map[string]bool {
+	names := map[string]bool{cert.Subject.CommonName: true}
+	for _, name := range cert.DNSNames {
+		names[name] = true
+	}
+
+	return names
+}
+
+// verifyCertificate checks that the local certificate in the config
+// names the local raft server, so the peers will accept it.
+func verifyCertificate(config *tls.Config, id raft.ServerID) error {
+	if len(config.Certificates) == 0 {
+		return fmt.Errorf("no certificate for raft server %q", id)
+	}
+	cert, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	if err != nil {
+		return err
+	}
+	names := certificateNames(cert)
+	if !names[string(id)] {
+		return fmt.Errorf(
+			"certificate for %v doesn't name raft server %q",
+			keys(names), id,
+		)
+	}
+
+	return nil
+}
+
+func keys(m map[string]bool) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Close stops the group's stream layer. The listener is closed
+// along with the last group's stream layer.
+func (s *StreamLayer) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+	return s.mux.deregister(s.group)
+}
+
+func (s *StreamLayer) Addr() net.Addr {
+	return s.mux.ln.Addr()
+}
+
+// streamMux accepts the raft connections on the listener
+// and hands each one over to the stream layer of its group.
+type streamMux struct {
+	ln        net.Listener
+	tlsConfig *tls.Config
+	logger    *zap.Logger
+	serveOnce sync.Once
+	done      chan struct{}
+	err       error
+
+	mu     sync.Mutex
+	groups map[uint32]*StreamLayer
+}
+
+func (m *streamMux) register(id uint32, serverTLSConfig, peerTLSConfig *tls.Config) (*StreamLayer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.groups[id]; ok {
+		return nil, fmt.Errorf("stream layer of group %d already exists", id)
+	}
+
+	s := &StreamLayer{
+		mux:             m,
+		group:           id,
+		conns:           make(chan net.Conn),
+		closed:          make(chan struct{}),
+		serverTLSConfig: serverTLSConfig,
+		peerTLSConfig:   peerTLSConfig,
+	}
+	m.groups[id] = s
+	return s, nil
+}
+
+func (m *streamMux) deregister(id uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.groups[id]; !ok {
+		return nil
+	}
+
+	delete(m.groups, id)
+	if len(m.groups) == 0 {
+		return m.ln.Close()
+	}
+	return nil
+}
+
+// serve starts accepting the connections, once,
+// until the listener is closed.
+func (m *streamMux) serve() {
+	m.serveOnce.Do(func() {
+		go func() {
+			defer close(m.done)
+			for {
+				conn, err := m.ln.Accept()
+				if err != nil {
+					m.err = err
+					return
+				}
+				go m.handle(conn)
+			}
+		}()
+	})
+}
+
+// handle reads the connection's preamble, through TLS if there's TLS,
+// and passes the connection on to its group once the peer is verified.
+func (m *streamMux) handle(conn net.Conn) {
+	var tlsConn *tls.Conn
+	if m.tlsConfig != nil {
+		config := m.tlsConfig.Clone()
+		config.NextProtos = []string{raftProto}
+		tlsConn = tls.Server(conn, config)
+		conn = tlsConn
+	}
+
+	preamble := make([]byte, preambleWidth)
+	var id []byte
+	err := conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err == nil {
+		_, err = io.ReadFull(conn, preamble)
+	}
+	if err == nil && preamble[0] != RaftRPC {
+		err = fmt.Errorf("not a raft connection")
+	}
+	if err == nil {
+		id = make([]byte, enc.Uint16(preamble[5:preambleWidth]))
+		_, err = io.ReadFull(conn, id)
+	}
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		m.reject(conn, string(id), fmt.Errorf("failed to read preamble: %w", err))
+		return
+	}
+
+	group := enc.Uint32(preamble[1:5])
+	m.mu.Lock()
+	s, ok := m.groups[group]
+	m.mu.Unlock()
+	if !ok {
+		m.reject(conn, string(id), fmt.Errorf("unknown group: %d", group))
+		return
+	}
+	if tlsConn != nil {
+		err = s.verifyClient(raft.ServerID(id), tlsConn.ConnectionState())
+		if err != nil {
+			m.reject(conn, string(id), err)
+			return
+		}
+	}
+
+	select {
+	case s.conns <- conn:
+	case <-s.closed:
+		_ = conn.Close()
+	}
+}
+
+// reject closes the connection of the peer, logging why.
+func (m *streamMux) reject(conn net.Conn, id string, err error) {
+	m.logger.Warn(
+		"rejected peer",
+		zap.Error(err),
+		zap.Stringer("addr", conn.RemoteAddr()),
+		zap.String("id", id),
+	)
+	_ = conn.Close()
+}
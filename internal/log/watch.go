@@ -0,0 +1,107 @@
+package log
+
+import (
+	"sync"
+
+	"github.com/hashicorp/raft"
+)
+
+// serverWatchers signal the changes of the servers to their watchers.
+// Each watcher's channel holds a single pending signal, so the changes
+// made while a watcher is busy coalesce into one.
+type serverWatchers struct {
+	mu       sync.Mutex
+	watchers map[chan struct{}]struct{}
+	closed   bool
+}
+
+func (w *serverWatchers) watch() (<-chan struct{}, func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ch := make(chan struct{}, 1)
+	if w.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	if w.watchers == nil {
+		w.watchers = make(map[chan struct{}]struct{})
+	}
+	w.watchers[ch] = struct{}{}
+
+	return ch, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if _, ok := w.watchers[ch]; ok {
+			delete(w.watchers, ch)
+			close(ch)
+		}
+	}
+}
+
+func (w *serverWatchers) notify() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for ch := range w.watchers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// close ends the watches.
+func (w *serverWatchers) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	for ch := range w.watchers {
+		delete(w.watchers, ch)
+		close(ch)
+	}
+}
+
+// WatchServers returns a channel signalled whenever the servers change:
+// the leadership, or the configuration. The signal carries no servers,
+// the watcher gets them with GetServers. It also returns a func to stop
+// watching; the channel is closed once the watch ends.
+func (l *DistributedLog) WatchServers() (<-chan struct{}, func()) {
+	return l.watchers.watch()
+}
+
+// observe has raft report the changes of the leadership and of the
+// peers. Only the leader observes its peers, the followers learn of the
+// configuration changes as they're committed, from the FSM.
+func (l *DistributedLog) observe() {
+	l.observations = make(chan raft.Observation, 16)
+	l.observer = raft.NewObserver(l.observations, false, func(o *raft.Observation) bool {
+		switch o.Data.(type) {
+		case raft.LeaderObservation, raft.PeerObservation:
+			return true
+		}
+		return false
+	})
+	l.raft.RegisterObserver(l.observer)
+
+	go func() {
+		for range l.observations {
+			l.watchers.notify()
+		}
+	}()
+}
+
+// stopObserving ends the observation, and the watches along with it.
+func (l *DistributedLog) stopObserving() {
+	l.stopObserver.Do(func() {
+		l.raft.DeregisterObserver(l.observer)
+		close(l.observations)
+		l.watchers.close()
+	})
+}
+
+// StoreConfiguration has raft tell the FSM of the configurations as
+// they're committed, on every server.
+func (l *FSM) StoreConfiguration(index uint64, configuration raft.Configuration) {
+	if l.onConfiguration != nil {
+		l.onConfiguration()
+	}
+}
@@ -0,0 +1,59 @@
+package mirror
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// checkpoint is the next record to mirror: its offset in the source and
+// the offset it's to get in the target.
+type checkpoint struct {
+	Source uint64 `json:"source_offset"`
+	Target uint64 `json:"target_offset"`
+}
+
+// loadCheckpoint reads the checkpoint from the file. Without one, the
+// mirror starts at the offset, into an empty target.
+func loadCheckpoint(path string, offset uint64) (checkpoint, error) {
+	cp := checkpoint{Source: offset}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cp, nil
+	}
+	if err != nil {
+		return cp, err
+	}
+
+	err = json.Unmarshal(b, &cp)
+	return cp, err
+}
+
+// save replaces the checkpoint file through a rename, so a crash leaves
+// either the old checkpoint or the new one.
+func (cp checkpoint) save(path string) error {
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err = f.Write(b); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,278 @@
+package mirror
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	api "github.com/fedoroko/proglog/api/v1"
+	"github.com/fedoroko/proglog/internal/loadbalance"
+)
+
+// SourceOffsetKey is the metadata key of the offset a mirrored record has
+// in the source cluster.
+const SourceOffsetKey = "mirror.source_offset"
+
+// Mirror continuously copies the log of a source cluster to a target
+// cluster, e.g. a primary's log to its DR cluster. The target is expected
+// to be written by the mirror only, so its offsets follow the source's
+// one to one, and the mirror checks they do.
+type Mirror struct {
+	Config
+	source api.LogClient
+	target api.LogClient
+	conns  []*grpc.ClientConn
+	logger *zap.Logger
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type Config struct {
+	// SourceAddr and TargetAddr are the RPC addresses of a server in
+	// each cluster, the rest are resolved through them.
+	SourceAddr string
+	TargetAddr string
+	// TLSConfig is the client's TLS config for both clusters, which are
+	// dialed without TLS if it's nil.
+	TLSConfig *tls.Config
+	// CheckpointFile keeps the mirror's progress across restarts.
+	CheckpointFile string
+	// StartOffset is the source offset to mirror from when there's no
+	// checkpoint yet.
+	StartOffset uint64
+	// RetryInterval is how long the mirror waits to reconnect after
+	// a failure, 1 second by default.
+	RetryInterval time.Duration
+}
+
+// New starts mirroring from where the checkpoint left off.
+func New(config Config) (*Mirror, error) {
+	if config.RetryInterval == 0 {
+		config.RetryInterval = time.Second
+	}
+	m := &Mirror{
+		Config: config,
+		logger: zap.L().Named("mirror"),
+		done:   make(chan struct{}),
+	}
+
+	sourceConn, err := m.dial(fmt.Sprintf("%s:///%s", loadbalance.Name, config.SourceAddr))
+	if err != nil {
+		return nil, err
+	}
+	targetConn, err := m.dial(fmt.Sprintf("%s:///%s", loadbalance.Name, config.TargetAddr))
+	if err != nil {
+		_ = m.closeConns()
+		return nil, err
+	}
+	m.source = api.NewLogClient(sourceConn)
+	m.target = api.NewLogClient(targetConn)
+
+	var ctx context.Context
+	ctx, m.cancel = context.WithCancel(context.Background())
+	go m.run(ctx)
+	return m, nil
+}
+
+func (m *Mirror) dial(target string) (*grpc.ClientConn, error) {
+	conn, err := grpc.Dial(target, m.dialOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	m.conns = append(m.conns, conn)
+	return conn, nil
+}
+
+func (m *Mirror) dialOptions() []grpc.DialOption {
+	creds := insecure.NewCredentials()
+	if m.TLSConfig != nil {
+		creds = credentials.NewTLS(m.TLSConfig)
+	}
+	return []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+}
+
+func (m *Mirror) run(ctx context.Context) {
+	defer close(m.done)
+	for {
+		err := m.mirror(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		m.logger.Error("failed to mirror", zap.Error(err))
+
+		select {
+		case <-time.After(m.RetryInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// mirror streams the source's records from the checkpoint on, and produces
+// each to the target before moving the checkpoint past it.
+func (m *Mirror) mirror(ctx context.Context) error {
+	cp, err := m.recover(ctx)
+	if err != nil {
+		return err
+	}
+
+	stream, err := m.source.ConsumeStream(ctx, &api.ConsumeRequest{Offset: cp.Source})
+	if err != nil {
+		return err
+	}
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if res.Record.Offset != cp.Source {
+			return fmt.Errorf("source sent offset %d, expected %d", res.Record.Offset, cp.Source)
+		}
+
+		produced, err := m.target.Produce(ctx, &api.ProduceRequest{
+			Record: mirrored(res.Record),
+		})
+		if err != nil {
+			return err
+		}
+		if produced.Offset != cp.Target {
+			return fmt.Errorf(
+				"target wrote offset %d, expected %d: is another producer writing to it?",
+				produced.Offset, cp.Target,
+			)
+		}
+
+		cp.Source++
+		cp.Target++
+		if err = cp.save(m.CheckpointFile); err != nil {
+			return err
+		}
+	}
+}
+
+// recover loads the checkpoint and moves it past the records the target
+// already has. A crash or a lost produce response leaves the checkpoint
+// behind the target, and mirroring those records again would duplicate
+// them. A newly elected leader may not have applied all the records
+// committed yet, so the records are read once it has, past a barrier.
+func (m *Mirror) recover(ctx context.Context) (checkpoint, error) {
+	cp, err := loadCheckpoint(m.CheckpointFile, m.StartOffset)
+	if err != nil {
+		return cp, err
+	}
+
+	// a follower may not have the latest records yet, so they're read
+	// from the leader
+	leader, err := m.targetLeader(ctx)
+	if err != nil {
+		return cp, err
+	}
+	defer leader.Close()
+	if _, err = api.NewAdminClient(leader).Barrier(ctx, &api.BarrierRequest{}); err != nil {
+		return cp, err
+	}
+
+	client := api.NewLogClient(leader)
+	recovered := false
+	for {
+		res, err := client.Consume(ctx, &api.ConsumeRequest{Offset: cp.Target})
+		if status.Code(err) == codes.NotFound {
+			break
+		}
+		if err != nil {
+			return cp, err
+		}
+		if res.Record.Metadata[SourceOffsetKey] != strconv.FormatUint(cp.Source, 10) {
+			return cp, fmt.Errorf(
+				"target offset %d isn't the mirror of source offset %d",
+				cp.Target, cp.Source,
+			)
+		}
+		cp.Source++
+		cp.Target++
+		recovered = true
+	}
+	if recovered {
+		m.logger.Info(
+			"recovered checkpoint from the target",
+			zap.Uint64("source_offset", cp.Source),
+			zap.Uint64("target_offset", cp.Target),
+		)
+		if err = cp.save(m.CheckpointFile); err != nil {
+			return cp, err
+		}
+	}
+
+	return cp, nil
+}
+
+// targetLeader dials the target cluster's leader.
+func (m *Mirror) targetLeader(ctx context.Context) (*grpc.ClientConn, error) {
+	opts := m.dialOptions()
+	conn, err := grpc.DialContext(ctx, m.TargetAddr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	res, err := api.NewLogClient(conn).GetServers(ctx, &api.GetServersRequest{})
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	for _, server := range res.Servers {
+		if !server.IsLeader {
+			continue
+		}
+		if server.RpcAddr == m.TargetAddr {
+			return conn, nil
+		}
+		_ = conn.Close()
+		return grpc.DialContext(ctx, server.RpcAddr, opts...)
+	}
+	_ = conn.Close()
+
+	return nil, fmt.Errorf("target cluster has no leader")
+}
+
+// mirrored returns the record to produce to the target for the source's
+// record.
+func mirrored(record *api.Record) *api.Record {
+	metadata := make(map[string]string, len(record.Metadata)+1)
+	for k, v := range record.Metadata {
+		metadata[k] = v
+	}
+	metadata[SourceOffsetKey] = strconv.FormatUint(record.Offset, 10)
+
+	return &api.Record{
+		Value:    record.Value,
+		Metadata: metadata,
+	}
+}
+
+// Close stops mirroring. The checkpoint stays where the last mirrored
+// record left it.
+func (m *Mirror) Close() error {
+	m.cancel()
+	<-m.done
+	return m.closeConns()
+}
+
+func (m *Mirror) closeConns() error {
+	for _, conn := range m.conns {
+		if err := conn.Close(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
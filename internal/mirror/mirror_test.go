@@ -0,0 +1,141 @@
+package mirror_test
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/go-dynaport"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	api "github.com/fedoroko/proglog/api/v1"
+	"github.com/fedoroko/proglog/internal/agent"
+	"github.com/fedoroko/proglog/internal/config"
+	"github.com/fedoroko/proglog/internal/mirror"
+)
+
+func TestMirror(t *testing.T) {
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		Server:        true,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	clientTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	sourceAddr, source := setupCluster(t, serverTLSConfig, clientTLSConfig)
+	targetAddr, target := setupCluster(t, serverTLSConfig, clientTLSConfig)
+	ctx := context.Background()
+
+	produce := func(client api.LogClient, record *api.Record) {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: record})
+		require.NoError(t, err)
+	}
+	// waitFor waits for the target to have the mirror of the source's
+	// records up to the offset, each at the same offset as in the source.
+	waitFor := func(offset uint64) {
+		require.Eventually(t, func() bool {
+			_, err := target.Consume(ctx, &api.ConsumeRequest{Offset: offset})
+			return err == nil
+		}, 5*time.Second, 50*time.Millisecond)
+
+		for i := uint64(0); i <= offset; i++ {
+			res, err := target.Consume(ctx, &api.ConsumeRequest{Offset: i})
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("record-%d", i)), res.Record.Value)
+			require.Equal(t, strconv.FormatUint(i, 10), res.Record.Metadata[mirror.SourceOffsetKey])
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		produce(source, &api.Record{Value: []byte(fmt.Sprintf("record-%d", i))})
+	}
+
+	dir, err := ioutil.TempDir("", "mirror-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := mirror.Config{
+		SourceAddr:     sourceAddr,
+		TargetAddr:     targetAddr,
+		TLSConfig:      clientTLSConfig,
+		CheckpointFile: filepath.Join(dir, "checkpoint"),
+		RetryInterval:  100 * time.Millisecond,
+	}
+	m, err := mirror.New(c)
+	require.NoError(t, err)
+	defer m.Close()
+	waitFor(2)
+	require.NoError(t, m.Close())
+
+	// the source moves on while the mirror is down, and the next record
+	// made it to the target before a crash, without its checkpoint
+	for i := 3; i < 5; i++ {
+		produce(source, &api.Record{Value: []byte(fmt.Sprintf("record-%d", i))})
+	}
+	produce(target, &api.Record{
+		Value:    []byte("record-3"),
+		Metadata: map[string]string{mirror.SourceOffsetKey: "3"},
+	})
+
+	m, err = mirror.New(c)
+	require.NoError(t, err)
+	defer m.Close()
+	waitFor(4)
+
+	// and it keeps up with the source
+	produce(source, &api.Record{Value: []byte("record-5")})
+	waitFor(5)
+	time.Sleep(500 * time.Millisecond)
+	_, err = target.Consume(ctx, &api.ConsumeRequest{Offset: 6})
+	require.Error(t, err)
+}
+
+// setupCluster starts a single server cluster and returns its RPC address
+// with a client.
+func setupCluster(t *testing.T, serverTLSConfig, clientTLSConfig *tls.Config) (string, api.LogClient) {
+	t.Helper()
+	ports := dynaport.Get(2)
+	dataDir, err := ioutil.TempDir("", "mirror-test-log")
+	require.NoError(t, err)
+
+	a, err := agent.New(agent.Config{
+		Bootstrap:       true,
+		NodeName:        "0",
+		BindAddr:        fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		RPCPort:         ports[1],
+		DataDir:         dataDir,
+		ACLModelFile:    config.ACLModelFile,
+		ACLPolicyFile:   config.ACLPolicyFile,
+		ServerTLSConfig: serverTLSConfig,
+		PeerTLSConfig:   clientTLSConfig,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, a.Shutdown())
+		require.NoError(t, os.RemoveAll(dataDir))
+	})
+
+	addr, err := a.RPCAddr()
+	require.NoError(t, err)
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(credentials.NewTLS(clientTLSConfig)))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return addr, api.NewLogClient(conn)
+}
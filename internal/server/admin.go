@@ -0,0 +1,395 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/fedoroko/proglog/api/v1"
+)
+
+const (
+	transferLeadershipAction   = "transfer_leadership"
+	addVoterAction             = "add_voter"
+	addNonvoterAction          = "add_nonvoter"
+	removeServerAction         = "remove_server"
+	getRaftConfigurationAction = "get_raft_configuration"
+	getRaftStatsAction         = "get_raft_stats"
+	barrierAction              = "barrier"
+	getClusterHealthAction     = "get_cluster_health"
+	listMembersAction          = "list_members"
+	watchMembersAction         = "watch_members"
+	listKeysAction             = "list_keys"
+	installKeyAction           = "install_key"
+	useKeyAction               = "use_key"
+	removeKeyAction            = "remove_key"
+	fireEventAction            = "fire_event"
+	fireQueryAction            = "fire_query"
+	drainAction                = "drain"
+)
+
+var _ api.AdminServer = (*adminServer)(nil)
+
+// adminServer serves the cluster administration RPCs,
+// each one authorized as its own action.
+type adminServer struct {
+	api.UnimplementedAdminServer
+	*Config
+}
+
+func newAdminServer(config *Config) *adminServer {
+	return &adminServer{
+		Config: config,
+	}
+}
+
+func (s *adminServer) authorize(ctx context.Context, action string) error {
+	return s.Authorizer.Authorize(subject(ctx), objectWildcard, action)
+}
+
+// raftError maps the raft errors to their gRPC statuses: the calls made
+// on a follower fail with the leader's address, the calls raft couldn't
+// complete for now with Unavailable. The other errors are returned as is.
+func (s *adminServer) raftError(err error) error {
+	switch {
+	case errors.Is(err, raft.ErrNotLeader):
+		var leaderAddr string
+		if servers, e := s.Admin.GetServers(); e == nil {
+			for _, server := range servers {
+				if server.IsLeader {
+					leaderAddr = server.RpcAddr
+				}
+			}
+		}
+		return api.ErrNotLeader{LeaderAddr: leaderAddr}
+	case errors.Is(err, raft.ErrLeadershipLost),
+		errors.Is(err, raft.ErrLeadershipTransferInProgress),
+		errors.Is(err, raft.ErrEnqueueTimeout),
+		errors.Is(err, raft.ErrRaftShutdown):
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return err
+}
+
+func (s *adminServer) TransferLeadership(
+	ctx context.Context, req *api.TransferLeadershipRequest,
+) (*api.TransferLeadershipResponse, error) {
+	if err := s.authorize(ctx, transferLeadershipAction); err != nil {
+		return nil, err
+	}
+	if err := s.Admin.TransferLeadership(req.Id); err != nil {
+		return nil, s.raftError(err)
+	}
+
+	return &api.TransferLeadershipResponse{}, nil
+}
+
+func (s *adminServer) AddVoter(
+	ctx context.Context, req *api.AddServerRequest,
+) (*api.AddServerResponse, error) {
+	if err := s.authorize(ctx, addVoterAction); err != nil {
+		return nil, err
+	}
+	if err := s.Admin.Join(req.Id, req.RpcAddr, true); err != nil {
+		return nil, s.raftError(err)
+	}
+
+	return &api.AddServerResponse{}, nil
+}
+
+func (s *adminServer) AddNonvoter(
+	ctx context.Context, req *api.AddServerRequest,
+) (*api.AddServerResponse, error) {
+	if err := s.authorize(ctx, addNonvoterAction); err != nil {
+		return nil, err
+	}
+	if err := s.Admin.Join(req.Id, req.RpcAddr, false); err != nil {
+		return nil, s.raftError(err)
+	}
+
+	return &api.AddServerResponse{}, nil
+}
+
+func (s *adminServer) RemoveServer(
+	ctx context.Context, req *api.RemoveServerRequest,
+) (*api.RemoveServerResponse, error) {
+	if err := s.authorize(ctx, removeServerAction); err != nil {
+		return nil, err
+	}
+	if err := s.Admin.Leave(req.Id); err != nil {
+		return nil, s.raftError(err)
+	}
+
+	return &api.RemoveServerResponse{}, nil
+}
+
+func (s *adminServer) GetRaftConfiguration(
+	ctx context.Context, req *api.GetRaftConfigurationRequest,
+) (*api.GetRaftConfigurationResponse, error) {
+	if err := s.authorize(ctx, getRaftConfigurationAction); err != nil {
+		return nil, err
+	}
+	servers, err := s.Admin.GetServers()
+	if err != nil {
+		return nil, s.raftError(err)
+	}
+
+	return &api.GetRaftConfigurationResponse{Servers: servers}, nil
+}
+
+func (s *adminServer) GetRaftStats(
+	ctx context.Context, req *api.GetRaftStatsRequest,
+) (*api.GetRaftStatsResponse, error) {
+	if err := s.authorize(ctx, getRaftStatsAction); err != nil {
+		return nil, err
+	}
+	stats, err := s.Admin.RaftStats()
+	if err != nil {
+		return nil, s.raftError(err)
+	}
+
+	return &api.GetRaftStatsResponse{Stats: stats}, nil
+}
+
+func (s *adminServer) Barrier(
+	ctx context.Context, req *api.BarrierRequest,
+) (*api.BarrierResponse, error) {
+	if err := s.authorize(ctx, barrierAction); err != nil {
+		return nil, err
+	}
+	if err := s.Admin.Barrier(); err != nil {
+		return nil, s.raftError(err)
+	}
+
+	return &api.BarrierResponse{}, nil
+}
+
+func (s *adminServer) GetClusterHealth(
+	ctx context.Context, req *api.GetClusterHealthRequest,
+) (*api.GetClusterHealthResponse, error) {
+	if err := s.authorize(ctx, getClusterHealthAction); err != nil {
+		return nil, err
+	}
+	if s.Autopilot == nil {
+		return nil, status.Error(codes.Unimplemented, "autopilot is disabled")
+	}
+	health, err := s.Autopilot.ClusterHealth()
+	if err != nil {
+		return nil, s.raftError(err)
+	}
+
+	return &api.GetClusterHealthResponse{Health: health}, nil
+}
+
+func (s *adminServer) ListMembers(
+	ctx context.Context, req *api.ListMembersRequest,
+) (*api.ListMembersResponse, error) {
+	if err := s.authorize(ctx, listMembersAction); err != nil {
+		return nil, err
+	}
+	if s.Membership == nil {
+		return nil, status.Error(codes.Unimplemented, "membership is unavailable")
+	}
+	members, err := s.Membership.ListMembers()
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.ListMembersResponse{Members: members}, nil
+}
+
+func (s *adminServer) WatchMembers(
+	req *api.WatchMembersRequest, stream api.Admin_WatchMembersServer,
+) error {
+	ctx := stream.Context()
+	if err := s.authorize(ctx, watchMembersAction); err != nil {
+		return err
+	}
+	if s.Membership == nil {
+		return status.Error(codes.Unimplemented, "membership is unavailable")
+	}
+	events, err := s.Membership.WatchMembers(ctx)
+	if err != nil {
+		return err
+	}
+
+	for e := range events {
+		if err = stream.Send(e); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	// the watch fell behind or the server is shutting down,
+	// either way the client has to watch again
+	return status.Error(codes.Unavailable, "members watch ended")
+}
+
+func (s *adminServer) ListKeys(
+	ctx context.Context, req *api.ListKeysRequest,
+) (*api.KeyringResponse, error) {
+	if err := s.authorize(ctx, listKeysAction); err != nil {
+		return nil, err
+	}
+	if s.Keyring == nil {
+		return nil, status.Error(codes.Unimplemented, "keyring is unavailable")
+	}
+
+	return s.Keyring.ListKeys()
+}
+
+func (s *adminServer) InstallKey(
+	ctx context.Context, req *api.KeyRequest,
+) (*api.KeyringResponse, error) {
+	if err := s.authorize(ctx, installKeyAction); err != nil {
+		return nil, err
+	}
+	if s.Keyring == nil {
+		return nil, status.Error(codes.Unimplemented, "keyring is unavailable")
+	}
+
+	return s.Keyring.InstallKey(req.Key)
+}
+
+func (s *adminServer) UseKey(
+	ctx context.Context, req *api.KeyRequest,
+) (*api.KeyringResponse, error) {
+	if err := s.authorize(ctx, useKeyAction); err != nil {
+		return nil, err
+	}
+	if s.Keyring == nil {
+		return nil, status.Error(codes.Unimplemented, "keyring is unavailable")
+	}
+
+	return s.Keyring.UseKey(req.Key)
+}
+
+func (s *adminServer) RemoveKey(
+	ctx context.Context, req *api.KeyRequest,
+) (*api.KeyringResponse, error) {
+	if err := s.authorize(ctx, removeKeyAction); err != nil {
+		return nil, err
+	}
+	if s.Keyring == nil {
+		return nil, status.Error(codes.Unimplemented, "keyring is unavailable")
+	}
+
+	return s.Keyring.RemoveKey(req.Key)
+}
+
+func (s *adminServer) FireEvent(
+	ctx context.Context, req *api.FireEventRequest,
+) (*api.FireEventResponse, error) {
+	if err := s.authorize(ctx, fireEventAction); err != nil {
+		return nil, err
+	}
+	if s.Events == nil {
+		return nil, status.Error(codes.Unimplemented, "events are unavailable")
+	}
+	if req.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "event name is required")
+	}
+	if err := s.Events.FireEvent(req.Name, req.Payload); err != nil {
+		return nil, err
+	}
+
+	return &api.FireEventResponse{}, nil
+}
+
+func (s *adminServer) FireQuery(
+	ctx context.Context, req *api.FireQueryRequest,
+) (*api.FireQueryResponse, error) {
+	if err := s.authorize(ctx, fireQueryAction); err != nil {
+		return nil, err
+	}
+	if s.Events == nil {
+		return nil, status.Error(codes.Unimplemented, "events are unavailable")
+	}
+	if req.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "query name is required")
+	}
+	var timeout time.Duration
+	if req.Timeout != nil {
+		timeout = req.Timeout.AsDuration()
+	}
+	responses, err := s.Events.FireQuery(req.Name, req.Payload, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.FireQueryResponse{Responses: responses}, nil
+}
+
+func (s *adminServer) Drain(
+	ctx context.Context, req *api.DrainRequest,
+) (*api.DrainResponse, error) {
+	if err := s.authorize(ctx, drainAction); err != nil {
+		return nil, err
+	}
+	if s.Decommissioner == nil {
+		return nil, status.Error(codes.Unimplemented, "drain is unavailable")
+	}
+	var timeout time.Duration
+	if req.Timeout != nil {
+		timeout = req.Timeout.AsDuration()
+	}
+	if err := s.Decommissioner.Drain(timeout); err != nil {
+		return nil, err
+	}
+
+	return &api.DrainResponse{}, nil
+}
+
+type Admin interface {
+	TransferLeadership(id string) error
+	Join(id, addr string, voter bool) error
+	Leave(id string) error
+	GetServers() ([]*api.Server, error)
+	RaftStats() (*api.RaftStats, error)
+	// Barrier blocks until the leader has applied every entry committed
+	// before the call.
+	Barrier() error
+}
+
+// Autopilot reports the cluster's health, as seen by the leader.
+type Autopilot interface {
+	ClusterHealth() (*api.ClusterHealth, error)
+}
+
+// Membership lists the members of the cluster and their changes.
+type Membership interface {
+	ListMembers() ([]*api.Member, error)
+	// WatchMembers sends the members' changes until the context is done.
+	// The channel is closed once the watch ends.
+	WatchMembers(ctx context.Context) (<-chan *api.MemberEvent, error)
+}
+
+// Keyring manages the gossip encryption keys across the cluster.
+type Keyring interface {
+	ListKeys() (*api.KeyringResponse, error)
+	InstallKey(key string) (*api.KeyringResponse, error)
+	UseKey(key string) (*api.KeyringResponse, error)
+	RemoveKey(key string) (*api.KeyringResponse, error)
+}
+
+// Events broadcasts operational commands to every member of the cluster.
+type Events interface {
+	// FireEvent fires the event without waiting for the members.
+	FireEvent(name string, payload []byte) error
+	// FireQuery fires the query and collects the members' acks and
+	// answers until the timeout, the default one if zero.
+	FireQuery(name string, payload []byte, timeout time.Duration) ([]*api.MemberResponse, error)
+}
+
+// Decommissioner drains the server out of the cluster.
+type Decommissioner interface {
+	// Drain starts draining, giving the calls in flight the timeout, the
+	// default one if zero, to finish. It returns once the drain starts,
+	// as the server shuts down when it's done.
+	Drain(timeout time.Duration) error
+}
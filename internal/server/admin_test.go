@@ -0,0 +1,353 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	api "github.com/fedoroko/proglog/api/v1"
+	"github.com/fedoroko/proglog/internal/auth"
+	"github.com/fedoroko/proglog/internal/config"
+)
+
+func TestAdmin(t *testing.T) {
+	admin := &fakeAdmin{servers: map[string]bool{"0": true}}
+	rootClient, nobodyClient, teardown := setupAdminTest(t, admin)
+	defer teardown()
+	ctx := context.Background()
+
+	_, err := rootClient.AddVoter(ctx, &api.AddServerRequest{Id: "1", RpcAddr: "localhost:9001"})
+	require.NoError(t, err)
+	_, err = rootClient.AddNonvoter(ctx, &api.AddServerRequest{Id: "2", RpcAddr: "localhost:9002"})
+	require.NoError(t, err)
+	require.Equal(t, map[string]bool{"0": true, "1": true, "2": false}, admin.servers)
+
+	_, err = rootClient.RemoveServer(ctx, &api.RemoveServerRequest{Id: "2"})
+	require.NoError(t, err)
+	cfg, err := rootClient.GetRaftConfiguration(ctx, &api.GetRaftConfigurationRequest{})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(cfg.Servers))
+
+	_, err = rootClient.TransferLeadership(ctx, &api.TransferLeadershipRequest{Id: "1"})
+	require.NoError(t, err)
+	require.Equal(t, "1", admin.leader)
+
+	stats, err := rootClient.GetRaftStats(ctx, &api.GetRaftStatsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), stats.Stats.Term)
+	_, err = rootClient.Barrier(ctx, &api.BarrierRequest{})
+	require.NoError(t, err)
+	require.True(t, admin.barrier)
+
+	health, err := rootClient.GetClusterHealth(ctx, &api.GetClusterHealthRequest{})
+	require.NoError(t, err)
+	require.Equal(t, int32(1), health.Health.FailureTolerance)
+
+	_, err = nobodyClient.TransferLeadership(ctx, &api.TransferLeadershipRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = nobodyClient.RemoveServer(ctx, &api.RemoveServerRequest{Id: "1"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = nobodyClient.GetRaftStats(ctx, &api.GetRaftStatsRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = nobodyClient.Barrier(ctx, &api.BarrierRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = nobodyClient.GetClusterHealth(ctx, &api.GetClusterHealthRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = nobodyClient.ListMembers(ctx, &api.ListMembersRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	require.Equal(t, "1", admin.leader)
+
+	_, err = nobodyClient.Drain(ctx, &api.DrainRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = rootClient.Drain(ctx, &api.DrainRequest{Timeout: durationpb.New(time.Second)})
+	require.NoError(t, err)
+	require.Equal(t, time.Second, admin.drain)
+}
+
+func TestAdminNotLeader(t *testing.T) {
+	admin := &fakeAdmin{
+		servers:   map[string]bool{"0": true, "1": true},
+		leader:    "1",
+		notLeader: true,
+	}
+	rootClient, _, teardown := setupAdminTest(t, admin)
+	defer teardown()
+	ctx := context.Background()
+
+	_, err := rootClient.GetClusterHealth(ctx, &api.GetClusterHealthRequest{})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	require.Contains(t, status.Convert(err).Message(), "localhost:9001")
+
+	_, err = rootClient.GetRaftStats(ctx, &api.GetRaftStatsRequest{})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+
+	admin.leader = ""
+	_, err = rootClient.GetClusterHealth(ctx, &api.GetClusterHealthRequest{})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestAdminMembers(t *testing.T) {
+	admin := &fakeAdmin{servers: map[string]bool{"0": true}}
+	rootClient, nobodyClient, teardown := setupAdminTest(t, admin)
+	defer teardown()
+	ctx := context.Background()
+
+	members, err := rootClient.ListMembers(ctx, &api.ListMembersRequest{})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(members.Members))
+	require.Equal(t, "alive", members.Members[0].Status)
+
+	stream, err := rootClient.WatchMembers(ctx, &api.WatchMembersRequest{})
+	require.NoError(t, err)
+	e, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, api.MemberEventType_MEMBER_FAILED, e.Type)
+	require.Equal(t, "1", e.Member.Name)
+	// the watch ended, so the client is told to watch again
+	_, err = stream.Recv()
+	require.Equal(t, codes.Unavailable, status.Code(err))
+
+	stream, err = nobodyClient.WatchMembers(ctx, &api.WatchMembersRequest{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestAdminKeyring(t *testing.T) {
+	admin := &fakeAdmin{keys: map[string]int32{"old": 3}}
+	rootClient, nobodyClient, teardown := setupAdminTest(t, admin)
+	defer teardown()
+	ctx := context.Background()
+
+	_, err := rootClient.InstallKey(ctx, &api.KeyRequest{Key: "new"})
+	require.NoError(t, err)
+	_, err = rootClient.UseKey(ctx, &api.KeyRequest{Key: "new"})
+	require.NoError(t, err)
+	_, err = rootClient.RemoveKey(ctx, &api.KeyRequest{Key: "old"})
+	require.NoError(t, err)
+	res, err := rootClient.ListKeys(ctx, &api.ListKeysRequest{})
+	require.NoError(t, err)
+	require.Equal(t, map[string]int32{"new": 3}, res.Keys)
+	require.Equal(t, map[string]int32{"new": 3}, res.PrimaryKeys)
+
+	_, err = nobodyClient.ListKeys(ctx, &api.ListKeysRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = nobodyClient.InstallKey(ctx, &api.KeyRequest{Key: "evil"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	require.Equal(t, map[string]int32{"new": 3}, admin.keys)
+}
+
+func TestAdminEvents(t *testing.T) {
+	admin := &fakeAdmin{}
+	rootClient, nobodyClient, teardown := setupAdminTest(t, admin)
+	defer teardown()
+	ctx := context.Background()
+
+	_, err := rootClient.FireEvent(ctx, &api.FireEventRequest{
+		Name:    "flush",
+		Payload: []byte("now"),
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"flush:now"}, admin.events)
+
+	res, err := rootClient.FireQuery(ctx, &api.FireQueryRequest{
+		Name:    "ping",
+		Timeout: durationpb.New(time.Second),
+	})
+	require.NoError(t, err)
+	require.Equal(t, "ping", admin.events[1])
+	require.Equal(t, 2, len(res.Responses))
+	require.True(t, res.Responses[0].Responded)
+	require.False(t, res.Responses[1].Acked)
+
+	_, err = rootClient.FireEvent(ctx, &api.FireEventRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = nobodyClient.FireEvent(ctx, &api.FireEventRequest{Name: "evil"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = nobodyClient.FireQuery(ctx, &api.FireQueryRequest{Name: "evil"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	require.Equal(t, 2, len(admin.events))
+}
+
+func setupAdminTest(t *testing.T, admin *fakeAdmin) (
+	rootClient, nobodyClient api.AdminClient, teardown func(),
+) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	newClient := func(crtPath, keyPath string) (*grpc.ClientConn, api.AdminClient) {
+		tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+			CertFile: crtPath,
+			KeyFile:  keyPath,
+			CAFile:   config.CAFile,
+			Server:   false,
+		})
+		require.NoError(t, err)
+		tlsCreds := credentials.NewTLS(tlsConfig)
+		conn, err := grpc.Dial(l.Addr().String(), grpc.WithTransportCredentials(tlsCreds))
+		require.NoError(t, err)
+		return conn, api.NewAdminClient(conn)
+	}
+	rootConn, rootClient := newClient(config.RootClientCertFile, config.RootClientKeyFile)
+	nobodyConn, nobodyClient := newClient(config.NobodyClientCertFile, config.NobodyClientKeyFile)
+
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: l.Addr().String(),
+		Server:        true,
+	})
+	require.NoError(t, err)
+
+	server, err := NewGRPCServer(&Config{
+		Authorizer:     auth.New(config.ACLModelFile, config.ACLPolicyFile),
+		Admin:          admin,
+		Autopilot:      admin,
+		Membership:     admin,
+		Keyring:        admin,
+		Events:         admin,
+		Decommissioner: admin,
+	}, grpc.Creds(credentials.NewTLS(serverTLSConfig)))
+	require.NoError(t, err)
+	go func() {
+		server.Serve(l)
+	}()
+
+	return rootClient, nobodyClient, func() {
+		server.Stop()
+		rootConn.Close()
+		nobodyConn.Close()
+		l.Close()
+	}
+}
+
+type fakeAdmin struct {
+	servers   map[string]bool // id to voter
+	leader    string
+	notLeader bool             // the server is a follower of the leader
+	drain     time.Duration    // the timeout of the drain, once drained
+	barrier   bool             // whether a barrier was issued
+	keys      map[string]int32 // key to members
+	primary   string
+	events    []string // fired events and queries
+}
+
+func (a *fakeAdmin) TransferLeadership(id string) error {
+	a.leader = id
+	return nil
+}
+
+func (a *fakeAdmin) Join(id, addr string, voter bool) error {
+	a.servers[id] = voter
+	return nil
+}
+
+func (a *fakeAdmin) Leave(id string) error {
+	delete(a.servers, id)
+	return nil
+}
+
+func (a *fakeAdmin) GetServers() ([]*api.Server, error) {
+	var servers []*api.Server
+	for id := range a.servers {
+		servers = append(servers, &api.Server{
+			Id:       id,
+			RpcAddr:  "localhost:900" + id,
+			IsLeader: id == a.leader,
+		})
+	}
+	return servers, nil
+}
+
+func (a *fakeAdmin) RaftStats() (*api.RaftStats, error) {
+	if a.notLeader {
+		return nil, raft.ErrRaftShutdown
+	}
+	return &api.RaftStats{Term: 7}, nil
+}
+
+func (a *fakeAdmin) Barrier() error {
+	if a.notLeader {
+		return raft.ErrNotLeader
+	}
+	a.barrier = true
+	return nil
+}
+
+func (a *fakeAdmin) ClusterHealth() (*api.ClusterHealth, error) {
+	if a.notLeader {
+		return nil, raft.ErrNotLeader
+	}
+	return &api.ClusterHealth{Healthy: true, FailureTolerance: 1}, nil
+}
+
+func (a *fakeAdmin) ListMembers() ([]*api.Member, error) {
+	return []*api.Member{{Name: "0", Status: "alive", InRaft: true}}, nil
+}
+
+func (a *fakeAdmin) WatchMembers(ctx context.Context) (<-chan *api.MemberEvent, error) {
+	events := make(chan *api.MemberEvent, 1)
+	events <- &api.MemberEvent{
+		Type:   api.MemberEventType_MEMBER_FAILED,
+		Member: &api.Member{Name: "1", Status: "failed"},
+	}
+	close(events)
+	return events, nil
+}
+
+func (a *fakeAdmin) ListKeys() (*api.KeyringResponse, error) {
+	res := &api.KeyringResponse{
+		Keys:        a.keys,
+		PrimaryKeys: map[string]int32{},
+	}
+	if a.primary != "" {
+		res.PrimaryKeys[a.primary] = a.keys[a.primary]
+	}
+	return res, nil
+}
+
+func (a *fakeAdmin) InstallKey(key string) (*api.KeyringResponse, error) {
+	a.keys[key] = 3
+	return a.ListKeys()
+}
+
+func (a *fakeAdmin) UseKey(key string) (*api.KeyringResponse, error) {
+	a.primary = key
+	return a.ListKeys()
+}
+
+func (a *fakeAdmin) RemoveKey(key string) (*api.KeyringResponse, error) {
+	delete(a.keys, key)
+	return a.ListKeys()
+}
+
+func (a *fakeAdmin) FireEvent(name string, payload []byte) error {
+	a.events = append(a.events, name+":"+string(payload))
+	return nil
+}
+
+func (a *fakeAdmin) FireQuery(
+	name string, payload []byte, timeout time.Duration,
+) ([]*api.MemberResponse, error) {
+	a.events = append(a.events, name)
+	return []*api.MemberResponse{
+		{Member: "0", Acked: true, Responded: true, Payload: []byte("pong")},
+		{Member: "1"},
+	}, nil
+}
+
+func (a *fakeAdmin) Drain(timeout time.Duration) error {
+	a.drain = timeout
+	return nil
+}
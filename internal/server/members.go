@@ -0,0 +1,49 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	api "github.com/fedoroko/proglog/api/v1"
+)
+
+// NewMembersHandler serves the members over HTTP, at GET /members, for
+// the tools that don't speak gRPC. The clients are authorized by their
+// certificates, as over gRPC.
+func NewMembersHandler(config *Config) http.Handler {
+	h := &membersHandler{Config: config}
+	r := mux.NewRouter()
+	r.HandleFunc("/members", h.handleListMembers).Methods("GET")
+	return r
+}
+
+type membersHandler struct {
+	*Config
+}
+
+func (h *membersHandler) handleListMembers(w http.ResponseWriter, r *http.Request) {
+	sub := ""
+	if r.TLS != nil && len(r.TLS.VerifiedChains) != 0 {
+		sub = r.TLS.VerifiedChains[0][0].Subject.CommonName
+	}
+	if err := h.Authorizer.Authorize(sub, objectWildcard, listMembersAction); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	members, err := h.Membership.ListMembers()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	b, err := protojson.Marshal(&api.ListMembersResponse{Members: members})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
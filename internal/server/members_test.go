@@ -0,0 +1,60 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	api "github.com/fedoroko/proglog/api/v1"
+	"github.com/fedoroko/proglog/internal/auth"
+	"github.com/fedoroko/proglog/internal/config"
+)
+
+func TestMembersHandler(t *testing.T) {
+	srv := httptest.NewUnstartedServer(NewMembersHandler(&Config{
+		Authorizer: auth.New(config.ACLModelFile, config.ACLPolicyFile),
+		Membership: &fakeAdmin{},
+	}))
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: "127.0.0.1",
+		Server:        true,
+	})
+	require.NoError(t, err)
+	srv.TLS = serverTLSConfig
+	srv.StartTLS()
+	defer srv.Close()
+
+	get := func(certFile, keyFile string) *http.Response {
+		tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+			CertFile:      certFile,
+			KeyFile:       keyFile,
+			CAFile:        config.CAFile,
+			ServerAddress: "127.0.0.1",
+		})
+		require.NoError(t, err)
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		res, err := client.Get(srv.URL + "/members")
+		require.NoError(t, err)
+		return res
+	}
+
+	res := get(config.RootClientCertFile, config.RootClientKeyFile)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	b, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	var members api.ListMembersResponse
+	require.NoError(t, protojson.Unmarshal(b, &members))
+	require.Equal(t, "0", members.Members[0].Name)
+
+	res = get(config.NobodyClientCertFile, config.NobodyClientKeyFile)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusForbidden, res.StatusCode)
+}
@@ -25,9 +25,23 @@ import (
 )
 
 type Config struct {
-	CommitLog   CommitLog
+	CommitLog CommitLog
+	// Partitions, when set, serves the partitions other than the
+	// partition 0, which CommitLog serves.
+	Partitions  Partitions
 	Authorizer  Authorizer
 	GetServerer GetServerer
+	SessionLog  SessionLog
+	Admin       Admin
+	Drainer     Drainer
+	Autopilot   Autopilot
+	Membership  Membership
+	Keyring     Keyring
+	Events      Events
+	// Decommissioner, when set, serves the Drain admin RPC.
+	Decommissioner Decommissioner
+	// ServerWatcher, when set, serves WatchServers.
+	ServerWatcher ServerWatcher
 }
 
 const (
@@ -70,6 +84,9 @@ func NewGRPCServer(config *Config, opts ...grpc.ServerOption) (*grpc.Server, err
 	}
 
 	api.RegisterLogServer(gsrv, srv)
+	if config.Admin != nil {
+		api.RegisterAdminServer(gsrv, newAdminServer(config))
+	}
 	return gsrv, nil
 }
 
@@ -107,6 +124,16 @@ func setupOpenConsensus() error {
 }
 
 func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
+	release, err := s.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return s.produce(ctx, req)
+}
+
+func (s *grpcServer) produce(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
 	if err := s.Authorizer.Authorize(
 		subject(ctx),
 		objectWildcard,
@@ -114,6 +141,25 @@ func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api
 	); err != nil {
 		return nil, err
 	}
+	if req.Partition != 0 {
+		if s.Partitions == nil {
+			return nil, api.ErrUnknownPartition{Partition: req.Partition}
+		}
+		offset, err := s.Partitions.Append(req.Partition, req.Record)
+		if err != nil {
+			return nil, err
+		}
+
+		return &api.ProduceResponse{Offset: offset}, nil
+	}
+	if s.SessionLog != nil {
+		offset, token, err := s.SessionLog.AppendSession(req.Record)
+		if err != nil {
+			return nil, err
+		}
+
+		return &api.ProduceResponse{Offset: offset, Token: token}, nil
+	}
 	offset, err := s.CommitLog.Append(req.Record)
 	if err != nil {
 		return nil, err
@@ -123,6 +169,16 @@ func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api
 }
 
 func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
+	release, err := s.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return s.consume(ctx, req)
+}
+
+func (s *grpcServer) consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
 	if err := s.Authorizer.Authorize(
 		subject(ctx),
 		objectWildcard,
@@ -130,6 +186,28 @@ func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api
 	); err != nil {
 		return nil, err
 	}
+	if req.Partition != 0 {
+		if s.Partitions == nil {
+			return nil, api.ErrUnknownPartition{Partition: req.Partition}
+		}
+		if len(req.MinToken) != 0 {
+			return nil, status.Error(
+				codes.InvalidArgument,
+				"sessions are kept on the partition 0 only",
+			)
+		}
+		record, err := s.Partitions.Read(req.Partition, req.Offset)
+		if err != nil {
+			return nil, err
+		}
+
+		return &api.ConsumeResponse{Record: record}, nil
+	}
+	if s.SessionLog != nil && len(req.MinToken) != 0 {
+		if err := s.SessionLog.WaitForSession(ctx, req.MinToken); err != nil {
+			return nil, err
+		}
+	}
 	record, err := s.CommitLog.Read(req.Offset)
 	if err != nil {
 		return nil, err
@@ -139,12 +217,23 @@ func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api
 }
 
 func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
+	release, err := s.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	for {
 		req, err := stream.Recv()
 		if err != nil {
 			return err
 		}
-		res, err := s.Produce(stream.Context(), req)
+		// a stream open when the server starts draining takes no more
+		// records, so the drain doesn't wait on the client to close it
+		if s.Drainer != nil && s.Drainer.Draining() {
+			return api.ErrDraining{}
+		}
+		res, err := s.produce(stream.Context(), req)
 		if err != nil {
 			return err
 		}
@@ -156,15 +245,26 @@ func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 }
 
 func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_ConsumeStreamServer) error {
+	release, err := s.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	for {
 		select {
 		case <-stream.Context().Done():
 			return nil
 		default:
-			res, err := s.Consume(stream.Context(), req)
+			res, err := s.consume(stream.Context(), req)
 			switch {
 			case errors.Is(err, nil):
 			case errors.As(err, &api.ErrOffsetOutOfRange{}):
+				// a caught up stream tails the log, polling for the
+				// next record, unless the server is draining
+				if s.Drainer != nil && s.Drainer.Draining() {
+					return api.ErrDraining{}
+				}
 				continue
 			default:
 				return err
@@ -178,6 +278,19 @@ func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_Consu
 	}
 }
 
+// acquire admits a produce or consume call unless the server is draining.
+// The returned func releases the call once it's done.
+func (s *grpcServer) acquire() (func(), error) {
+	if s.Drainer == nil {
+		return func() {}, nil
+	}
+	if err := s.Drainer.Acquire(); err != nil {
+		return nil, err
+	}
+
+	return s.Drainer.Release, nil
+}
+
 func (s *grpcServer) GetServers(
 	ctx context.Context, req *api.GetServersRequest,
 ) (*api.GetServersResponse, error) {
@@ -188,15 +301,69 @@ func (s *grpcServer) GetServers(
 	return &api.GetServersResponse{Servers: servers}, nil
 }
 
+func (s *grpcServer) WatchServers(
+	req *api.WatchServersRequest, stream api.Log_WatchServersServer,
+) error {
+	if s.ServerWatcher == nil {
+		return status.Error(codes.Unimplemented, "watching servers is unavailable")
+	}
+	ctx := stream.Context()
+	servers, err := s.ServerWatcher.WatchServers(ctx)
+	if err != nil {
+		return err
+	}
+
+	for list := range servers {
+		if err = stream.Send(&api.GetServersResponse{Servers: list}); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	// the server is shutting down, the client has to watch another one
+	return status.Error(codes.Unavailable, "servers watch ended")
+}
+
 type GetServerer interface {
 	GetServers() ([]*api.Server, error)
 }
 
+// ServerWatcher pushes the servers as they change.
+type ServerWatcher interface {
+	// WatchServers sends the servers, then the servers again on every
+	// change, until the context is done. The channel is closed once the
+	// watch ends.
+	WatchServers(ctx context.Context) (<-chan []*api.Server, error)
+}
+
 type CommitLog interface {
 	Append(*api.Record) (uint64, error)
 	Read(uint64) (*api.Record, error)
 }
 
+// Partitions serves the partitions of a log running a raft group per
+// partition.
+type Partitions interface {
+	Append(partition uint32, record *api.Record) (uint64, error)
+	Read(partition uint32, offset uint64) (*api.Record, error)
+}
+
+// SessionLog provides read-your-writes consistency: appends return a token,
+// and reads carrying that token wait until the write is applied locally.
+type SessionLog interface {
+	AppendSession(*api.Record) (uint64, []byte, error)
+	WaitForSession(ctx context.Context, token []byte) error
+}
+
+// Drainer tracks produce and consume calls in flight, and rejects
+// new ones once the server starts draining.
+type Drainer interface {
+	Acquire() error
+	Release()
+	Draining() bool
+}
+
 type Authorizer interface {
 	Authorize(subject, object, action string) error
 }
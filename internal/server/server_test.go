@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
@@ -235,3 +236,141 @@ func testUnauthorized(t *testing.T, _, client api.LogClient, config *Config) {
 	gotCode = status.Code(err)
 	require.Equal(t, wantCode, gotCode)
 }
+
+func TestWatchServers(t *testing.T) {
+	watcher := &fakeServerWatcher{servers: make(chan []*api.Server, 2)}
+	watcher.servers <- []*api.Server{{Id: "0", IsLeader: true}}
+	watcher.servers <- []*api.Server{{Id: "0"}, {Id: "1", IsLeader: true}}
+	close(watcher.servers)
+	client, _, _, teardown := setupTest(t, func(config *Config) {
+		config.ServerWatcher = watcher
+	})
+	defer teardown()
+
+	stream, err := client.WatchServers(context.Background(), &api.WatchServersRequest{})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res.Servers))
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.True(t, res.Servers[1].IsLeader)
+	// the watch ended on the server's side
+	_, err = stream.Recv()
+	require.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+type fakeServerWatcher struct {
+	servers chan []*api.Server
+}
+
+func (w *fakeServerWatcher) WatchServers(ctx context.Context) (<-chan []*api.Server, error) {
+	return w.servers, nil
+}
+
+func TestProduceStreamDraining(t *testing.T) {
+	drainer := &fakeDrainer{}
+	client, _, _, teardown := setupTest(t, func(config *Config) {
+		config.Drainer = drainer
+	})
+	defer teardown()
+
+	stream, err := client.ProduceStream(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	}))
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	// the open stream takes no more records once the server drains
+	drainer.setDraining()
+	require.NoError(t, stream.Send(&api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hey planet")},
+	}))
+	_, err = stream.Recv()
+	require.Equal(t, api.ErrDraining{}.GRPCStatus().Message(), status.Convert(err).Message())
+}
+
+type fakeDrainer struct {
+	mu       sync.Mutex
+	draining bool
+}
+
+func (d *fakeDrainer) setDraining() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.draining = true
+}
+
+func (d *fakeDrainer) Acquire() error { return nil }
+
+func (d *fakeDrainer) Release() {}
+
+func (d *fakeDrainer) Draining() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.draining
+}
+
+func TestPartitions(t *testing.T) {
+	partitions := &fakePartitions{logs: make(map[uint32]*log.Log)}
+	for _, partition := range []uint32{1, 2} {
+		dir, err := ioutil.TempDir("", "server-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		partitions.logs[partition], err = log.NewLog(dir, log.Config{})
+		require.NoError(t, err)
+	}
+	client, _, config, teardown := setupTest(t, func(config *Config) {
+		config.Partitions = partitions
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	// each partition has its own offsets, the partition 0 is the commit log
+	for _, partition := range []uint32{0, 1, 2} {
+		produce, err := client.Produce(ctx, &api.ProduceRequest{
+			Record:    &api.Record{Value: []byte{byte(partition)}},
+			Partition: partition,
+		})
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), produce.Offset)
+	}
+	for _, partition := range []uint32{1, 2} {
+		consume, err := client.Consume(ctx, &api.ConsumeRequest{Partition: partition})
+		require.NoError(t, err)
+		require.Equal(t, []byte{byte(partition)}, consume.Record.Value)
+	}
+	record, err := config.CommitLog.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0}, record.Value)
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record:    &api.Record{Value: []byte("hello")},
+		Partition: 3,
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Partition: 1, MinToken: []byte("token")})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+type fakePartitions struct {
+	logs map[uint32]*log.Log
+}
+
+func (p *fakePartitions) Append(partition uint32, record *api.Record) (uint64, error) {
+	l, ok := p.logs[partition]
+	if !ok {
+		return 0, api.ErrUnknownPartition{Partition: partition}
+	}
+	return l.Append(record)
+}
+
+func (p *fakePartitions) Read(partition uint32, offset uint64) (*api.Record, error) {
+	l, ok := p.logs[partition]
+	if !ok {
+		return nil, api.ErrUnknownPartition{Partition: partition}
+	}
+	return l.Read(offset)
+}